@@ -0,0 +1,358 @@
+package mobile
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+	"github.com/emmansun/gmsm/sm2"
+)
+
+// The format identifier and version every config bundle carries.
+const (
+	configBundleFormat  = "vlan-config-bundle"
+	configBundleVersion = 1
+)
+
+// The group a CA-issued signing cert must carry to be allowed to sign config bundles on behalf of the
+// network CA.
+const configSignerGroup = "config-signer"
+
+// The ConfigBundle type is the signed envelope configs are delivered in.
+// @property {string} Format - Always "vlan-config-bundle".
+// @property {int} Version - The envelope version, currently 1.
+// @property {[]byte} Config - The signed configuration data.
+// @property {int64} IssuedAt - When the bundle was signed, in unix seconds.
+// @property {int64} ExpiresAt - When the bundle stops being valid, in unix seconds.
+// @property {string} Signer - The PEM encoded cert of the signer, either the network CA itself or a
+// signing cert the CA issued.
+// @property {[]byte} Signature - The signature over all of the above.
+type ConfigBundle struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	Config    []byte `json:"config"`
+	IssuedAt  int64  `json:"issued_at"`
+	ExpiresAt int64  `json:"expires_at"`
+	Signer    string `json:"signer"`
+	Signature []byte `json:"signature"`
+}
+
+// The VerifiedBundle type describes a config bundle that passed verification.
+// @property {string} Config - The configuration data inside the bundle.
+// @property {string} Signer - The name of the cert that signed the bundle.
+// @property {bool} Delegated - Whether the bundle was signed by a signing cert rather than the CA.
+// @property IssuedAt - When the bundle was signed.
+// @property ExpiresAt - When the bundle stops being valid.
+type VerifiedBundle struct {
+	Config    string
+	Signer    string
+	Delegated bool
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// The function `SignConfigBundle` wraps the configuration data in a signed `ConfigBundle` and returns
+// it as JSON. The signer is either the network CA or a signing cert the CA issued with the
+// "config-signer" group, and `signerKeyPEM` is its private key. The bundle expires after
+// `validSeconds`, or together with the signer cert when `validSeconds` is 0.
+func SignConfigBundle(configData string, signerCertPEM string, signerKeyPEM string, validSeconds int64) (string, error) {
+	signer, _, err := cert.UnmarshalCertificateFromPEM([]byte(signerCertPEM))
+	if err != nil {
+		return "", fmt.Errorf("error while unmarshaling signer cert: %s", err)
+	}
+
+	if !signer.Details.IsCA {
+		return "", errors.New("signer cert is not a signing cert")
+	}
+
+	now := time.Now()
+	if signer.Expired(now) {
+		return "", errors.New("signer cert is expired")
+	}
+
+	expires := signer.Details.NotAfter
+	if validSeconds > 0 {
+		expires = now.Add(time.Duration(validSeconds) * time.Second)
+	}
+
+	if expires.After(signer.Details.NotAfter) {
+		return "", errors.New("bundle would outlive the signer cert")
+	}
+
+	signerPEM, err := signer.MarshalToPEM()
+	if err != nil {
+		return "", err
+	}
+
+	b := ConfigBundle{
+		Format:    configBundleFormat,
+		Version:   configBundleVersion,
+		Config:    []byte(configData),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+		Signer:    string(signerPEM),
+	}
+
+	b.Signature, err = signBundle(signer.Details.Curve, []byte(signerKeyPEM), b.signedBytes())
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(b)
+}
+
+// The function `VerifyConfigBundle` verifies a config bundle against the PEM encoded network CA certs
+// and returns a JSON encoded `VerifiedBundle`. Bundles with an invalid signature, an untrusted signer
+// or that are expired are rejected.
+func VerifyConfigBundle(bundle string, caPEM string) (string, error) {
+	v, err := verifyConfigBundle([]byte(bundle), caPEM, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(v)
+}
+
+// The function `isConfigBundle` reports whether the data looks like a config bundle rather than plain
+// configuration data.
+func isConfigBundle(data string) bool {
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, "{") {
+		return false
+	}
+
+	var header struct {
+		Format string `json:"format"`
+	}
+
+	return json.Unmarshal([]byte(data), &header) == nil && header.Format == configBundleFormat
+}
+
+// The function `verifyConfigBundle` is the implementation behind `VerifyConfigBundle`. The CA has to
+// come from outside the bundle, so a bundle without a trusted CA is always rejected.
+func verifyConfigBundle(data []byte, caPEM string, now time.Time) (*VerifiedBundle, error) {
+	var b ConfigBundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid config bundle: %s", err)
+	}
+
+	if b.Format != configBundleFormat {
+		return nil, errors.New("not a config bundle")
+	}
+
+	if b.Version != configBundleVersion {
+		return nil, fmt.Errorf("unsupported config bundle version: %d", b.Version)
+	}
+
+	if strings.TrimSpace(caPEM) == "" {
+		return nil, errors.New("no trusted CA to verify the config bundle against")
+	}
+
+	cas, err := unmarshalCerts(caPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshaling CA certs: %s", err)
+	}
+
+	signer, _, err := cert.UnmarshalCertificateFromPEM([]byte(b.Signer))
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshaling signer cert: %s", err)
+	}
+
+	delegated, err := checkBundleSigner(signer, cas, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifyBundle(signer.Details.Curve, signer.Details.PublicKey, b.signedBytes(), b.Signature) {
+		return nil, errors.New("config bundle signature did not match")
+	}
+
+	issued, expires := time.Unix(b.IssuedAt, 0), time.Unix(b.ExpiresAt, 0)
+	if now.After(expires) {
+		return nil, errors.New("config bundle is expired")
+	}
+
+	if issued.After(now.Add(5 * time.Minute)) {
+		return nil, errors.New("config bundle is issued in the future")
+	}
+
+	return &VerifiedBundle{
+		Config:    string(b.Config),
+		Signer:    signer.Details.Name,
+		Delegated: delegated,
+		IssuedAt:  issued,
+		ExpiresAt: expires,
+	}, nil
+}
+
+// The function `checkBundleSigner` checks that the signer is one of the CAs, or a signing cert issued
+// by one of them, and reports which of the two it is.
+func checkBundleSigner(signer *cert.Certificate, cas []*cert.Certificate, now time.Time) (bool, error) {
+	if signer.Expired(now) {
+		return false, errors.New("signer cert is expired")
+	}
+
+	signerSum, err := signer.Sha256Sum()
+	if err != nil {
+		return false, err
+	}
+
+	for _, ca := range cas {
+		caSum, err := ca.Sha256Sum()
+		if err != nil {
+			return false, err
+		}
+
+		if caSum == signerSum {
+			return false, nil
+		}
+
+		if signer.Details.Issuer != caSum || !signer.Details.IsCA {
+			continue
+		}
+
+		if ca.Expired(now) {
+			return false, errors.New("issuing CA is expired")
+		}
+
+		if !signer.CheckSignature(ca.Details.PublicKey) {
+			return false, errors.New("signer cert signature did not match")
+		}
+
+		for _, g := range signer.Details.Groups {
+			if g == configSignerGroup {
+				return true, nil
+			}
+		}
+
+		return false, fmt.Errorf("signer cert lacks the %q group", configSignerGroup)
+	}
+
+	return false, errors.New("signer cert is not trusted by the network CA")
+}
+
+// The `signedBytes` method returns the bytes the bundle signature covers.
+func (b *ConfigBundle) signedBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(b.Format)
+	binary.Write(&buf, binary.BigEndian, int64(b.Version))
+	binary.Write(&buf, binary.BigEndian, b.IssuedAt)
+	binary.Write(&buf, binary.BigEndian, b.ExpiresAt)
+
+	for _, part := range [][]byte{[]byte(b.Signer), b.Config} {
+		binary.Write(&buf, binary.BigEndian, int64(len(part)))
+		buf.Write(part)
+	}
+
+	return buf.Bytes()
+}
+
+// The function `signBundle` signs a message with the PEM encoded signing key for the given curve:
+// Ed25519 for 25519 CAs, ECDSA for P256 and SM2 for SM2.
+func signBundle(curve cert.Curve, keyPEM []byte, msg []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("error while unmarshaling signer key: no PEM block found")
+	}
+	key := block.Bytes
+
+	switch curve {
+	case cert.Curve_X25519:
+		switch len(key) {
+		case ed25519.SeedSize:
+			return ed25519.Sign(ed25519.NewKeyFromSeed(key), msg), nil
+		case ed25519.PrivateKeySize:
+			return ed25519.Sign(ed25519.PrivateKey(key), msg), nil
+		}
+		return nil, errors.New("invalid ed25519 signing key")
+	case cert.Curve_P256:
+		priv, err := ecdsaPrivateKey(elliptic.P256(), key)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(msg)
+		return ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	case cert.Curve_SM2:
+		ecPriv, err := ecdsaPrivateKey(sm2.P256(), key)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := new(sm2.PrivateKey).FromECPrivateKey(ecPriv)
+		if err != nil {
+			return nil, err
+		}
+		return priv.Sign(rand.Reader, msg, sm2.DefaultSM2SignerOpts)
+	default:
+		return nil, fmt.Errorf("invalid curve")
+	}
+}
+
+// The function `verifyBundle` verifies a signature made by `signBundle`.
+func verifyBundle(curve cert.Curve, pub []byte, msg []byte, sig []byte) bool {
+	switch curve {
+	case cert.Curve_X25519:
+		return len(pub) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(pub), msg, sig)
+	case cert.Curve_P256:
+		x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+		if x == nil {
+			return false
+		}
+		digest := sha256.Sum256(msg)
+		return ecdsa.VerifyASN1(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest[:], sig)
+	case cert.Curve_SM2:
+		x, y := elliptic.Unmarshal(sm2.P256(), pub)
+		if x == nil {
+			return false
+		}
+		return sm2.VerifyASN1WithSM2(&ecdsa.PublicKey{Curve: sm2.P256(), X: x, Y: y}, nil, msg, sig)
+	default:
+		return false
+	}
+}
+
+// The function `ecdsaPrivateKey` builds an ECDSA private key from a raw scalar.
+func ecdsaPrivateKey(curve elliptic.Curve, scalar []byte) (*ecdsa.PrivateKey, error) {
+	d := new(big.Int).SetBytes(scalar)
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("invalid signing key")
+	}
+
+	priv := &ecdsa.PrivateKey{D: d}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(scalar)
+	return priv, nil
+}
+
+// The function `unmarshalCerts` unmarshals every cert in a PEM bundle.
+func unmarshalCerts(rawPEM string) ([]*cert.Certificate, error) {
+	var certs []*cert.Certificate
+	rest := []byte(rawPEM)
+
+	for strings.TrimSpace(string(rest)) != "" {
+		c, r, err := cert.UnmarshalCertificateFromPEM(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, c)
+		rest = r
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certs found")
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,83 @@
+package mobile
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+// The function `TestConfigBundle` tests signing and verifying config bundles for every curve, and that
+// bundles are rejected without a trusted CA, from a foreign CA or when tampered with.
+func TestConfigBundle(t *testing.T) {
+	configData := "punchy:\n  enable: true\n"
+
+	curves := map[string]cert.Curve{"ed25519": cert.Curve_X25519, "p256": cert.Curve_P256, "sm2": cert.Curve_SM2}
+	for name, curve := range curves {
+		t.Run(name, func(t *testing.T) {
+			ca, caPEM, caKey := newTestSigner(t, curve, "ca", nil, nil, nil)
+			_, foreignPEM, foreignKey := newTestSigner(t, curve, "foreign", nil, nil, nil)
+
+			bundle, err := SignConfigBundle(configData, caPEM, signingKeyPEM(caKey), 3600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := VerifyConfigBundle(bundle, caPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v VerifiedBundle
+			if err := json.Unmarshal([]byte(out), &v); err != nil {
+				t.Fatal(err)
+			}
+			if v.Config != configData || v.Signer != "ca" || v.Delegated {
+				t.Errorf("unexpected verified bundle: %+v", v)
+			}
+
+			if _, err := VerifyConfigBundle(bundle, ""); err == nil {
+				t.Error("expected a bundle without a trusted CA to be rejected")
+			}
+
+			foreign, err := SignConfigBundle(configData+"pki:\n  ca: "+strings.ReplaceAll(foreignPEM, "\n", "\\n")+"\n", foreignPEM, signingKeyPEM(foreignKey), 3600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := VerifyConfigBundle(foreign, caPEM); err == nil || !strings.Contains(err.Error(), "not trusted") {
+				t.Errorf("expected a bundle signed by a foreign CA to be rejected, got %v", err)
+			}
+			if _, err := prepareConfig(foreign, ""); err == nil {
+				t.Error("expected a bundle to be rejected without a CA even if it carries its own")
+			}
+
+			var b ConfigBundle
+			if err := json.Unmarshal([]byte(bundle), &b); err != nil {
+				t.Fatal(err)
+			}
+			b.Config = []byte("punchy:\n  enable: false\n")
+			tampered, _ := marshalJSON(b)
+			if _, err := VerifyConfigBundle(tampered, caPEM); err == nil || !strings.Contains(err.Error(), "signature") {
+				t.Errorf("expected a tampered bundle to be rejected, got %v", err)
+			}
+
+			_, signerPEM, signerKey := newTestSigner(t, curve, "ci", []string{configSignerGroup}, ca, caKey)
+			delegated, err := SignConfigBundle(configData, signerPEM, signingKeyPEM(signerKey), 3600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out, err := VerifyConfigBundle(delegated, caPEM); err != nil || !strings.Contains(out, `"Delegated":true`) {
+				t.Errorf("expected the delegated bundle to verify, got %s, %v", out, err)
+			}
+
+			_, otherPEM, otherKey := newTestSigner(t, curve, "ops", []string{"ops"}, ca, caKey)
+			other, err := SignConfigBundle(configData, otherPEM, signingKeyPEM(otherKey), 3600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := VerifyConfigBundle(other, caPEM); err == nil {
+				t.Error("expected a signing cert without the config-signer group to be rejected")
+			}
+		})
+	}
+}
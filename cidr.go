@@ -0,0 +1,190 @@
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// The function `SummarizeRoutes` takes a JSON encoded list of CIDRs and returns the JSON encoded `CIDR`
+// list of the smallest set of networks covering exactly the same addresses. Networks inside others are
+// dropped and adjacent networks are merged. Plain IPs are taken as single address networks. IPv4 and
+// IPv6 networks may be mixed, IPv4 come first.
+func SummarizeRoutes(cidrsJSON string) (string, error) {
+	prefixes, err := parseCIDRList(cidrsJSON)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalCIDRList(summarizePrefixes(prefixes))
+}
+
+// The function `SubtractRoutes` takes JSON encoded lists of CIDRs to include and exclude and returns
+// the JSON encoded `CIDR` list of the smallest set of networks covering the included addresses but
+// none of the excluded ones. It is used where the platform can only add routes, such as `VpnService`
+// before Android 13, to leave the local LAN and the tower addresses out of a default route.
+func SubtractRoutes(includeJSON string, excludeJSON string) (string, error) {
+	include, err := parseCIDRList(includeJSON)
+	if err != nil {
+		return "", fmt.Errorf("invalid include list: %s", err)
+	}
+
+	exclude, err := parseCIDRList(excludeJSON)
+	if err != nil {
+		return "", fmt.Errorf("invalid exclude list: %s", err)
+	}
+
+	return marshalCIDRList(subtractPrefixes(include, exclude))
+}
+
+// The function `parseCIDRList` decodes a JSON encoded list of CIDRs or IPs into masked prefixes. An
+// empty string is an empty list.
+func parseCIDRList(cidrsJSON string) ([]netip.Prefix, error) {
+	var list []string
+	if strings.TrimSpace(cidrsJSON) != "" {
+		if err := json.Unmarshal([]byte(cidrsJSON), &list); err != nil {
+			return nil, fmt.Errorf("expected a JSON list of CIDRs: %s", err)
+		}
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// The function `parsePrefix` parses a CIDR, or an IP as a single address network, and clears the host
+// bits. IPv4-mapped IPv6 addresses are taken as IPv4.
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+	}
+
+	if prefix.Addr().Is4In6() {
+		if prefix.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: IPv4-mapped prefix shorter than /96", s)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+
+	return prefix.Masked(), nil
+}
+
+// The function `summarizePrefixes` returns the smallest sorted set of prefixes covering the same
+// addresses as `prefixes`.
+func summarizePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	set := map[netip.Prefix]bool{}
+	for _, p := range prefixes {
+		set[p] = true
+	}
+
+	// Sorted by address and then by length, a prefix covering others comes right before them
+	var out []netip.Prefix
+	for _, p := range sortedPrefixes(set) {
+		if n := len(out); n > 0 && out[n-1].Bits() <= p.Bits() && out[n-1].Contains(p.Addr()) {
+			continue
+		}
+
+		out = append(out, p)
+		for n := len(out); n > 1; n = len(out) {
+			parent, ok := mergePrefixes(out[n-2], out[n-1])
+			if !ok {
+				break
+			}
+			out = append(out[:n-2], parent)
+		}
+	}
+
+	if out == nil {
+		out = []netip.Prefix{}
+	}
+	return out
+}
+
+// The function `subtractPrefixes` returns the smallest sorted set of prefixes covering the addresses
+// of `include` that are not in `exclude`.
+func subtractPrefixes(include, exclude []netip.Prefix) []netip.Prefix {
+	remaining := summarizePrefixes(include)
+	for _, ex := range summarizePrefixes(exclude) {
+		var next []netip.Prefix
+		for _, p := range remaining {
+			next = append(next, subtractPrefix(p, ex)...)
+		}
+		remaining = next
+	}
+
+	return summarizePrefixes(remaining)
+}
+
+// The function `subtractPrefix` returns the prefixes covering the addresses of `p` that are not in
+// `ex`. `p` is split in halves until no half partly overlaps `ex`, which gives at most one prefix per
+// bit of difference in length.
+func subtractPrefix(p, ex netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(ex) {
+		return []netip.Prefix{p}
+	}
+
+	if ex.Bits() <= p.Bits() {
+		return nil
+	}
+
+	lo, hi := splitPrefix(p)
+	return append(subtractPrefix(lo, ex), subtractPrefix(hi, ex)...)
+}
+
+// The function `splitPrefix` returns the lower and upper halves of a prefix, which must not be a
+// single address.
+func splitPrefix(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := p.Bits()
+	b := p.Addr().AsSlice()
+	b[bits/8] |= 0x80 >> (bits % 8)
+	hi, _ := netip.AddrFromSlice(b)
+
+	return netip.PrefixFrom(p.Addr(), bits+1), netip.PrefixFrom(hi, bits+1)
+}
+
+// The function `mergePrefixes` returns the parent of `a` and `b` if they are the two halves of it.
+func mergePrefixes(a, b netip.Prefix) (netip.Prefix, bool) {
+	if a.Bits() != b.Bits() || a.Bits() == 0 || a == b || a.Addr().Is4() != b.Addr().Is4() {
+		return netip.Prefix{}, false
+	}
+
+	parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+	if parent != netip.PrefixFrom(b.Addr(), b.Bits()-1).Masked() {
+		return netip.Prefix{}, false
+	}
+
+	return parent, true
+}
+
+// The function `marshalCIDRList` returns the JSON encoded `CIDR` list of the prefixes.
+func marshalCIDRList(prefixes []netip.Prefix) (string, error) {
+	list := make([]*CIDR, 0, len(prefixes))
+	for _, p := range prefixes {
+		c, err := ParseCIDR(p.String())
+		if err != nil {
+			return "", err
+		}
+		list = append(list, c)
+	}
+
+	return marshalJSON(list)
+}
@@ -0,0 +1,61 @@
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// The function `TestRouteArithmetic` tests summarizing and subtracting IPv4 and IPv6 routes.
+func TestRouteArithmetic(t *testing.T) {
+	networks := func(t *testing.T, s string, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var list []CIDR
+		if err := json.Unmarshal([]byte(s), &list); err != nil {
+			t.Fatal(err)
+		}
+
+		out := []string{}
+		for _, c := range list {
+			out = append(out, fmt.Sprintf("%s/%d", c.Network, c.MaskSize))
+		}
+		return out
+	}
+
+	s, err := SummarizeRoutes(`["10.0.1.0/24", "10.0.0.0/24", "10.0.2.0/23", "10.0.3.7", "2001:db8::/33", "2001:db8:8000::/33", "192.168.1.1/16"]`)
+	if got, want := networks(t, s, err), []string{"10.0.0.0/22", "192.168.0.0/16", "2001:db8::/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected summary %v, got %v", want, got)
+	}
+
+	s, err = SubtractRoutes(`["0.0.0.0/0"]`, `["0.0.0.0/1", "128.0.0.0/2", "203.0.113.1"]`)
+	remainder := networks(t, s, err)
+	if len(remainder) != 30 || remainder[0] != "192.0.0.0/5" || containsString(remainder, "203.0.113.0/24") {
+		t.Errorf("unexpected remainder %v", remainder)
+	}
+
+	// The remainder and the exclusions together must give back the included network
+	b, _ := json.Marshal(append(remainder, "0.0.0.0/1", "128.0.0.0/2", "203.0.113.1/32"))
+	s, err = SummarizeRoutes(string(b))
+	if got := networks(t, s, err); !reflect.DeepEqual(got, []string{"0.0.0.0/0"}) {
+		t.Errorf("expected the remainder and the exclusions to cover everything, got %v", got)
+	}
+
+	s, err = SubtractRoutes(`["::/0"]`, `["8000::/1", "::/2"]`)
+	if got := networks(t, s, err); !reflect.DeepEqual(got, []string{"4000::/2"}) {
+		t.Errorf("expected IPv6 remainder 4000::/2, got %v", got)
+	}
+
+	s, err = SubtractRoutes(`["10.0.0.0/8", "fd00::/8"]`, `["10.0.0.0/8"]`)
+	if got := networks(t, s, err); !reflect.DeepEqual(got, []string{"fd00::/8"}) {
+		t.Errorf("expected exclusions to only affect their family, got %v", got)
+	}
+
+	if _, err := SubtractRoutes(`["10.0.0.0/33"]`, ""); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+}
@@ -44,23 +44,27 @@ package mobile
 // specifies rules and settings related to network traffic filtering and security.
 // @property {string} Cipher - The `Cipher` property is a string that specifies the encryption cipher
 // to be used. It is used to encrypt and decrypt data during communication.
+// @property {int} ConfigVersion - The `ConfigVersion` property records which shape of the config the
+// file follows. `MigrateConfig` upgrades configs with an older version step by step. A config without
+// it is version 0, so it has no default and is only written into generated and migrated configs.
 type config struct {
-	Sync       Sync                `json:"sync,omitempty" yaml:"sync,omitempty"`
-	PKI        PKI                 `json:"pki,omitempty" yaml:"pki,omitempty"`
-	Points     map[string][]string `json:"points,omitempty" yaml:"points,omitempty"`
-	Tower      Tower               `json:"tower,omitempty" yaml:"tower,omitempty"`
-	Listen     Listen              `json:"listen,omitempty" yaml:"listen,omitempty"`
-	Punchy     Punchy              `json:"punchy,omitempty" yaml:"punchy,omitempty"`
-	SSH        ssh                 `json:"ssh,omitempty" yaml:"ssh,omitempty"`
-	Proxy      Proxy               `json:"proxy,omitempty" yaml:"proxy,omitempty"`
-	Tun        Tun                 `json:"tun,omitempty" yaml:"tun,omitempty"`
-	Logging    Logging             `json:"logging,omitempty" yaml:"logging,omitempty"`
-	Stats      Stats               `json:"stats,omitempty" yaml:"stats,omitempty"`
-	Handshakes Handshakes          `json:"handshakes,omitempty" yaml:"handshakes,omitempty"`
-	Timers     Timers              `json:"timers,omitempty" yaml:"timers,omitempty"`
-	PSK        PSK                 `json:"psk,omitempty" yaml:"psk,omitempty"`
-	Firewall   Firewall            `json:"firewall,omitempty" yaml:"firewall,omitempty"`
-	Cipher     string              `json:"cipher,omitempty" yaml:"cipher,omitempty"`
+	Sync          Sync                `json:"sync,omitempty" yaml:"sync,omitempty"`
+	PKI           PKI                 `json:"pki,omitempty" yaml:"pki,omitempty"`
+	Points        map[string][]string `json:"points,omitempty" yaml:"points,omitempty"`
+	Tower         Tower               `json:"tower,omitempty" yaml:"tower,omitempty"`
+	Listen        Listen              `json:"listen,omitempty" yaml:"listen,omitempty"`
+	Punchy        Punchy              `json:"punchy,omitempty" yaml:"punchy,omitempty"`
+	SSH           ssh                 `json:"ssh,omitempty" yaml:"ssh,omitempty"`
+	Proxy         Proxy               `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	Tun           Tun                 `json:"tun,omitempty" yaml:"tun,omitempty"`
+	Logging       Logging             `json:"logging,omitempty" yaml:"logging,omitempty"`
+	Stats         Stats               `json:"stats,omitempty" yaml:"stats,omitempty"`
+	Handshakes    Handshakes          `json:"handshakes,omitempty" yaml:"handshakes,omitempty"`
+	Timers        Timers              `json:"timers,omitempty" yaml:"timers,omitempty"`
+	PSK           PSK                 `json:"psk,omitempty" yaml:"psk,omitempty"`
+	Firewall      Firewall            `json:"firewall,omitempty" yaml:"firewall,omitempty"`
+	Cipher        string              `json:"cipher,omitempty" yaml:"cipher,omitempty"`
+	ConfigVersion int                 `json:"config_version,omitempty" yaml:"config_version,omitempty"`
 }
 
 // The Sync type represents a synchronization configuration with various properties.
@@ -78,13 +82,16 @@ type config struct {
 // synchronized data will be stored.
 // @property {string} Addition - The "Addition" property is an optional field that can be used to
 // provide additional information or configuration for the synchronization process.
+// @property {bool} RequireSigned - The `RequireSigned` property rejects fetched configs that are not
+// signed config bundles, so a plain config served in their place is never applied.
 type Sync struct {
-	Enable     bool   `json:"enable,omitempty" yaml:"enable,omitempty"`
-	Persistent bool   `json:"persistent,omitempty" yaml:"persistent,omitempty"`
-	Interval   string `json:"interval,omitempty" yaml:"interval,omitempty"`
-	Source     string `json:"source,omitempty" yaml:"source,omitempty"`
-	Store      string `json:"store,omitempty" yaml:"store,omitempty"`
-	Addition   string `json:"addition,omitempty" yaml:"addition,omitempty"`
+	Enable        bool   `json:"enable,omitempty" yaml:"enable,omitempty"`
+	Persistent    bool   `json:"persistent,omitempty" yaml:"persistent,omitempty"`
+	Interval      string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Source        string `json:"source,omitempty" yaml:"source,omitempty"`
+	Store         string `json:"store,omitempty" yaml:"store,omitempty"`
+	Addition      string `json:"addition,omitempty" yaml:"addition,omitempty"`
+	RequireSigned bool   `json:"require_signed,omitempty" yaml:"require_signed,omitempty"`
 }
 
 // The ExpiryCheck type represents an expiry check with optional fields for enabling/disabling, time
@@ -145,13 +152,28 @@ type PKI struct {
 // original server. It is used as a backup in case the original server becomes unavailable.
 // @property Records - The "Records" property is a map that stores DNS records. Each record consists of
 // a key-value pair, where the key is the domain name and the value is the corresponding IP address.
+// @property {string} Zone - The zone under which every point is published by the name of its cert,
+// such as "laptop-3.vlan" for the zone "vlan". Empty publishes no names.
+// @property {[]DNSUpstream} Upstreams - The upstreams the split DNS resolver of the app forwards the
+// queries for some domains to. Other names go to `Mirror`.
 type DNS struct {
-	Enable   bool              `json:"enable,omitempty" yaml:"enable,omitempty"`
-	Addr     string            `json:"addr,omitempty" yaml:"addr,omitempty"`
-	Port     int               `json:"port,omitempty" yaml:"port,omitempty"`
-	Interval int               `json:"interval,omitempty" yaml:"interval,omitempty"`
-	Mirror   string            `json:"mirror,omitempty" yaml:"mirror,omitempty"`
-	Records  map[string]string `json:"records,omitempty" yaml:"records,omitempty"`
+	Enable    bool              `json:"enable,omitempty" yaml:"enable,omitempty"`
+	Addr      string            `json:"addr,omitempty" yaml:"addr,omitempty"`
+	Port      int               `json:"port,omitempty" yaml:"port,omitempty"`
+	Interval  int               `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Mirror    string            `json:"mirror,omitempty" yaml:"mirror,omitempty"`
+	Records   map[string]string `json:"records,omitempty" yaml:"records,omitempty"`
+	Zone      string            `json:"zone,omitempty" yaml:"zone,omitempty"`
+	Upstreams []DNSUpstream     `json:"upstreams,omitempty" yaml:"upstreams,omitempty"`
+}
+
+// The DNSUpstream type routes the queries for some domains to dedicated DNS servers.
+// @property {[]string} Domains - The domains, each matching itself and every name below it.
+// @property {[]string} Servers - The servers, as IP or IP:port, or "tower" for the DNS services of the
+// towers. They are tried in order.
+type DNSUpstream struct {
+	Domains []string `json:"domains,omitempty" yaml:"domains,omitempty"`
+	Servers []string `json:"servers,omitempty" yaml:"servers,omitempty"`
 }
 
 // The Tower type represents a configuration for a service with DNS settings, interval, detection
@@ -159,13 +181,15 @@ type DNS struct {
 // @property {bool} Service - The `Service` property is a boolean value that indicates whether the
 // tower is a service or not. If it is set to `true`, it means the tower is a service. If it is set to
 // `false` or omitted, it means the tower is not a service.
+// @property {[]string} Hosts - The VPN IPs of the towers this point reports to. Each needs an entry
+// in `Points`.
 // @property {DNS} DNS - The `DNS` property is a struct that contains information related to DNS
 // configuration. It may include properties such as `Nameservers`, `SearchDomains`, `Options`, etc.
 // @property {int} Interval - The `Interval` property in the `Tower` struct represents the time
 // interval in seconds at which certain actions or checks should be performed. It specifies the
 // frequency at which the tower should perform its tasks or operations.
-// @property DetectionPoint - The `DetectionPoint` property is a nested map that represents the
-// detection points for the tower. It has the following structure:
+// @property DetectionPoint - The `DetectionPoint` property maps a network in CIDR notation to the list
+// of `DetectionPoint` entries probed for it.
 // @property RemoteAllowList - The `RemoteAllowList` property is a map where the keys are strings
 // representing remote addresses and the values are booleans indicating whether the remote address is
 // allowed or not. It is used to specify a list of remote addresses that are allowed to access the
@@ -179,14 +203,23 @@ type DNS struct {
 // @property {[]string} AdvertiseAddrs - AdvertiseAddrs is a slice of strings that represents the
 // addresses that the Tower should advertise for incoming connections.
 type Tower struct {
-	Service           bool                       `json:"service,omitempty" yaml:"service,omitempty"`
-	DNS               DNS                        `json:"dns,omitempty" yaml:"dns,omitempty"`
-	Interval          int                        `json:"interval,omitempty" yaml:"interval,omitempty"`
-	DetectionPoint    map[string]map[string]any  `json:"detection_point,omitempty" yaml:"detection_point,omitempty"`
-	RemoteAllowList   map[string]bool            `json:"remote_allow_list,omitempty" yaml:"remote_allow_list,omitempty"`
-	RemoteAllowRanges map[string]map[string]bool `json:"remote_allow_ranges,omitempty" yaml:"remote_allow_ranges,omitempty"`
-	LocalAllowList    map[string]any             `json:"local_allow_list,omitempty" yaml:"local_allow_list,omitempty"`
-	AdvertiseAddrs    []string                   `json:"advertise_addrs,omitempty" yaml:"advertise_addrs,omitempty"`
+	Service           bool                        `json:"service,omitempty" yaml:"service,omitempty"`
+	Hosts             []string                    `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	DNS               DNS                         `json:"dns,omitempty" yaml:"dns,omitempty"`
+	Interval          int                         `json:"interval,omitempty" yaml:"interval,omitempty"`
+	DetectionPoint    map[string][]DetectionPoint `json:"detection_point,omitempty" yaml:"detection_point,omitempty"`
+	RemoteAllowList   map[string]bool             `json:"remote_allow_list,omitempty" yaml:"remote_allow_list,omitempty"`
+	RemoteAllowRanges map[string]map[string]bool  `json:"remote_allow_ranges,omitempty" yaml:"remote_allow_ranges,omitempty"`
+	LocalAllowList    map[string]any              `json:"local_allow_list,omitempty" yaml:"local_allow_list,omitempty"`
+	AdvertiseAddrs    []string                    `json:"advertise_addrs,omitempty" yaml:"advertise_addrs,omitempty"`
+}
+
+// The DetectionPoint type represents a single detection point of a tower.
+// @property {string} Mask - The `Mask` property is the address in CIDR notation that is probed.
+// @property {int} Port - The `Port` property is the port that is probed.
+type DetectionPoint struct {
+	Mask string `json:"mask,omitempty" yaml:"mask,omitempty"`
+	Port int    `json:"port,omitempty" yaml:"port,omitempty"`
 }
 
 // The `Listen` type represents the configuration for a listening server.
@@ -418,7 +451,7 @@ type Logging struct {
 // @property {string} NameSpace - The `NameSpace` property is used to specify the namespace for the
 // stats. It is an optional field and can be used to categorize or group the stats based on a specific
 // namespace.
-// @property {string} Extention - The `Extention` property is used to specify the file extension for
+// @property {string} Extension - The `Extension` property is used to specify the file extension for
 // the stats. It is an optional property and can be omitted if not needed.
 // @property {string} Prefix - The "Prefix" property is used to specify a prefix that will be added to
 // the generated metrics. It is an optional property and can be omitted if not needed.
@@ -438,7 +471,7 @@ type Stats struct {
 	Listen         string `json:"listen,omitempty" yaml:"listen,omitempty"`
 	Path           string `json:"path,omitempty" yaml:"path,omitempty"`
 	NameSpace      string `json:"name_space,omitempty" yaml:"name_space,omitempty"`
-	Extention      string `json:"extention,omitempty" yaml:"extention,omitempty"`
+	Extension      string `json:"extension,omitempty" yaml:"extension,omitempty"`
 	Prefix         string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
 	Protocol       string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
 	Server         string `json:"server,omitempty" yaml:"server,omitempty"`
@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"runtime"
 	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
 
 	cfg "git.weixin.qq.com/__/vlan/lib/config"
 	"git.weixin.qq.com/__/vlan/lib/network/iputil"
@@ -21,10 +25,52 @@ import (
 // @property c - A pointer to an instance of the `Control` struct.
 // @property l - A pointer to a logger.Logger object.
 // @property config - The `config` property is a pointer to an object of type `cfg.C`.
+// @property apply - Hands a resolved configuration to the core, `config.ReloadConfigString` when nil.
+// @property reachable - Reports whether a tunnel to an endpoint is established, looked up in the core
+// when nil.
+// @property storeKey - The keystore key the config was decrypted with, nil for a plain config.
+// @property reloadMu - Serializes reload transactions.
+// @property mu - Guards the mutable state below.
+// @property listener - The `EventListener` that receives events, if any.
+// @property lastGood - The last configuration that was applied successfully, with references
+// unresolved.
+// @property active - The configuration currently applied, with references unresolved. It differs from
+// `lastGood` while a reload is verified.
+// @property applied - The settings handed to the core, resolved and with the runtime state layered. It
+// is read instead of `config`, which a reload replaces under `reloadMu`.
+// @property reloadGrace - How long a reloaded configuration gets to reach a tower.
+// @property reloadID - The ID of the most recent reload transaction.
+// @property lastReload - The result of the most recent reload transaction.
+// @property syncer - The state of the config sync subsystem.
+// @property firewall - The firewall rules added at runtime.
+// @property routes - The unsafe route changes made at runtime.
+// @property dns - The DNS record changes made at runtime.
+// @property resolver - The split DNS resolver.
 type Bulk struct {
-	c      *vlan.Control
-	l      *logger.Logger
-	config *cfg.C
+	c         *vlan.Control
+	l         *logger.Logger
+	config    *cfg.C
+	apply     func(resolved string) error
+	reachable func(ep iputil.Endpoint) bool
+	storeKey  []byte
+
+	reloadMu    sync.Mutex
+	mu          sync.Mutex
+	listener    EventListener
+	lastGood    string
+	active      string
+	applied     map[string]any
+	reloadGrace time.Duration
+	reloadID    int64
+	lastReload  *ReloadResult
+	syncer      syncState
+	firewall    firewallState
+	routes      routeState
+	dns         dnsState
+	resolver    dnsResolver
+
+	lastGoodRuntime runtimeState
+	activeRuntime   runtimeState
 }
 
 func init() {
@@ -33,8 +79,24 @@ func init() {
 }
 
 // The function `NewBulk` creates a new instance of the `Bulk` struct with the provided configuration
-// data, log file path, and tunnel file descriptor.
+// data, log file path, and tunnel file descriptor. Signed config bundles need a trusted CA, start
+// them with `NewBulkFromConfigBundle`.
 func NewBulk(configData string, logFile string, tunFd int) (*Bulk, error) {
+	return newBulk(configData, "", logFile, tunFd)
+}
+
+// The function `NewBulkFromConfigBundle` verifies a signed config bundle against the PEM encoded
+// network CA certs in `caPEM` and creates a `Bulk` instance from the config it carries.
+func NewBulkFromConfigBundle(bundle string, caPEM string, logFile string, tunFd int) (*Bulk, error) {
+	if !isConfigBundle(bundle) {
+		return nil, errors.New("not a config bundle")
+	}
+
+	return newBulk(bundle, caPEM, logFile, tunFd)
+}
+
+// The function `newBulk` is the implementation behind `NewBulk` and `NewBulkFromConfigBundle`.
+func newBulk(configData string, caPEM string, logFile string, tunFd int) (*Bulk, error) {
 	// GC more often, largely for iOS due to extension 15mb limit
 	debug.SetGCPercent(20)
 
@@ -45,8 +107,18 @@ func NewBulk(configData string, logFile string, tunFd int) (*Bulk, error) {
 	}
 	l.SetOutput(f)
 
+	configData, err = prepareConfig(configData, caPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := resolveConfig(configData)
+	if err != nil {
+		return nil, err
+	}
+
 	c := cfg.NewC(l)
-	err = c.LoadString(configData)
+	err = c.LoadString(resolved)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config: %s", err)
 	}
@@ -58,7 +130,40 @@ func NewBulk(configData string, logFile string, tunFd int) (*Bulk, error) {
 		return nil, err
 	}
 
-	return &Bulk{ctrl, l, c}, nil
+	applied, _ := loadSettings(resolved)
+	return &Bulk{
+		c:           ctrl,
+		l:           l,
+		config:      c,
+		lastGood:    configData,
+		active:      configData,
+		applied:     applied,
+		reloadGrace: defaultReloadGracePeriod,
+	}, nil
+}
+
+// The function `prepareConfig` turns configuration data as handed to `NewBulk` or `Reload` into plain
+// configuration data the core can load. Signed config bundles are verified against `caPEM` and
+// rejected when it is empty, and configs written for an older config version are migrated.
+func prepareConfig(configData string, caPEM string) (string, error) {
+	if isEncryptedConfig(configData) {
+		return "", errors.New("config is encrypted, decrypt it with DecryptConfig first")
+	}
+
+	if isConfigBundle(configData) {
+		v, err := verifyConfigBundle([]byte(configData), caPEM, time.Now())
+		if err != nil {
+			return "", fmt.Errorf("rejected config bundle: %s", err)
+		}
+		configData = v.Config
+	}
+
+	m, err := migrateConfig(configData)
+	if err != nil {
+		return "", err
+	}
+
+	return m.Config, nil
 }
 
 // The `Log` function is a method of the `Bulk` struct. It takes a string `v` as a parameter and logs
@@ -69,9 +174,11 @@ func (x *Bulk) Log(v string) {
 
 // The `Start()` method of the `Bulk` struct is used to start the execution of the `Control` instance
 // associated with the `Bulk` instance. It calls the `Start()` method of the `Control` instance, which
-// starts the main event loop and begins handling network traffic.
+// starts the main event loop and begins handling network traffic. If `sync.enable` is set, the config
+// sync loop is started as well.
 func (x *Bulk) Start() {
 	x.c.Start()
+	x.StartSync()
 }
 
 // The `ShutdownBlock()` method of the `Bulk` struct is used to block the execution of the program
@@ -87,6 +194,9 @@ func (x *Bulk) ShutdownBlock() {
 // associated with the `Bulk` instance. It calls the `Stop()` method of the `Control` instance, which
 // stops the main event loop and terminates the handling of network traffic.
 func (x *Bulk) Stop() {
+	x.StopSync()
+	x.StopSplitDNS()
+	x.stopRuntimeTimers()
 	x.c.Stop()
 }
 
@@ -101,14 +211,21 @@ func (x *Bulk) Rebind(reason string) {
 }
 
 // The `Reload` method of the `Bulk` struct is used to reload the configuration of the `Bulk` instance.
-// It takes a `configData` string as a parameter, which represents the new configuration data. Inside
-// the method, it calls the `ReloadConfigString` method of the `cfg.C` instance associated with the
-// `Bulk` instance. This method reloads the configuration using the provided `configData` string. If
-// there is an error during the reloading process, the method returns an error.
+// It takes a `configData` string as a parameter, which represents the new configuration data. A signed
+// config bundle is verified against the `pki.ca` of the running configuration first. The new
+// configuration is then applied as a transaction: if the core rejects it the last-known-good
+// configuration is restored and an error is returned. If towers were reachable before the reload and
+// none becomes reachable within the grace period, the last-known-good configuration is restored in
+// the background. Every outcome is also delivered as a "reload" event.
 func (x *Bulk) Reload(configData string) error {
 	x.l.Info("Reloading Nebula")
 
-	return x.config.ReloadConfigString(configData)
+	r := x.reload(configData)
+	if r.rejected() {
+		return fmt.Errorf("reload %s: %s", r.State, r.Reason)
+	}
+
+	return nil
 }
 
 // The `ListPendingPoints` method of the `Bulk` struct is used to retrieve a list of pending points. It
@@ -127,8 +244,12 @@ func (x *Bulk) ListPendingPoints(pending bool) (string, error) {
 // specific network point (endpoint). It takes two parameters: `endpoint` which is the IP address of
 // the network point, and `pending` which indicates whether to include pending points or not.
 func (x *Bulk) GetPointInfoByEndpoint(endpoint string, pending bool) (string, error) {
-	endpointInt := stringIpToInt(endpoint)
-	b, err := json.Marshal(x.c.GetpointByEndpoint(endpointInt, pending))
+	ep, err := parseEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(x.c.GetpointByEndpoint(ep, pending))
 	if err != nil {
 		return "", err
 	}
@@ -138,21 +259,31 @@ func (x *Bulk) GetPointInfoByEndpoint(endpoint string, pending bool) (string, er
 
 // The `CloseTunnel` method of the `Bulk` struct is used to close a tunnel associated with a specific
 // endpoint. It takes an `endpoint` string parameter, which represents the IP address of the network
-// point.
-func (x *Bulk) CloseTunnel(endpoint string) bool {
-	return x.c.CloseTunnel(stringIpToInt(endpoint), false)
+// point. It reports whether a tunnel was closed.
+func (x *Bulk) CloseTunnel(endpoint string) (bool, error) {
+	ep, err := parseEndpoint(endpoint)
+	if err != nil {
+		return false, err
+	}
+
+	return x.c.CloseTunnel(ep, false), nil
 }
 
 // The `SetRemoteForTunnel` method of the `Bulk` struct is used to set the remote address for a tunnel
 // associated with a specific endpoint. It takes two parameters: `endpoint` which is the IP address of
 // the network point, and `addr` which is the remote address to set for the tunnel.
 func (x *Bulk) SetRemoteForTunnel(endpoint string, addr string) (string, error) {
+	ep, err := parseEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+
 	udpAddr := udp.NewAddrFromString(addr)
 	if udpAddr == nil {
 		return "", errors.New("could not parse udp address")
 	}
 
-	b, err := json.Marshal(x.c.SetRemoteForTunnel(stringIpToInt(endpoint), *udpAddr))
+	b, err := json.Marshal(x.c.SetRemoteForTunnel(ep, *udpAddr))
 	if err != nil {
 		return "", err
 	}
@@ -169,6 +300,20 @@ func (x *Bulk) Sleep() {
 	}
 }
 
-func stringIpToInt(ip string) iputil.Endpoint {
-	return iputil.Ip2Endpoint(net.ParseIP(ip))
+// The function `parseEndpoint` parses the VPN IP of a point into the endpoint the core addresses it by.
+// The core keys points by their IPv4 VPN IP, so anything else is rejected instead of silently
+// addressing endpoint 0.
+func parseEndpoint(endpoint string) (iputil.Endpoint, error) {
+	ip, err := netip.ParseAddr(strings.TrimSpace(endpoint))
+	if err != nil {
+		return 0, fmt.Errorf("invalid endpoint %q: not an IP address", endpoint)
+	}
+
+	ip = ip.Unmap()
+	if !ip.Is4() || ip.IsUnspecified() {
+		return 0, fmt.Errorf("invalid endpoint %q: points are addressed by their IPv4 VPN IP", endpoint)
+	}
+
+	b := ip.As4()
+	return iputil.Ip2Endpoint(net.IP(b[:])), nil
 }
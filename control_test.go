@@ -0,0 +1,24 @@
+package mobile
+
+import "testing"
+
+// The function `TestEndpointValidation` tests that the endpoint-taking methods reject invalid
+// endpoints before they reach the core.
+func TestEndpointValidation(t *testing.T) {
+	x := &Bulk{}
+	for _, endpoint := range []string{"", "garbage", "10.1.0", "0.0.0.0", "fd00::1"} {
+		if _, err := x.GetPointInfoByEndpoint(endpoint, false); err == nil {
+			t.Errorf("GetPointInfoByEndpoint(%q): expected an error", endpoint)
+		}
+		if closed, err := x.CloseTunnel(endpoint); err == nil || closed {
+			t.Errorf("CloseTunnel(%q): expected an error", endpoint)
+		}
+		if _, err := x.SetRemoteForTunnel(endpoint, "203.0.113.1:4242"); err == nil {
+			t.Errorf("SetRemoteForTunnel(%q): expected an error", endpoint)
+		}
+	}
+
+	if _, err := parseEndpoint("::ffff:10.1.0.7"); err != nil {
+		t.Errorf("expected an IPv4-mapped endpoint to be accepted: %s", err)
+	}
+}
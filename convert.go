@@ -0,0 +1,115 @@
+package mobile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats `ConvertConfig` converts to.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// The function `ConvertConfig` converts configuration data to `targetFormat`, either "json" or "yaml".
+// The input may be either format. Keys are written in sorted order so the same settings always convert
+// to the same output, and multi-line strings such as PEM certs are written as YAML block scalars.
+// Comments are not carried over.
+func ConvertConfig(configData string, targetFormat string) (string, error) {
+	if isEncryptedConfig(configData) {
+		return "", errors.New("config is encrypted, decrypt it with DecryptConfig first")
+	}
+
+	if isConfigBundle(configData) {
+		return "", errors.New("signed config bundles can not be converted, convert the config before signing it")
+	}
+
+	settings, err := loadSettings(configData)
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.ToLower(targetFormat) {
+	case FormatJSON:
+		b, err := json.MarshalIndent(settings, "", "    ")
+		if err != nil {
+			return "", err
+		}
+		return string(b) + "\n", nil
+	case FormatYAML, "yml":
+		node, err := settingsNode(settings)
+		if err != nil {
+			return "", err
+		}
+
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(node); err != nil {
+			return "", err
+		}
+		if err := enc.Close(); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	default:
+		return "", fmt.Errorf("unknown format %q, expected json or yaml", targetFormat)
+	}
+}
+
+// The function `settingsNode` builds the YAML node of a settings tree with sorted keys, writing
+// multi-line strings as literal block scalars. Scalars are encoded by yaml.v3, which quotes strings
+// that would otherwise load as another type.
+func settingsNode(v any) (*yaml.Node, error) {
+	switch t := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, k := range keys {
+			key, err := settingsNode(k)
+			if err != nil {
+				return nil, err
+			}
+
+			val, err := settingsNode(t[k])
+			if err != nil {
+				return nil, err
+			}
+
+			node.Content = append(node.Content, key, val)
+		}
+		return node, nil
+	case []any:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, e := range t {
+			child, err := settingsNode(e)
+			if err != nil {
+				return nil, err
+			}
+
+			node.Content = append(node.Content, child)
+		}
+		return node, nil
+	default:
+		node := &yaml.Node{}
+		if err := node.Encode(t); err != nil {
+			return nil, err
+		}
+
+		if s, ok := t.(string); ok && strings.Contains(strings.TrimRight(s, "\n"), "\n") {
+			node.Style = yaml.LiteralStyle
+		}
+		return node, nil
+	}
+}
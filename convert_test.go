@@ -0,0 +1,71 @@
+package mobile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+// The function `TestConvertConfig` tests that JSON and YAML converted from the same config load to
+// identical settings, and that converting is stable.
+func TestConvertConfig(t *testing.T) {
+	_, caPEM, _ := newTestSigner(t, cert.Curve_X25519, "ca", nil, nil, nil)
+	jsonConfig := `{
+    "pki": {"ca": ` + mustJSON(t, caPEM) + `, "blocklist": []},
+    "points": {"6.6.6.6": ["120.92.140.174:35533"]},
+    "tower": {"dns": {"records": {"a.example.com": "yes", "b.example.com": "0700"}}},
+    "logging": {"level": "on", "format": ""},
+    "listen": {"port": 4242, "send_recv_error": "1.0"},
+    "firewall": {"inbound": [{"port": "any", "proto": "any", "groups": ["null", "true"]}]}
+}`
+
+	want, err := loadSettings(jsonConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yamlOut, err := ConvertConfig(jsonConfig, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(yamlOut, "ca: |") {
+		t.Errorf("expected the CA to be a block scalar:\n%s", yamlOut)
+	}
+
+	jsonOut, err := ConvertConfig(yamlOut, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, out := range map[string]string{"yaml": yamlOut, "json": jsonOut} {
+		got, err := loadSettings(out)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s output loads to different settings:\n%s", name, out)
+		}
+	}
+
+	again, err := ConvertConfig(jsonOut, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again != yamlOut {
+		t.Errorf("converting is not stable:\n%s\n%s", yamlOut, again)
+	}
+}
+
+// The function `mustJSON` returns `s` as a JSON string literal.
+func mustJSON(t *testing.T, s string) string {
+	b, err := marshalJSON(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
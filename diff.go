@@ -0,0 +1,242 @@
+package mobile
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The classes a changed configuration path can fall into.
+const (
+	// ChangeHotReloadable changes are applied by `Bulk.Reload` without interrupting traffic.
+	ChangeHotReloadable = "hot_reloadable"
+	// ChangeRequiresRehandshake changes are applied by `Bulk.Reload`, but existing tunnels only pick
+	// them up once they handshake again.
+	ChangeRequiresRehandshake = "requires_rehandshake"
+	// ChangeRequiresRestart changes are ignored by `Bulk.Reload` and only apply once `Bulk` is torn
+	// down and created again.
+	ChangeRequiresRestart = "requires_restart"
+)
+
+// The actions an app should take to apply a `ConfigDiff`.
+const (
+	DiffActionNone    = "none"
+	DiffActionReload  = "reload"
+	DiffActionRestart = "restart"
+)
+
+// The ConfigChange type represents a single changed path between two configurations.
+// @property {string} Path - The dotted path of the changed setting. Lists are compared as a whole, so
+// a change inside `tun.routes` is reported as `tun.routes`.
+// @property {string} Change - One of "added", "removed" or "modified".
+// @property Old - The value in the old configuration, nil when the path was added. Secrets are
+// replaced by the placeholders `RedactConfig` uses.
+// @property New - The value in the new configuration, nil when the path was removed.
+// @property {string} Class - How the change is applied: `ChangeHotReloadable`,
+// `ChangeRequiresRehandshake` or `ChangeRequiresRestart`.
+type ConfigChange struct {
+	Path   string
+	Change string
+	Old    any
+	New    any
+	Class  string
+}
+
+// The ConfigDiff type is the result of comparing two configurations.
+// @property {[]ConfigChange} Changes - The changed paths, sorted by path.
+// @property {bool} RequiresRehandshake - Whether any change only applies to new handshakes.
+// @property {bool} RequiresRestart - Whether any change is ignored by `Bulk.Reload`.
+// @property {string} Action - The least disruptive way to apply every change: `DiffActionNone`,
+// `DiffActionReload` or `DiffActionRestart`.
+type ConfigDiff struct {
+	Changes             []ConfigChange
+	RequiresRehandshake bool
+	RequiresRestart     bool
+	Action              string
+}
+
+// changeClasses maps path prefixes to the way the core applies them. The longest matching prefix wins
+// and paths that match nothing are treated as requiring a restart.
+var changeClasses = map[string]string{
+	// Read by this package alone, the core never sees a difference
+	"config_version":      ChangeHotReloadable,
+	"sync":                ChangeHotReloadable,
+	"tower.dns.zone":      ChangeHotReloadable,
+	"tower.dns.upstreams": ChangeHotReloadable,
+
+	"points":   ChangeHotReloadable,
+	"tower":    ChangeHotReloadable,
+	"punchy":   ChangeHotReloadable,
+	"logging":  ChangeHotReloadable,
+	"firewall": ChangeHotReloadable,
+	"ssh":      ChangeHotReloadable,
+
+	"pki.blocklist":          ChangeHotReloadable,
+	"pki.disconnect_invalid": ChangeHotReloadable,
+	"pki.expiry_check":       ChangeHotReloadable,
+	"pki":                    ChangeRequiresRehandshake,
+	"psk":                    ChangeRequiresRehandshake,
+
+	"listen.read_buffer":     ChangeHotReloadable,
+	"listen.write_buffer":    ChangeHotReloadable,
+	"listen.send_recv_error": ChangeHotReloadable,
+	"listen":                 ChangeRequiresRestart,
+
+	"tun.routes":      ChangeHotReloadable,
+	"tun.route_table": ChangeHotReloadable,
+	"tun":             ChangeRequiresRestart,
+
+	"tower.service":  ChangeRequiresRestart,
+	"tower.dns.addr": ChangeRequiresRestart,
+	"tower.dns.port": ChangeRequiresRestart,
+
+	"handshakes.try_interval": ChangeHotReloadable,
+	"handshakes":              ChangeRequiresRestart,
+
+	"cipher": ChangeRequiresRestart,
+	"stats":  ChangeRequiresRestart,
+	"timers": ChangeRequiresRestart,
+	"proxy":  ChangeRequiresRestart,
+}
+
+// The function `DiffConfigs` compares two configurations and returns a JSON encoded `ConfigDiff`
+// listing every changed path and whether `Bulk.Reload` can apply it. Both are compared as migrated to
+// the current config version, so a migration alone changes nothing.
+func DiffConfigs(oldConfig string, newConfig string) (string, error) {
+	d, err := diffConfigs(oldConfig, newConfig)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(d)
+}
+
+// The function `diffConfigs` is the implementation behind `DiffConfigs`.
+func diffConfigs(oldConfig string, newConfig string) (*ConfigDiff, error) {
+	oldSettings, err := migratedSettings(oldConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	newSettings, err := migratedSettings(newConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &ConfigDiff{Changes: []ConfigChange{}, Action: DiffActionNone}
+	diffValues("", oldSettings, newSettings, &d.Changes)
+	sort.Slice(d.Changes, func(i, j int) bool {
+		return d.Changes[i].Path < d.Changes[j].Path
+	})
+
+	for _, c := range d.Changes {
+		switch c.Class {
+		case ChangeRequiresRestart:
+			d.RequiresRestart = true
+		case ChangeRequiresRehandshake:
+			d.RequiresRehandshake = true
+		}
+	}
+
+	switch {
+	case d.RequiresRestart:
+		d.Action = DiffActionRestart
+	case len(d.Changes) > 0:
+		d.Action = DiffActionReload
+	}
+
+	return d, nil
+}
+
+// The function `diffValues` recursively compares two settings trees and appends every difference to
+// `changes`. Maps are descended into, every other value is compared as a whole. A section that is
+// missing or null on one side is treated as an empty map, so its leaves are classified one by one.
+func diffValues(path string, oldValue any, newValue any, changes *[]ConfigChange) {
+	oldMap, oldIsMap := oldValue.(map[string]any)
+	newMap, newIsMap := newValue.(map[string]any)
+
+	if (oldIsMap || oldValue == nil) && (newIsMap || newValue == nil) && (oldIsMap || newIsMap) {
+		for k, ov := range oldMap {
+			nv, ok := newMap[k]
+			if !ok {
+				diffPresence(joinPath(path, k), "removed", ov, changes)
+				continue
+			}
+			diffValues(joinPath(path, k), ov, nv, changes)
+		}
+
+		for k, nv := range newMap {
+			if _, ok := oldMap[k]; !ok {
+				diffPresence(joinPath(path, k), "added", nv, changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(oldValue, newValue) {
+		*changes = append(*changes, newConfigChange(path, "modified", oldValue, newValue))
+	}
+}
+
+// The function `diffPresence` appends the leaves of a value that only exists on one side. Non-empty
+// maps are descended into so every leaf gets its own path and class.
+func diffPresence(path string, change string, v any, changes *[]ConfigChange) {
+	if m, ok := v.(map[string]any); ok && len(m) > 0 {
+		for k, val := range m {
+			diffPresence(joinPath(path, k), change, val, changes)
+		}
+		return
+	}
+
+	if change == "added" {
+		*changes = append(*changes, newConfigChange(path, change, nil, v))
+	} else {
+		*changes = append(*changes, newConfigChange(path, change, v, nil))
+	}
+}
+
+// The function `newConfigChange` builds a `ConfigChange` and classifies its path.
+func newConfigChange(path string, change string, oldValue any, newValue any) ConfigChange {
+	// Secrets are replaced by keyed placeholders so a changed key shows up without leaking it
+	return ConfigChange{
+		Path:   path,
+		Change: change,
+		Old:    redactSettings(oldValue, splitPath(path)),
+		New:    redactSettings(newValue, splitPath(path)),
+		Class:  classifyPath(path),
+	}
+}
+
+// The function `migratedSettings` loads configuration data migrated to the current config version.
+func migratedSettings(configData string) (map[string]any, error) {
+	r, err := migrateConfig(configData)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadSettings(r.Config)
+}
+
+// The function `classifyPath` returns the change class of the longest prefix in `changeClasses` that
+// matches the path.
+func classifyPath(path string) string {
+	best := ""
+	class := ChangeRequiresRestart
+	for prefix, c := range changeClasses {
+		if (path == prefix || strings.HasPrefix(path, prefix+".")) && len(prefix) > len(best) {
+			best = prefix
+			class = c
+		}
+	}
+
+	return class
+}
+
+// The function `joinPath` appends a key to a dotted path.
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
@@ -0,0 +1,119 @@
+package mobile
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The function `TestDiffConfigs` tests that changed paths are classified by their leaves, including
+// sections that are missing on one side, and that a migration alone changes nothing.
+func TestDiffConfigs(t *testing.T) {
+	tests := []struct {
+		name       string
+		oldConfig  string
+		newConfig  string
+		wantPaths  map[string]string
+		wantAction string
+	}{
+		{
+			name:       "unchanged",
+			oldConfig:  "tun:\n  mtu: 1300\n",
+			newConfig:  "tun:\n  mtu: 1300\n",
+			wantPaths:  map[string]string{},
+			wantAction: DiffActionNone,
+		},
+		{
+			name:       "modified leaf",
+			oldConfig:  "punchy:\n  delay: 1s\n",
+			newConfig:  "punchy:\n  delay: 2s\n",
+			wantPaths:  map[string]string{"punchy.delay": ChangeHotReloadable},
+			wantAction: DiffActionReload,
+		},
+		{
+			name:       "section added",
+			oldConfig:  "punchy:\n  delay: 1s\n",
+			newConfig:  "punchy:\n  delay: 1s\ntun:\n  routes:\n    - route: 10.2.0.0/16\n      via: 10.1.0.1\n",
+			wantPaths:  map[string]string{"tun.routes": ChangeHotReloadable},
+			wantAction: DiffActionReload,
+		},
+		{
+			name:       "section removed",
+			oldConfig:  "tun:\n  routes:\n    - route: 10.2.0.0/16\n      via: 10.1.0.1\n",
+			newConfig:  "punchy:\n  delay: 1s\n",
+			wantPaths:  map[string]string{"tun.routes": ChangeHotReloadable, "punchy.delay": ChangeHotReloadable},
+			wantAction: DiffActionReload,
+		},
+		{
+			name:       "null section",
+			oldConfig:  "pki:\n",
+			newConfig:  "pki:\n  blocklist: [abc]\n",
+			wantPaths:  map[string]string{"pki.blocklist": ChangeHotReloadable},
+			wantAction: DiffActionReload,
+		},
+		{
+			name:       "nested section added",
+			oldConfig:  "tower:\n  interval: 60\n",
+			newConfig:  "tower:\n  interval: 60\n  dns:\n    port: 53\n    records:\n      a.vlan: 10.1.0.2\n",
+			wantPaths:  map[string]string{"tower.dns.port": ChangeRequiresRestart, "tower.dns.records.a.vlan": ChangeHotReloadable},
+			wantAction: DiffActionRestart,
+		},
+		{
+			name:       "package settings",
+			oldConfig:  "sync:\n  enable: false\n",
+			newConfig:  "sync:\n  enable: true\ntower:\n  dns:\n    zone: vlan\n    upstreams:\n      - domains: [corp.example]\n        servers: [tower]\n",
+			wantPaths:  map[string]string{"sync.enable": ChangeHotReloadable, "tower.dns.zone": ChangeHotReloadable, "tower.dns.upstreams": ChangeHotReloadable},
+			wantAction: DiffActionReload,
+		},
+		{
+			name:       "rehandshake",
+			oldConfig:  "pki:\n  cert: a\n",
+			newConfig:  "pki:\n  cert: b\n",
+			wantPaths:  map[string]string{"pki.cert": ChangeRequiresRehandshake},
+			wantAction: DiffActionReload,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := diffConfigs(tt.oldConfig, tt.newConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			paths := map[string]string{}
+			for _, c := range d.Changes {
+				paths[c.Path] = c.Class
+			}
+			if !reflect.DeepEqual(paths, tt.wantPaths) {
+				t.Errorf("expected changes %v, got %v", tt.wantPaths, paths)
+			}
+			if d.Action != tt.wantAction {
+				t.Errorf("expected action %s, got %s", tt.wantAction, d.Action)
+			}
+		})
+	}
+
+	d, err := diffConfigs("punchy:\n  delay: 1s\n", "tun:\n  routes: []\npunchy:\n  delay: 1s\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Changes) != 1 || d.Changes[0].Change != "added" || d.Changes[0].Old != nil {
+		t.Errorf("expected tun.routes to be reported as added, got %+v", d.Changes)
+	}
+
+	original := "stats:\n  type: prometheus\n  extention: {path: /metrics}\n"
+	m, err := migrateConfig(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Steps) == 0 {
+		t.Fatal("expected the config to be migrated")
+	}
+	d, err = diffConfigs(original, m.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Changes) != 0 || d.Action != DiffActionNone {
+		t.Errorf("expected a migration to change nothing for the core, got %+v", d)
+	}
+}
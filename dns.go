@@ -0,0 +1,608 @@
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+// The DNS record types.
+const (
+	DNSTypeA     = "A"
+	DNSTypeAAAA  = "AAAA"
+	DNSTypeCNAME = "CNAME"
+	DNSTypeTXT   = "TXT"
+)
+
+// The source of DNS records derived from cert names, besides "config" and "runtime".
+const RecordSourceCert = "cert"
+
+const (
+	defaultDNSTTL = 60
+	maxTXTLength  = 2048
+)
+
+// The DNSRecord type is a record of the tower DNS service as listed by `ListDNSRecords`.
+// @property {string} Name - The fully qualified name, lower case and without the trailing dot.
+// @property {string} Type - One of "A", "AAAA", "CNAME" or "TXT".
+// @property {string} Value - The address, the target name or the text of the record.
+// @property {int} TTL - The TTL of the record in seconds.
+// @property {string} Source - One of "config", "runtime" or "cert".
+// @property {bool} TowerDNS - Whether the tower DNS service of the core answers the record. The others,
+// such as TXT records, records derived from cert names, a name's AAAA record next to its A record and
+// CNAME records without an address to flatten to, are only answered by the split DNS resolver of
+// `StartSplitDNS`.
+type DNSRecord struct {
+	Name     string
+	Type     string
+	Value    string
+	TTL      int
+	Source   string
+	TowerDNS bool
+}
+
+// The dnsState type holds the DNS record changes made at runtime, keyed by name and type. Like runtime
+// firewall rules they are layered over `tower.dns.records` on every reload.
+// @property records - The records set at runtime.
+// @property order - The keys of `records`, in the order they were first set.
+// @property deleted - The keys of the records deleted at runtime.
+type dnsState struct {
+	records map[string]DNSRecord
+	order   []string
+	deleted map[string]bool
+}
+
+// The `empty` method reports whether no DNS record was changed at runtime.
+func (s *dnsState) empty() bool {
+	return len(s.order) == 0 && len(s.deleted) == 0
+}
+
+// The `clone` method returns a copy of the state to roll back to.
+func (s *dnsState) clone() dnsState {
+	c := dnsState{
+		records: make(map[string]DNSRecord, len(s.records)),
+		order:   append([]string{}, s.order...),
+		deleted: make(map[string]bool, len(s.deleted)),
+	}
+	for k, v := range s.records {
+		c.records[k] = v
+	}
+	for k, v := range s.deleted {
+		c.deleted[k] = v
+	}
+
+	return c
+}
+
+// The `SetDNSRecord` method sets a record of the tower DNS service, replacing the record of the same
+// name and type, and returns its JSON encoded `DNSRecord`. A `ttl` of 0 uses the default of 60
+// seconds. The `tower.dns.records` map of the core only holds one address per name, so it is given the
+// A record of a name, else its AAAA record, and CNAME records are flattened into it where their target
+// has an address. Records the core can not carry, such as TXT records, are only answered by the split
+// DNS resolver of the app, so setting them fails unless it runs.
+func (x *Bulk) SetDNSRecord(name string, recordType string, value string, ttl int) (string, error) {
+	r, err := newDNSRecord(name, recordType, value, ttl)
+	if err != nil {
+		return "", err
+	}
+	r.Source = RuleSourceRuntime
+
+	splitDNS := x.resolver.listenAddr().IsValid()
+	key := dnsKey(r.Name, r.Type)
+	err = x.changeDNS(func(s *dnsState, effective []DNSRecord) error {
+		for _, e := range effective {
+			if e.Name == r.Name && e.Type != r.Type && (e.Type == DNSTypeCNAME || r.Type == DNSTypeCNAME) {
+				return fmt.Errorf("%s already has a %s record, a CNAME record can not share its name", r.Name, e.Type)
+			}
+		}
+
+		if s.records == nil {
+			s.records = map[string]DNSRecord{}
+		}
+		if _, ok := s.records[key]; !ok {
+			s.order = append(s.order, key)
+		}
+		s.records[key] = r
+		delete(s.deleted, key)
+
+		if splitDNS {
+			return nil
+		}
+		for _, e := range x.dnsRecords(x.activeSettings()) {
+			if dnsKey(e.Name, e.Type) == key && !e.TowerDNS {
+				return fmt.Errorf("the tower DNS service can not answer %s %s, start the split DNS resolver to publish it", r.Name, r.Type)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	x.l.Info("Set DNS record %s %s %s", r.Name, r.Type, r.Value)
+	return marshalJSON(r)
+}
+
+// The `DeleteDNSRecord` method deletes the records of a name, only those of `recordType` unless it is
+// empty. Records of the config stay deleted across reloads; records derived from cert names can only
+// be overridden.
+func (x *Bulk) DeleteDNSRecord(name string, recordType string) error {
+	name, err := dnsName(name)
+	if err != nil {
+		return err
+	}
+
+	recordType = strings.ToUpper(strings.TrimSpace(recordType))
+	if recordType != "" {
+		if err := checkDNSType(recordType); err != nil {
+			return err
+		}
+	}
+
+	err = x.changeDNS(func(s *dnsState, effective []DNSRecord) error {
+		found := false
+		for _, e := range effective {
+			if e.Name != name || (recordType != "" && e.Type != recordType) {
+				continue
+			}
+			found = true
+
+			key := dnsKey(e.Name, e.Type)
+			if _, ok := s.records[key]; ok {
+				delete(s.records, key)
+				for i, k := range s.order {
+					if k == key {
+						s.order = append(s.order[:i:i], s.order[i+1:]...)
+						break
+					}
+				}
+			}
+
+			if s.deleted == nil {
+				s.deleted = map[string]bool{}
+			}
+			s.deleted[key] = true
+		}
+
+		if !found {
+			return fmt.Errorf("no DNS record %s %s", name, recordType)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	x.l.Info("Deleted DNS record %s %s", name, recordType)
+	return nil
+}
+
+// The `ListDNSRecords` method returns the JSON encoded `DNSRecord` list of the records of the tower
+// DNS service, sorted by name. When `tower.dns.zone` is set, every point with an established tunnel,
+// and this point itself, has A and AAAA records `<cert-name>.<zone>` for the IPs of its cert unless a
+// record of the config or set at runtime takes the name. These change with the tunnels, not with the
+// config, so they are answered by the split DNS resolver only; `TowerDNS` tells which records the core
+// answers as well.
+func (x *Bulk) ListDNSRecords() (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return marshalJSON(x.allDNSRecords())
+}
+
+// The `allDNSRecords` method returns the effective records including those derived from cert names.
+// The caller must hold `x.mu`.
+func (x *Bulk) allDNSRecords() []DNSRecord {
+	settings := x.activeSettings()
+	records := x.dnsRecords(settings)
+
+	zone, _ := lookupPath(settings, "tower.dns.zone")
+	if z, ok := zone.(string); ok && z != "" {
+		records = mergeCertRecords(records, certRecords(z, x.pointAddrs()))
+	}
+
+	sortDNSRecords(records)
+	return records
+}
+
+// The `changeDNS` method applies a change to the runtime DNS records as a reload transaction.
+func (x *Bulk) changeDNS(change func(s *dnsState, effective []DNSRecord) error) error {
+	changed := false
+	err := x.changeRuntime(func() error {
+		if err := change(&x.dns, x.dnsRecords(x.activeSettings())); err != nil {
+			return err
+		}
+		changed = true
+		return nil
+	})
+	if err != nil && changed {
+		return fmt.Errorf("failed to apply DNS records: %s", err)
+	}
+
+	return err
+}
+
+// The `dnsRecords` method layers the runtime DNS record changes over `tower.dns.records` of `settings`
+// and returns the effective records, without those derived from cert names, marking those the core
+// answers. The caller must hold `x.mu`.
+func (x *Bulk) dnsRecords(settings map[string]any) []DNSRecord {
+	raw, _ := lookupPath(settings, "tower.dns.records")
+	entries, isList := dnsRecordEntries(raw)
+
+	records := []DNSRecord{}
+	var layered []dnsRecordEntry
+	for _, e := range entries {
+		value := fmt.Sprint(e.value)
+		name, err := dnsName(e.name)
+		if err != nil {
+			layered = append(layered, e)
+			continue
+		}
+
+		r := DNSRecord{Name: name, Type: DNSTypeCNAME, Value: value, TTL: defaultDNSTTL, Source: RuleSourceConfig}
+		if ip, err := netip.ParseAddr(value); err == nil {
+			r.Type = DNSTypeA
+			if !ip.Unmap().Is4() {
+				r.Type = DNSTypeAAAA
+			}
+		}
+
+		key := dnsKey(r.Name, r.Type)
+		if x.dns.deleted[key] {
+			continue
+		}
+		if _, ok := x.dns.records[key]; ok {
+			continue
+		}
+
+		layered = append(layered, e)
+		records = append(records, r)
+	}
+
+	served := map[string]string{}
+	for _, e := range layered {
+		if name, err := dnsName(e.name); err == nil {
+			served[name] = fmt.Sprint(e.value)
+		}
+	}
+
+	for _, key := range x.dns.order {
+		records = append(records, x.dns.records[key])
+	}
+
+	// The core takes one address per name, A records first
+	for _, recordType := range []string{DNSTypeA, DNSTypeAAAA, DNSTypeCNAME} {
+		for _, r := range records {
+			if _, ok := served[r.Name]; ok || r.Type != recordType || r.Source != RuleSourceRuntime {
+				continue
+			}
+
+			if addr, ok := flattenCNAME(records, r); ok {
+				layered = append(layered, dnsRecordEntry{name: r.Name, value: addr})
+				served[r.Name] = addr
+			}
+		}
+	}
+
+	for i, r := range records {
+		addr, ok := flattenCNAME(records, r)
+		records[i].TowerDNS = ok && served[r.Name] == addr
+	}
+
+	if !x.dns.empty() {
+		setPath(settings, "tower.dns.records", dnsRecordsValue(layered, isList))
+	}
+	return records
+}
+
+// The dnsRecordEntry type is a name and value of `tower.dns.records`.
+type dnsRecordEntry struct {
+	name  string
+	value any
+}
+
+// The function `dnsRecordEntries` reads `tower.dns.records`, either a map of names to values or a list
+// of such maps, and reports whether it is a list. Map entries are sorted by name.
+func dnsRecordEntries(raw any) ([]dnsRecordEntry, bool) {
+	var entries []dnsRecordEntry
+	add := func(m map[string]any) {
+		names := make([]string, 0, len(m))
+		for k := range m {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		for _, k := range names {
+			entries = append(entries, dnsRecordEntry{name: k, value: m[k]})
+		}
+	}
+
+	switch t := raw.(type) {
+	case map[string]any:
+		add(t)
+	case []any:
+		for _, v := range t {
+			m, _ := v.(map[string]any)
+			add(m)
+		}
+		return entries, true
+	}
+
+	return entries, false
+}
+
+// The function `dnsRecordsValue` turns entries back into `tower.dns.records`, a list of single entry
+// maps if `isList` is set, else a map.
+func dnsRecordsValue(entries []dnsRecordEntry, isList bool) any {
+	if isList {
+		l := make([]any, 0, len(entries))
+		for _, e := range entries {
+			l = append(l, map[string]any{e.name: e.value})
+		}
+		return l
+	}
+
+	m := make(map[string]any, len(entries))
+	for _, e := range entries {
+		m[e.name] = e.value
+	}
+	return m
+}
+
+// The function `flattenCNAME` returns the address a record resolves to among `records`, following
+// CNAME records for a few hops.
+func flattenCNAME(records []DNSRecord, r DNSRecord) (string, bool) {
+	for hops := 0; hops < 8 && r.Type == DNSTypeCNAME; hops++ {
+		target, ok := addressRecord(records, r.Value)
+		if !ok {
+			return "", false
+		}
+		r = target
+	}
+
+	if r.Type != DNSTypeA && r.Type != DNSTypeAAAA {
+		return "", false
+	}
+	return r.Value, true
+}
+
+// The function `addressRecord` returns the record of a name the core's address map takes: its A
+// record, else its AAAA record, else its CNAME record.
+func addressRecord(records []DNSRecord, name string) (DNSRecord, bool) {
+	for _, recordType := range []string{DNSTypeA, DNSTypeAAAA, DNSTypeCNAME} {
+		for _, r := range records {
+			if r.Name == name && r.Type == recordType {
+				return r, true
+			}
+		}
+	}
+
+	return DNSRecord{}, false
+}
+
+// The `pointAddrs` method returns the VPN IPs of this point and of the points with an established
+// tunnel, keyed by the names of their certs. The caller must hold `x.mu`.
+func (x *Bulk) pointAddrs() map[string][]netip.Addr {
+	points := map[string][]netip.Addr{}
+	if rawCert, _ := lookupPath(x.appliedSettings(), "pki.cert"); rawCert != nil {
+		if s, _ := rawCert.(string); s != "" {
+			if c, _, err := cert.UnmarshalCertificateFromPEM([]byte(s)); err == nil {
+				for _, ipNet := range c.Details.Ips {
+					if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+						points[c.Details.Name] = append(points[c.Details.Name], ip.Unmap())
+					}
+				}
+			}
+		}
+	}
+
+	if x.c != nil {
+		for _, info := range x.c.ListProcessesPoints(false) {
+			name, addrs := pointCertAddrs(info)
+			if name != "" {
+				points[name] = append(points[name], addrs...)
+			}
+		}
+	}
+
+	return points
+}
+
+// The function `pointCertAddrs` returns the cert name and VPN IPs of a point as reported by the core.
+func pointCertAddrs(info any) (string, []netip.Addr) {
+	var v any
+	if b, err := json.Marshal(info); err == nil {
+		_ = json.Unmarshal(b, &v)
+	}
+
+	name, _ := lookupPath(v, "cert.details.name")
+	ips, _ := lookupPath(v, "cert.details.ips")
+	if name == nil {
+		return "", nil
+	}
+
+	var addrs []netip.Addr
+	list, _ := ips.([]any)
+	for _, e := range list {
+		if prefix, err := netip.ParsePrefix(fmt.Sprint(e)); err == nil {
+			addrs = append(addrs, prefix.Addr().Unmap())
+		} else if ip, err := netip.ParseAddr(fmt.Sprint(e)); err == nil {
+			addrs = append(addrs, ip.Unmap())
+		}
+	}
+
+	return fmt.Sprint(name), addrs
+}
+
+// The function `certRecords` returns the A and AAAA records `<cert-name>.<zone>` of the points. Cert
+// names are turned into DNS labels; names that leave nothing are skipped.
+func certRecords(zone string, points map[string][]netip.Addr) []DNSRecord {
+	zone, err := dnsName(zone)
+	if err != nil {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	records := []DNSRecord{}
+	for certName, addrs := range points {
+		label := dnsLabel(certName)
+		if label == "" {
+			continue
+		}
+
+		for _, ip := range addrs {
+			r := DNSRecord{Name: label + "." + zone, Type: DNSTypeA, Value: ip.String(), TTL: defaultDNSTTL, Source: RecordSourceCert}
+			if ip.Is6() {
+				r.Type = DNSTypeAAAA
+			}
+
+			if key := dnsKey(r.Name, r.Type) + "/" + r.Value; !seen[key] {
+				seen[key] = true
+				records = append(records, r)
+			}
+		}
+	}
+
+	return records
+}
+
+// The function `mergeCertRecords` adds the records derived from cert names to `records`, except where
+// a record of the config or set at runtime takes the name and type, or the name is a CNAME.
+func mergeCertRecords(records []DNSRecord, derived []DNSRecord) []DNSRecord {
+	taken := map[string]bool{}
+	for _, r := range records {
+		taken[dnsKey(r.Name, r.Type)] = true
+		if r.Type == DNSTypeCNAME {
+			taken[dnsKey(r.Name, DNSTypeA)] = true
+			taken[dnsKey(r.Name, DNSTypeAAAA)] = true
+		}
+	}
+
+	for _, r := range derived {
+		if !taken[dnsKey(r.Name, r.Type)] {
+			records = append(records, r)
+		}
+	}
+
+	return records
+}
+
+// The function `sortDNSRecords` sorts records by name, type and value.
+func sortDNSRecords(records []DNSRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Value < b.Value
+	})
+}
+
+// The function `newDNSRecord` validates a record and returns it in canonical form.
+func newDNSRecord(name, recordType, value string, ttl int) (DNSRecord, error) {
+	var r DNSRecord
+	name, err := dnsName(name)
+	if err != nil {
+		return r, err
+	}
+
+	recordType = strings.ToUpper(strings.TrimSpace(recordType))
+	if err := checkDNSType(recordType); err != nil {
+		return r, err
+	}
+
+	if ttl < 0 {
+		return r, errors.New("invalid TTL: must not be negative")
+	}
+	if ttl == 0 {
+		ttl = defaultDNSTTL
+	}
+
+	switch recordType {
+	case DNSTypeA, DNSTypeAAAA:
+		ip, err := netip.ParseAddr(strings.TrimSpace(value))
+		if err != nil || ip.Unmap().Is4() != (recordType == DNSTypeA) {
+			return r, fmt.Errorf("invalid %s record value %q", recordType, value)
+		}
+		value = ip.Unmap().String()
+	case DNSTypeCNAME:
+		target, err := dnsName(value)
+		if err != nil {
+			return r, fmt.Errorf("invalid CNAME record value: %s", err)
+		}
+		if target == name {
+			return r, errors.New("invalid CNAME record value: a name can not point to itself")
+		}
+		value = target
+	case DNSTypeTXT:
+		if value == "" || len(value) > maxTXTLength {
+			return r, fmt.Errorf("invalid TXT record value: must be 1 to %d bytes", maxTXTLength)
+		}
+	}
+
+	return DNSRecord{Name: name, Type: recordType, Value: value, TTL: ttl}, nil
+}
+
+// The function `checkDNSType` checks that a record type is supported.
+func checkDNSType(recordType string) error {
+	switch recordType {
+	case DNSTypeA, DNSTypeAAAA, DNSTypeCNAME, DNSTypeTXT:
+		return nil
+	default:
+		return fmt.Errorf("unsupported record type %q, expected A, AAAA, CNAME or TXT", recordType)
+	}
+}
+
+// The function `dnsName` validates a domain name and returns it lower case and without the trailing
+// dot.
+func dnsName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if name == "" || len(name) > 253 {
+		return "", fmt.Errorf("invalid DNS name %q", name)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("invalid DNS name %q", name)
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("invalid DNS name %q", name)
+			}
+		}
+	}
+
+	return name, nil
+}
+
+// The function `dnsLabel` turns a cert name such as "Laptop 3" into a DNS label such as "laptop-3".
+func dnsLabel(certName string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(certName) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+
+	label := strings.Trim(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+
+	return label
+}
+
+// The function `dnsKey` returns the key of a record in `dnsState`.
+func dnsKey(name, recordType string) string {
+	return name + "/" + recordType
+}
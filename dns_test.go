@@ -0,0 +1,147 @@
+package mobile
+
+import (
+	"encoding/json"
+	"io"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	cfg "git.weixin.qq.com/__/vlan/lib/config"
+	"git.weixin.qq.com/__/vlan/lib/utils/logs/logger"
+)
+
+// The function `TestDNSRecords` tests runtime DNS record changes and how they are handed to the core.
+func TestDNSRecords(t *testing.T) {
+	configData := "tower:\n  dns:\n    enable: true\n    zone: vlan\n    records:\n      nas.home: 10.1.0.20\n      old.home: 10.1.0.21\n"
+
+	l := logger.New(1000)
+	l.SetOutput(io.Discard)
+	c := cfg.NewC(l)
+	if err := c.LoadString(configData); err != nil {
+		t.Fatal(err)
+	}
+	x := &Bulk{l: l, config: c, lastGood: configData, active: configData}
+
+	if _, err := x.SetDNSRecord("printer.home", "a", "10.1.0.30", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.SetDNSRecord("Files.Home.", "CNAME", "nas.home", 300); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.SetDNSRecord("nas.home", "TXT", "v=1", 0); err == nil {
+		t.Error("expected a record the tower DNS can not answer to fail without split DNS")
+	}
+
+	if _, err := x.StartSplitDNS("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.StopSplitDNS()
+
+	if _, err := x.SetDNSRecord("nas.home", "TXT", "v=1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.SetDNSRecord("printer.home", "AAAA", "fd00::30", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.DeleteDNSRecord("old.home", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range [][3]string{
+		{"printer.home", "AAAA", "10.1.0.30"},
+		{"-bad.home", "A", "10.1.0.30"},
+		{"files.home", "A", "10.1.0.31"},
+		{"x.home", "MX", "mail.home"},
+	} {
+		if _, err := x.SetDNSRecord(bad[0], bad[1], bad[2], 0); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+
+	records, _ := normalizeValue(x.config.Get("tower.dns.records")).(map[string]any)
+	want := map[string]any{"nas.home": "10.1.0.20", "printer.home": "10.1.0.30", "files.home": "10.1.0.20"}
+	if len(records) != len(want) {
+		t.Errorf("expected the core to get %v, got %v", want, records)
+	}
+	for k, v := range want {
+		if records[k] != v {
+			t.Errorf("expected the core to get %v, got %v", want, records)
+		}
+	}
+
+	var list []DNSRecord
+	out, err := x.ListDNSRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 5 || list[0].Name != "files.home" || list[0].TTL != 300 || list[3].Type != DNSTypeA || list[3].Source != RuleSourceRuntime {
+		t.Errorf("unexpected records: %+v", list)
+	}
+
+	served := map[string]bool{}
+	for _, r := range list {
+		served[r.Name+" "+r.Type] = r.TowerDNS
+	}
+	wantServed := map[string]bool{
+		"files.home CNAME":  true,
+		"nas.home A":        true,
+		"nas.home TXT":      false,
+		"printer.home A":    true,
+		"printer.home AAAA": false,
+	}
+	for k, v := range wantServed {
+		if served[k] != v {
+			t.Errorf("expected %s to be answered by the core: %v, got %v", k, v, served[k])
+		}
+	}
+
+	derived := certRecords("vlan", map[string][]netip.Addr{
+		"Laptop 3": {netip.MustParseAddr("10.1.0.7"), netip.MustParseAddr("fd00::7")},
+		"???":      {netip.MustParseAddr("10.1.0.8")},
+	})
+	merged := mergeCertRecords([]DNSRecord{{Name: "laptop-3.vlan", Type: DNSTypeA, Value: "10.1.0.99"}}, derived)
+	sortDNSRecords(merged)
+	if len(merged) != 2 || merged[0].Value != "10.1.0.99" || merged[1].Type != DNSTypeAAAA || merged[1].Source != RecordSourceCert {
+		t.Errorf("unexpected records derived from cert names: %+v", merged)
+	}
+}
+
+// The function `TestDNSRecordsList` tests that `tower.dns.records` written as a list of maps, as in
+// older configs, is listed and kept when records are set at runtime.
+func TestDNSRecordsList(t *testing.T) {
+	configData := "tower:\n  dns:\n    enable: true\n    records:\n      - example.com: 192.168.1.113\n"
+
+	l := logger.New(1000)
+	l.SetOutput(io.Discard)
+	c := cfg.NewC(l)
+	if err := c.LoadString(configData); err != nil {
+		t.Fatal(err)
+	}
+	x := &Bulk{l: l, config: c, lastGood: configData, active: configData}
+
+	var list []DNSRecord
+	out, err := x.ListDNSRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "example.com" || list[0].Value != "192.168.1.113" || list[0].Source != RuleSourceConfig {
+		t.Errorf("expected the record of the config, got %+v", list)
+	}
+
+	if _, err := x.SetDNSRecord("nas.example.com", "A", "192.168.1.20", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	records := normalizeValue(x.config.Get("tower.dns.records"))
+	want := []any{map[string]any{"example.com": "192.168.1.113"}, map[string]any{"nas.example.com": "192.168.1.20"}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("expected the core to get %v, got %v", want, records)
+	}
+}
@@ -0,0 +1,259 @@
+package mobile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The PEM block type of an encrypted config.
+const encryptedConfigBanner = "VLAN ENCRYPTED CONFIG"
+
+// A platform keystore key is passed to `EncryptConfig` and `DecryptConfig` as this prefix followed by
+// the base64 encoding of 32 random bytes. Anything else is treated as a passphrase.
+const rawKeyPrefix = "key:"
+
+const (
+	encryptedConfigVersion = 1
+	encryptedConfigCipher  = "aes-256-gcm"
+	kdfArgon2id            = "argon2id"
+	kdfRaw                 = "raw"
+	encryptionKeySize      = 32
+)
+
+// The argon2id parameters used for passphrases, with memory in KiB. Memory is kept low enough for the
+// iOS network extension; the parameters are stored with every config so they can be raised later, but
+// never past 32 MiB, since the extension is killed at about 50 MiB.
+const (
+	argon2Time    = 4
+	argon2Memory  = 8 * 1024
+	argon2Threads = 1
+
+	maxArgon2Time    = 16
+	maxArgon2Memory  = 32 * 1024
+	maxArgon2Threads = 4
+)
+
+// The function `EncryptConfig` encrypts the configuration data for storage at rest and returns it as a
+// PEM block whose headers carry the format version and KDF parameters. `passphraseOrKey` is either a
+// passphrase, which is stretched with argon2id, or a keystore key in the form "key:<base64>".
+func EncryptConfig(configData string, passphraseOrKey string) (string, error) {
+	headers := map[string]string{
+		"Version": strconv.Itoa(encryptedConfigVersion),
+		"Cipher":  encryptedConfigCipher,
+	}
+
+	var key []byte
+	if raw, ok := strings.CutPrefix(passphraseOrKey, rawKeyPrefix); ok {
+		k, err := decodeRawKey(raw)
+		if err != nil {
+			return "", err
+		}
+		key = k
+		headers["KDF"] = kdfRaw
+	} else {
+		if passphraseOrKey == "" {
+			return "", errors.New("passphrase must not be empty")
+		}
+
+		salt := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return "", err
+		}
+
+		headers["KDF"] = kdfArgon2id
+		headers["Salt"] = base64.StdEncoding.EncodeToString(salt)
+		headers["Time"] = strconv.Itoa(argon2Time)
+		headers["Memory"] = strconv.Itoa(argon2Memory)
+		headers["Threads"] = strconv.Itoa(argon2Threads)
+		key = argon2.IDKey([]byte(passphraseOrKey), salt, argon2Time, argon2Memory, argon2Threads, encryptionKeySize)
+	}
+
+	return sealConfig([]byte(configData), key, headers)
+}
+
+// The function `DecryptConfig` decrypts configuration data produced by `EncryptConfig`. Tampering with
+// the ciphertext or any of its headers makes decryption fail.
+func DecryptConfig(encryptedConfig string, passphraseOrKey string) (string, error) {
+	block, headers, err := decodeEncryptedConfig(encryptedConfig)
+	if err != nil {
+		return "", err
+	}
+
+	var key []byte
+	switch headers["KDF"] {
+	case kdfRaw:
+		raw, ok := strings.CutPrefix(passphraseOrKey, rawKeyPrefix)
+		if !ok {
+			return "", errors.New("config is encrypted with a keystore key, not a passphrase")
+		}
+		key, err = decodeRawKey(raw)
+	case kdfArgon2id:
+		key, err = argon2Key(passphraseOrKey, headers)
+	default:
+		err = fmt.Errorf("unsupported KDF: %q", headers["KDF"])
+	}
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := openConfig(block, key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// The function `NewBulkFromEncryptedConfig` decrypts configuration data produced by `EncryptConfig`
+// with a 32 byte key held by the platform keystore and starts a `Bulk` instance from it, so the
+// plaintext config never has to be written to disk. Configs persisted by sync are encrypted with the
+// same key.
+func NewBulkFromEncryptedConfig(encryptedConfig string, key []byte, logFile string, tunFd int) (*Bulk, error) {
+	configData, err := DecryptConfig(encryptedConfig, rawKeyPrefix+base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config: %s", err)
+	}
+
+	x, err := NewBulk(configData, logFile, tunFd)
+	if err != nil {
+		return nil, err
+	}
+
+	x.storeKey = append([]byte(nil), key...)
+	return x, nil
+}
+
+// The function `sealConfig` encrypts the plaintext with AES-256-GCM, authenticating the headers as
+// additional data, and encodes the result as a PEM block.
+func sealConfig(plaintext []byte, key []byte, headers map[string]string) (string, error) {
+	aead, err := newConfigAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	headers["Nonce"] = base64.StdEncoding.EncodeToString(nonce)
+
+	block := &pem.Block{
+		Type:    encryptedConfigBanner,
+		Headers: headers,
+		Bytes:   aead.Seal(nil, nonce, plaintext, encryptedConfigAAD(headers)),
+	}
+
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// The function `openConfig` decrypts and authenticates a PEM block produced by `sealConfig`.
+func openConfig(block *pem.Block, key []byte) ([]byte, error) {
+	aead, err := newConfigAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+
+	plaintext, err := aead.Open(nil, nonce, block.Bytes, encryptedConfigAAD(block.Headers))
+	if err != nil {
+		return nil, errors.New("wrong key or corrupted config")
+	}
+
+	return plaintext, nil
+}
+
+// The function `decodeEncryptedConfig` decodes the PEM block of an encrypted config and checks its
+// version and cipher.
+func decodeEncryptedConfig(encryptedConfig string) (*pem.Block, map[string]string, error) {
+	block, _ := pem.Decode([]byte(encryptedConfig))
+	if block == nil || block.Type != encryptedConfigBanner {
+		return nil, nil, errors.New("not an encrypted config")
+	}
+
+	if v, _ := strconv.Atoi(block.Headers["Version"]); v != encryptedConfigVersion {
+		return nil, nil, fmt.Errorf("unsupported encrypted config version: %q", block.Headers["Version"])
+	}
+
+	if block.Headers["Cipher"] != encryptedConfigCipher {
+		return nil, nil, fmt.Errorf("unsupported cipher: %q", block.Headers["Cipher"])
+	}
+
+	return block, block.Headers, nil
+}
+
+// The function `isEncryptedConfig` reports whether the data is an encrypted config.
+func isEncryptedConfig(data string) bool {
+	return strings.HasPrefix(strings.TrimSpace(data), "-----BEGIN "+encryptedConfigBanner+"-----")
+}
+
+// The function `argon2Key` derives the key for a passphrase using the argon2id parameters in the
+// headers. The parameters are bounded so a crafted config can not exhaust the device.
+func argon2Key(passphrase string, headers map[string]string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(headers["Salt"])
+	if err != nil || len(salt) < 8 {
+		return nil, errors.New("invalid KDF salt")
+	}
+
+	t, err1 := strconv.ParseUint(headers["Time"], 10, 32)
+	m, err2 := strconv.ParseUint(headers["Memory"], 10, 32)
+	p, err3 := strconv.ParseUint(headers["Threads"], 10, 8)
+	if err1 != nil || err2 != nil || err3 != nil || t == 0 || p == 0 {
+		return nil, errors.New("invalid KDF parameters")
+	}
+
+	if t > maxArgon2Time || m > maxArgon2Memory || p > maxArgon2Threads {
+		return nil, errors.New("KDF parameters exceed the supported limits")
+	}
+
+	return argon2.IDKey([]byte(passphrase), salt, uint32(t), uint32(m), uint8(p), encryptionKeySize), nil
+}
+
+// The function `decodeRawKey` decodes a base64 keystore key.
+func decodeRawKey(raw string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("invalid key: expected %d bytes, got %d", encryptionKeySize, len(key))
+	}
+
+	return key, nil
+}
+
+// The function `newConfigAEAD` returns the AES-256-GCM AEAD for a key.
+func newConfigAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// The function `encryptedConfigAAD` serializes the headers that are authenticated alongside the
+// ciphertext, in a fixed order.
+func encryptedConfigAAD(headers map[string]string) []byte {
+	var sb strings.Builder
+	sb.WriteString(encryptedConfigBanner)
+	for _, k := range []string{"Version", "Cipher", "KDF", "Salt", "Time", "Memory", "Threads", "Nonce"} {
+		sb.WriteString("\n" + k + ":" + headers[k])
+	}
+
+	return []byte(sb.String())
+}
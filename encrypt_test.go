@@ -0,0 +1,86 @@
+package mobile
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The function `TestEncryptConfig` tests the round trip with a passphrase and a keystore key, and that
+// a wrong key, a tampered header or ciphertext and oversized KDF parameters are rejected.
+func TestEncryptConfig(t *testing.T) {
+	configData := "pki:\n  key: secret\n"
+	key := rawKeyPrefix + base64.StdEncoding.EncodeToString(make([]byte, encryptionKeySize))
+	otherKey := rawKeyPrefix + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", encryptionKeySize)))
+
+	for _, secret := range []string{"correct horse", key} {
+		encrypted, err := EncryptConfig(configData, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(encrypted, "secret") || !isEncryptedConfig(encrypted) {
+			t.Errorf("unexpected encrypted config:\n%s", encrypted)
+		}
+
+		decrypted, err := DecryptConfig(encrypted, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted != configData {
+			t.Errorf("expected %q, got %q", configData, decrypted)
+		}
+
+		for _, wrong := range []string{"wrong horse", otherKey} {
+			if _, err := DecryptConfig(encrypted, wrong); err == nil {
+				t.Errorf("expected decryption with %q to fail", wrong)
+			}
+		}
+	}
+
+	if _, err := EncryptConfig(configData, ""); err == nil {
+		t.Error("expected an empty passphrase to be rejected")
+	}
+	if _, err := EncryptConfig(configData, rawKeyPrefix+"c2hvcnQ="); err == nil {
+		t.Error("expected a short keystore key to be rejected")
+	}
+
+	encrypted, err := EncryptConfig(configData, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reencode rewrites the PEM block after `change` modified it
+	reencode := func(change func(b *pem.Block)) string {
+		b, _ := pem.Decode([]byte(encrypted))
+		change(b)
+		return string(pem.EncodeToMemory(b))
+	}
+
+	tampered := map[string]string{
+		"salt":       reencode(func(b *pem.Block) { b.Headers["Salt"] = base64.StdEncoding.EncodeToString([]byte("other salt")) }),
+		"time":       reencode(func(b *pem.Block) { b.Headers["Time"] = "3" }),
+		"ciphertext": reencode(func(b *pem.Block) { b.Bytes[0] ^= 1 }),
+		"version":    reencode(func(b *pem.Block) { b.Headers["Version"] = "2" }),
+		"kdf":        reencode(func(b *pem.Block) { b.Headers["KDF"] = kdfRaw }),
+	}
+	for name, data := range tampered {
+		if _, err := DecryptConfig(data, "correct horse"); err == nil {
+			t.Errorf("expected the config with a tampered %s to be rejected", name)
+		}
+	}
+
+	limits := map[string]string{
+		"Time":    strconv.Itoa(maxArgon2Time + 1),
+		"Memory":  strconv.Itoa(maxArgon2Memory + 1),
+		"Threads": strconv.Itoa(maxArgon2Threads + 1),
+	}
+	for header, v := range limits {
+		data := reencode(func(b *pem.Block) { b.Headers[header] = v })
+		if _, err := DecryptConfig(data, "correct horse"); err == nil || !strings.Contains(err.Error(), "limits") {
+			t.Errorf("expected %s %s to exceed the limits, got %v", header, v, err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package mobile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+const (
+	defaultEnrollTimeout = 30 * time.Second
+	defaultEnrollKeyName = "pki_key"
+	maxEnrollResponse    = 1 << 20
+)
+
+// The KeyStore interface is implemented by the app to keep private keys in the platform keystore, such
+// as the iOS Keychain or the Android Keystore.
+type KeyStore interface {
+	StoreKey(name string, keyPEM string) error
+}
+
+// The EnrollOptions type holds the options of `Enroll`.
+// @property {string} Name - The name the point asks to be enrolled as, if the endpoint allows it.
+// @property {string} KeyName - The name the private key is stored under, defaults to "pki_key".
+// @property {string} CAFingerprint - The sha256 fingerprint the CA returned by the endpoint must have.
+// It is required unless `AllowUnpinned` is set.
+// @property {bool} AllowUnpinned - Whether to trust the CA returned by the endpoint without a pinned
+// fingerprint. The cert is then only checked against that CA, which proves nothing about the endpoint.
+// @property {bool} OmitKey - Whether to write `pki.key` as a `${secret:<KeyName>}` reference instead of
+// the key itself, for apps that resolve it from the keystore through a `ConfigResolver`.
+// @property {int} Timeout - The request timeout in seconds, defaults to 30.
+type EnrollOptions struct {
+	Name          string `json:"name"`
+	KeyName       string `json:"key_name"`
+	CAFingerprint string `json:"ca_fingerprint"`
+	AllowUnpinned bool   `json:"allow_unpinned"`
+	OmitKey       bool   `json:"omit_key"`
+	Timeout       int    `json:"timeout"`
+}
+
+// The enrollRequest type is the body sent to the enrollment endpoint.
+type enrollRequest struct {
+	Token     string `json:"token"`
+	Curve     string `json:"curve"`
+	PublicKey string `json:"public_key"`
+	Name      string `json:"name,omitempty"`
+}
+
+// The enrollResponse type is the body the enrollment endpoint answers with.
+// @property Cert - The PEM encoded cert the CA signed for the public key.
+// @property CA - The PEM encoded network CA certs.
+// @property Config - The base config, either as an object or as configuration data. It may be a signed
+// config bundle.
+type enrollResponse struct {
+	Cert   string `json:"cert"`
+	CA     string `json:"ca"`
+	Config any    `json:"config"`
+}
+
+// The function `Enroll` joins a network with a one-time token. It generates a key pair for the curve
+// locally with `GenerateKeyPair`, sends the public key and token to the enrollment endpoint and
+// assembles the returned cert, CA and base config into a ready to use config, which it returns as
+// JSON. The private key never leaves the device and is handed to `store` once enrollment succeeded.
+// The endpoint must be an https URL and the CA it returns must match the pinned `ca_fingerprint`,
+// unless `allow_unpinned` is set. `optionsJSON` holds JSON encoded `EnrollOptions`.
+func Enroll(endpointURL string, token string, curve string, optionsJSON string, store KeyStore) (string, error) {
+	var opts EnrollOptions
+	if strings.TrimSpace(optionsJSON) != "" {
+		if err := json.Unmarshal([]byte(optionsJSON), &opts); err != nil {
+			return "", fmt.Errorf("invalid options: %s", err)
+		}
+	}
+
+	if store == nil {
+		return "", errors.New("a key store is required")
+	}
+
+	if token == "" {
+		return "", errors.New("an enrollment token is required")
+	}
+
+	u, err := url.Parse(endpointURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid enrollment endpoint %q: an https URL is required", endpointURL)
+	}
+
+	timeout := defaultEnrollTimeout
+	if opts.Timeout > 0 {
+		timeout = time.Duration(opts.Timeout) * time.Second
+	}
+
+	if opts.KeyName == "" {
+		opts.KeyName = defaultEnrollKeyName
+	}
+
+	return enroll(&http.Client{Timeout: timeout}, u.String(), token, curve, opts, store)
+}
+
+// The function `enroll` is the implementation behind `Enroll`, it enrolls through `client`.
+func enroll(client *http.Client, endpoint string, token string, curve string, opts EnrollOptions, store KeyStore) (string, error) {
+	if opts.CAFingerprint == "" && !opts.AllowUnpinned {
+		return "", errors.New("ca_fingerprint is required, set allow_unpinned to trust the CA the endpoint returns")
+	}
+
+	rawKeyPair, err := GenerateKeyPair(curve)
+	if err != nil {
+		return "", err
+	}
+
+	var kp KeyPair
+	if err := json.Unmarshal([]byte(rawKeyPair), &kp); err != nil {
+		return "", err
+	}
+
+	resp, err := postEnrollment(client, endpoint, enrollRequest{
+		Token:     token,
+		Curve:     curve,
+		PublicKey: kp.PublicKey,
+		Name:      opts.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	configData, err := assembleEnrollment(resp, kp.PrivateKey, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if err := store.StoreKey(opts.KeyName, kp.PrivateKey); err != nil {
+		return "", fmt.Errorf("failed to store private key: %s", err)
+	}
+
+	return configData, nil
+}
+
+// The function `postEnrollment` sends the enrollment request and decodes the response.
+func postEnrollment(client *http.Client, endpoint string, req enrollRequest) (*enrollResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, maxEnrollResponse+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(raw))
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return nil, fmt.Errorf("enrollment rejected: %s: %s", httpResp.Status, msg)
+	}
+
+	if len(raw) > maxEnrollResponse {
+		return nil, errors.New("enrollment response is too large")
+	}
+
+	var resp enrollResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, fmt.Errorf("invalid enrollment response: %s", err)
+	}
+
+	return &resp, nil
+}
+
+// The function `assembleEnrollment` checks the cert the endpoint returned against the generated key
+// and the CA, and merges both into the base config.
+func assembleEnrollment(resp *enrollResponse, keyPEM string, opts EnrollOptions) (string, error) {
+	if resp.Cert == "" || resp.CA == "" {
+		return "", errors.New("enrollment response lacks a cert or CA")
+	}
+
+	if ok, err := VerifyCertAndKey(resp.Cert, keyPEM); !ok {
+		return "", fmt.Errorf("enrolled cert does not match the generated key: %v", err)
+	}
+
+	c, _, err := cert.UnmarshalCertificateFromPEM([]byte(resp.Cert))
+	if err != nil {
+		return "", fmt.Errorf("error while unmarshaling cert: %s", err)
+	}
+
+	cas, err := unmarshalCerts(resp.CA)
+	if err != nil {
+		return "", fmt.Errorf("error while unmarshaling CA certs: %s", err)
+	}
+
+	if err := checkIssuer(c, cas, opts.CAFingerprint); err != nil {
+		return "", err
+	}
+
+	var base map[string]any
+	switch t := resp.Config.(type) {
+	case nil:
+		base = map[string]any{}
+	case string:
+		configData, err := prepareConfig(t, resp.CA)
+		if err != nil {
+			return "", err
+		}
+		if base, err = loadSettings(configData); err != nil {
+			return "", err
+		}
+	case map[string]any:
+		base = normalizeValue(t).(map[string]any)
+	default:
+		return "", errors.New("invalid enrollment response: config must be an object or configuration data")
+	}
+
+	pki := map[string]any{"ca": resp.CA, "cert": resp.Cert, "key": keyPEM}
+	if opts.OmitKey {
+		pki["key"] = "${" + RefSecret + ":" + opts.KeyName + "}"
+	}
+
+	return marshalJSON(mergeSettings(base, map[string]any{"pki": pki}))
+}
+
+// The function `checkIssuer` checks that the cert was signed by one of the CAs and, if a fingerprint
+// is pinned, that this CA has it.
+func checkIssuer(c *cert.Certificate, cas []*cert.Certificate, pinned string) error {
+	now := time.Now()
+	if c.Expired(now) {
+		return errors.New("enrolled cert is expired")
+	}
+
+	for _, ca := range cas {
+		sum, err := ca.Sha256Sum()
+		if err != nil {
+			return err
+		}
+
+		if pinned != "" && !strings.EqualFold(sum, pinned) {
+			continue
+		}
+
+		if ca.Expired(now) || !c.CheckSignature(ca.Details.PublicKey) {
+			continue
+		}
+
+		return nil
+	}
+
+	if pinned != "" {
+		return errors.New("enrolled cert was not signed by the pinned CA")
+	}
+
+	return errors.New("enrolled cert was not signed by the returned CA")
+}
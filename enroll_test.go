@@ -0,0 +1,188 @@
+package mobile
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+const enrollTestCA = "-----BEGIN VLAN CERTIFICATE-----\nCj4KDEhpUGVyIFB1YmxpYyjGs6mXBjDG49GrBzog7+h8wZVKgdU4Fh4pwaLekH6D\nn+J8rTcgwNN7YaxcSFJAARJAIEzWZa79d+2RJ+17pay9oEehsV9coLgP72M0XZkw\nff6hHY99VsTLAiXvExd6eYyKRhcriqlr0O7BR+k6/qcqDQ==\n-----END VLAN CERTIFICATE-----\n"
+
+const enrollTestCert = "-----BEGIN VLAN CERTIFICATE-----\nCmEKBHN3YXASCYGCnDiAgIDwDyjlgPyXBjDF49GrBzog0UtIu9+bcam6euyq4qJi\nO5PBr4pxuVc4PLWfTGhtVDdKIG7LJZr9vlShnmxQ1IMlsW0lREpZtd0bMFr3UVMv\nxoHlEkDdOgb49QHZKYfCI33ekvAvaM8VczepReCeQNg2vAmk9FXf8IpVKWTJBssA\ng42SwsBAaH1kpZlYZyqyEQxOTUUB\n-----END VLAN CERTIFICATE-----\n"
+
+// The type `memoryKeyStore` is a `KeyStore` that keeps keys in memory.
+type memoryKeyStore map[string]string
+
+func (s memoryKeyStore) StoreKey(name string, keyPEM string) error {
+	s[name] = keyPEM
+	return nil
+}
+
+// The function `TestEnroll` tests the enrollment request against a local enrollment server, that plain
+// http endpoints are refused and that a cert which does not match the generated key is rejected
+// without storing the key.
+func TestEnroll(t *testing.T) {
+	var got enrollRequest
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if got.Token != "one-time" {
+			http.Error(w, "unknown token", http.StatusForbidden)
+			return
+		}
+
+		// The fixture cert belongs to a different key than the one the client generated
+		json.NewEncoder(w).Encode(enrollResponse{
+			Cert:   enrollTestCert,
+			CA:     enrollTestCA,
+			Config: "punchy:\n  enable: true\n",
+		})
+	}))
+	defer srv.Close()
+
+	store := memoryKeyStore{}
+	plain := "http://" + strings.TrimPrefix(srv.URL, "https://")
+	if _, err := Enroll(plain, "one-time", "25519", "", store); err == nil || !strings.Contains(err.Error(), "https URL is required") {
+		t.Errorf("expected the http endpoint to be refused, got %v", err)
+	}
+
+	opts := EnrollOptions{KeyName: defaultEnrollKeyName, AllowUnpinned: true}
+	_, err := enroll(srv.Client(), srv.URL, "used", "25519", opts, store)
+	if err == nil || !strings.Contains(err.Error(), "unknown token") {
+		t.Errorf("expected the token to be rejected, got %v", err)
+	}
+
+	opts.Name = "phone"
+	_, err = enroll(srv.Client(), srv.URL, "one-time", "25519", opts, store)
+	if err == nil || !strings.Contains(err.Error(), "does not match the generated key") {
+		t.Errorf("expected the mismatching cert to be rejected, got %v", err)
+	}
+
+	if got.Curve != "25519" || got.Name != "phone" || !strings.Contains(got.PublicKey, "PUBLIC KEY") {
+		t.Errorf("unexpected enrollment request: %+v", got)
+	}
+
+	if strings.Contains(got.PublicKey, "PRIVATE") {
+		t.Error("private key was sent to the enrollment endpoint")
+	}
+
+	if len(store) != 0 {
+		t.Error("key was stored although enrollment failed")
+	}
+}
+
+// The function `TestEnrollSuccess` tests that an enrollment for every curve yields a config with the
+// issued cert, the CA and the generated key, stores the key and honours a pinned CA fingerprint. An
+// unpinned CA is only trusted when allowed, and never when it did not sign the cert.
+func TestEnrollSuccess(t *testing.T) {
+	curves := map[string]cert.Curve{"25519": cert.Curve_X25519, "P256": cert.Curve_P256, "SM2": cert.Curve_SM2}
+	for name, curve := range curves {
+		t.Run(name, func(t *testing.T) {
+			ca, caPEM, caKey := newTestSigner(t, curve, "ca", nil, nil, nil)
+			_, foreignPEM, _ := newTestSigner(t, curve, "foreign", nil, nil, nil)
+			returnedCA := caPEM
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req enrollRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				block, _ := pem.Decode([]byte(req.PublicKey))
+				if block == nil || req.Curve != name {
+					http.Error(w, "invalid public key", http.StatusBadRequest)
+					return
+				}
+
+				now := time.Now()
+				c := &cert.Certificate{Details: cert.CertificateDetails{
+					Name:      req.Name,
+					NotBefore: now.Add(-time.Hour),
+					NotAfter:  now.Add(time.Hour),
+					PublicKey: block.Bytes,
+					Curve:     curve,
+				}}
+				json.NewEncoder(w).Encode(enrollResponse{
+					Cert:   signTestCert(t, c, ca, caKey),
+					CA:     returnedCA,
+					Config: map[string]any{"punchy": map[string]any{"enable": true}},
+				})
+			}))
+			defer srv.Close()
+
+			sum, err := ca.Sha256Sum()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store := memoryKeyStore{}
+			opts := EnrollOptions{Name: "phone", KeyName: "vlan", CAFingerprint: strings.ToUpper(sum)}
+			configData, err := enroll(srv.Client(), srv.URL, "one-time", name, opts, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			settings, err := loadSettings(configData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pki, _ := settings["pki"].(map[string]any)
+			if pki["ca"] != caPEM || pki["key"] != store["vlan"] || len(store) != 1 {
+				t.Errorf("expected the CA and stored key in the config, got %v", pki)
+			}
+			if ok, err := VerifyCertAndKey(fmt.Sprint(pki["cert"]), store["vlan"]); !ok {
+				t.Errorf("expected the issued cert to match the stored key: %v", err)
+			}
+			if punchy, _ := settings["punchy"].(map[string]any); punchy["enable"] != true {
+				t.Errorf("expected the base config to be kept, got %v", settings)
+			}
+
+			opts.OmitKey = true
+			configData, err = enroll(srv.Client(), srv.URL, "one-time", name, opts, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(configData, "${secret:vlan}") {
+				t.Errorf("expected pki.key to reference the keystore, got %s", configData)
+			}
+
+			store = memoryKeyStore{}
+			opts.CAFingerprint = strings.Repeat("0", len(sum))
+			_, err = enroll(srv.Client(), srv.URL, "one-time", name, opts, store)
+			if err == nil || !strings.Contains(err.Error(), "pinned CA") {
+				t.Errorf("expected the unpinned CA to be rejected, got %v", err)
+			}
+			if len(store) != 0 {
+				t.Error("key was stored although the CA was not pinned")
+			}
+
+			opts.CAFingerprint = ""
+			_, err = enroll(srv.Client(), srv.URL, "one-time", name, opts, store)
+			if err == nil || !strings.Contains(err.Error(), "ca_fingerprint is required") {
+				t.Errorf("expected enrollment without a pinned CA to be refused, got %v", err)
+			}
+
+			opts.AllowUnpinned = true
+			returnedCA = foreignPEM
+			_, err = enroll(srv.Client(), srv.URL, "one-time", name, opts, store)
+			if err == nil || !strings.Contains(err.Error(), "not signed by the returned CA") {
+				t.Errorf("expected the mismatched unpinned CA to be refused, got %v", err)
+			}
+
+			returnedCA = caPEM
+			if _, err := enroll(srv.Client(), srv.URL, "one-time", name, opts, store); err != nil {
+				t.Errorf("expected the allowed unpinned CA to be trusted, got %v", err)
+			}
+		})
+	}
+}
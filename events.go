@@ -0,0 +1,49 @@
+package mobile
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The EventListener interface is implemented by the app to receive events from a `Bulk` instance.
+// Every event is delivered as a JSON encoded `Event`.
+type EventListener interface {
+	OnEvent(eventJSON string)
+}
+
+// The Event type represents something that happened inside a `Bulk` instance.
+// @property {string} Type - The kind of event, for example "reload".
+// @property Time - The time the event was raised.
+// @property Data - The event payload, its shape depends on `Type`.
+type Event struct {
+	Type string
+	Time time.Time
+	Data any
+}
+
+// The `SetEventListener` method registers the listener that receives events from the `Bulk` instance.
+// Passing nil stops event delivery.
+func (x *Bulk) SetEventListener(listener EventListener) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.listener = listener
+}
+
+// The `emit` method delivers an event to the registered listener, if any.
+func (x *Bulk) emit(eventType string, data any) {
+	x.mu.Lock()
+	listener := x.listener
+	x.mu.Unlock()
+
+	if listener == nil {
+		return
+	}
+
+	b, err := json.Marshal(Event{Type: eventType, Time: time.Now(), Data: data})
+	if err != nil {
+		x.l.Error("Failed to marshal %s event: %s", eventType, err)
+		return
+	}
+
+	listener.OnEvent(string(b))
+}
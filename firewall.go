@@ -0,0 +1,234 @@
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The directions of firewall rules.
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// The default actions of the firewall, applied to traffic no rule allows.
+const (
+	ActionDrop   = "drop"
+	ActionReject = "reject"
+)
+
+// The protocols a firewall rule can match.
+const (
+	ProtoAny  = "any"
+	ProtoTCP  = "tcp"
+	ProtoUDP  = "udp"
+	ProtoICMP = "icmp"
+)
+
+// The firewallRule type is a single firewall rule as written in `firewall.inbound` or
+// `firewall.outbound`. Every rule allows traffic, and traffic no rule allows gets the default action.
+// A rule matches a peer if it is `any`, if the peer carries all of `Groups`, or if the peer cert is
+// named `Point`.
+type firewallRule struct {
+	Port   string
+	Proto  string
+	Point  string
+	Groups []string
+}
+
+// The portRange type is a parsed firewall port. The zero value matches any port.
+// @property start - The first port of the range.
+// @property end - The last port of the range.
+// @property fragment - Whether the rule matches fragmented packets, which carry no port.
+type portRange struct {
+	start    int
+	end      int
+	fragment bool
+}
+
+// The function `firewallRuleFrom` reads a rule from its settings. Ports may be written as numbers and
+// groups as a single string.
+func firewallRuleFrom(v any) firewallRule {
+	m, _ := v.(map[string]any)
+
+	var r firewallRule
+	if p, ok := m["port"]; ok && p != nil {
+		r.Port = fmt.Sprint(p)
+	}
+	if p, ok := m["proto"].(string); ok {
+		r.Proto = p
+	}
+	if p, ok := m["point"].(string); ok {
+		r.Point = p
+	}
+
+	switch g := m["groups"].(type) {
+	case string:
+		r.Groups = []string{g}
+	case []any:
+		for _, e := range g {
+			r.Groups = append(r.Groups, fmt.Sprint(e))
+		}
+	}
+
+	return r
+}
+
+// The function `firewallSettings` returns the rules and the default action of a direction. A missing
+// default action is `drop`.
+func firewallSettings(settings map[string]any, direction string) ([]firewallRule, string) {
+	entries, _ := lookupPath(settings, "firewall."+direction)
+	list, _ := entries.([]any)
+
+	rules := make([]firewallRule, 0, len(list))
+	for _, e := range list {
+		rules = append(rules, firewallRuleFrom(e))
+	}
+
+	action, _ := lookupPath(settings, "firewall."+direction+"_action")
+	s, _ := action.(string)
+	if s == "" {
+		s = ActionDrop
+	}
+
+	return rules, s
+}
+
+// The function `parsePort` parses a firewall port: `any`, `fragment`, a single port or a range such
+// as `200-901`. Port 0 means any port.
+func parsePort(s string) (portRange, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	switch s {
+	case "", "any":
+		return portRange{}, nil
+	case "fragment":
+		return portRange{fragment: true}, nil
+	}
+
+	first, last, isRange := strings.Cut(s, "-")
+	start, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+
+	end := start
+	if isRange {
+		if end, err = strconv.Atoi(strings.TrimSpace(last)); err != nil {
+			return portRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+
+	if start < 0 || end > 65535 {
+		return portRange{}, fmt.Errorf("port range %q is out of bounds", s)
+	}
+
+	if start > end {
+		return portRange{}, fmt.Errorf("port range %q ends before it starts", s)
+	}
+
+	if isRange && start == 0 {
+		return portRange{}, fmt.Errorf("port range %q starts at 0", s)
+	}
+
+	return portRange{start: start, end: end}, nil
+}
+
+// The function `parseProto` parses a firewall protocol.
+func parseProto(s string) (string, error) {
+	switch p := strings.ToLower(strings.TrimSpace(s)); p {
+	case "", ProtoAny:
+		return ProtoAny, nil
+	case ProtoTCP, ProtoUDP, ProtoICMP:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid proto %q, expected any, tcp, udp or icmp", s)
+	}
+}
+
+// The function `checkFirewallRule` validates a rule of `direction`. Outbound rules have no groups in
+// the core, which would ignore them and apply the rule to every point.
+func checkFirewallRule(direction string, r firewallRule) error {
+	if _, err := parsePort(r.Port); err != nil {
+		return err
+	}
+
+	if _, err := parseProto(r.Proto); err != nil {
+		return err
+	}
+
+	if direction == DirectionOutbound && len(r.Groups) > 0 {
+		return errors.New("groups are not supported on outbound rules")
+	}
+
+	if r.Point == "" && len(r.Groups) == 0 {
+		return errors.New("at least one of point or groups must be set")
+	}
+
+	return nil
+}
+
+// The function `checkFirewallAction` validates a default action.
+func checkFirewallAction(action string) error {
+	switch action {
+	case ActionDrop, ActionReject:
+		return nil
+	default:
+		return fmt.Errorf("invalid action %q, expected drop or reject", action)
+	}
+}
+
+// The `any` method reports whether the rule matches every peer.
+func (r firewallRule) any() bool {
+	return r.Point == "any" || containsString(r.Groups, "any")
+}
+
+// The `isAny` method reports whether the range matches every port.
+func (p portRange) isAny() bool {
+	return !p.fragment && p.start == 0 && p.end == 0
+}
+
+// The `covers` method reports whether every port `o` matches is matched by `p` too.
+func (p portRange) covers(o portRange) bool {
+	switch {
+	case p.isAny():
+		return true
+	case p.fragment || o.fragment:
+		return p.fragment == o.fragment
+	case o.isAny():
+		return false
+	default:
+		return p.start <= o.start && o.end <= p.end
+	}
+}
+
+// The function `describeRule` returns a short description of a rule, such as `tcp/22 groups admin`.
+func describeRule(r firewallRule) string {
+	proto, _ := parseProto(r.Proto)
+	port := r.Port
+	if port == "" {
+		port = "any"
+	}
+
+	var who []string
+	if r.Point != "" {
+		who = append(who, "point "+r.Point)
+	}
+	if len(r.Groups) > 0 {
+		who = append(who, "groups "+strings.Join(r.Groups, ","))
+	}
+
+	return fmt.Sprintf("%s/%s %s", proto, port, strings.Join(who, " or "))
+}
+
+// The function `containsString` reports whether `list` contains `s`.
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,303 @@
+package mobile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The severities of lint findings.
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+// The kinds of lint findings.
+const (
+	LintInvalidRule    = "invalid_rule"
+	LintInvalidPort    = "invalid_port"
+	LintInvalidAction  = "invalid_action"
+	LintShadowed       = "shadowed"
+	LintUnreachable    = "unreachable"
+	LintOverlyBroad    = "overly_broad"
+	LintUnknownGroup   = "unknown_group"
+	LintUnknownPoint   = "unknown_point"
+	LintActionConflict = "action_conflict"
+)
+
+// The LintFinding type is a single problem found by `LintFirewall`.
+// @property {string} Severity - Either "error", the core rejects the rule, or "warning".
+// @property {string} Kind - What is wrong, one of the `Lint*` kinds.
+// @property {string} Direction - Either "inbound" or "outbound".
+// @property {int} Rule - The index of the rule in `firewall.<direction>`, -1 for the default action.
+// @property {int} Related - The index of the rule causing the problem, such as the shadowing rule, or
+// -1.
+// @property {string} Message - A human readable description.
+type LintFinding struct {
+	Severity  string
+	Kind      string
+	Direction string
+	Rule      int
+	Related   int
+	Message   string
+}
+
+// The LintResult type is the result of `LintFirewall`.
+// @property {[]LintFinding} Findings - The problems found, by direction and rule.
+// @property {int} Errors - The number of findings with severity "error".
+// @property {int} Warnings - The number of findings with severity "warning".
+type LintResult struct {
+	Findings []LintFinding
+	Errors   int
+	Warnings int
+}
+
+// The certIdentity type is what firewall rules match a peer cert by.
+type certIdentity struct {
+	name   string
+	groups []string
+}
+
+// The function `LintFirewall` checks the firewall rules of the configuration data and returns a JSON
+// encoded `LintResult`. It reports invalid rules and port ranges, rules shadowed by a broader rule,
+// overly broad inbound rules and default actions that never apply. When `knownCertsPEM` holds the certs
+// of the network, rules naming groups or points no cert carries, and rules no cert can match, are
+// reported too.
+func LintFirewall(configData string, knownCertsPEM string) (string, error) {
+	settings, err := loadSettings(configData)
+	if err != nil {
+		return "", err
+	}
+
+	var idents []certIdentity
+	if strings.TrimSpace(knownCertsPEM) != "" {
+		certs, err := unmarshalCerts(knownCertsPEM)
+		if err != nil {
+			return "", fmt.Errorf("error while unmarshaling known certs: %s", err)
+		}
+
+		for _, c := range certs {
+			if !c.Details.IsCA {
+				idents = append(idents, certIdentity{name: c.Details.Name, groups: c.Details.Groups})
+			}
+		}
+	}
+
+	return marshalJSON(lintFirewall(settings, idents))
+}
+
+// The function `lintFirewall` is the implementation behind `LintFirewall`. Identity checks are skipped
+// when `idents` is empty.
+func lintFirewall(settings map[string]any, idents []certIdentity) *LintResult {
+	r := &LintResult{Findings: []LintFinding{}}
+	for _, direction := range []string{DirectionInbound, DirectionOutbound} {
+		rules, action := firewallSettings(settings, direction)
+		l := &firewallLinter{direction: direction, idents: idents, result: r}
+		l.lint(rules, action)
+	}
+
+	for _, f := range r.Findings {
+		if f.Severity == LintError {
+			r.Errors++
+		} else {
+			r.Warnings++
+		}
+	}
+
+	return r
+}
+
+// The firewallLinter type lints the rules of a single direction.
+type firewallLinter struct {
+	direction string
+	idents    []certIdentity
+	result    *LintResult
+}
+
+// The `report` method adds a finding.
+func (l *firewallLinter) report(severity, kind string, rule, related int, format string, args ...any) {
+	l.result.Findings = append(l.result.Findings, LintFinding{
+		Severity:  severity,
+		Kind:      kind,
+		Direction: l.direction,
+		Rule:      rule,
+		Related:   related,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+// The `lint` method runs every check on the rules of the direction.
+func (l *firewallLinter) lint(rules []firewallRule, action string) {
+	actionKey := l.direction + "_action"
+	if err := checkFirewallAction(action); err != nil {
+		l.report(LintError, LintInvalidAction, -1, -1, "%s: %s", actionKey, err)
+	}
+
+	valid := make([]bool, len(rules))
+	for i, rule := range rules {
+		if _, err := parsePort(rule.Port); err != nil {
+			l.report(LintError, LintInvalidPort, i, -1, "%s", err)
+			continue
+		}
+
+		if err := checkFirewallRule(l.direction, rule); err != nil {
+			l.report(LintError, LintInvalidRule, i, -1, "%s", err)
+			continue
+		}
+
+		valid[i] = true
+	}
+
+	for i, rule := range rules {
+		if !valid[i] {
+			continue
+		}
+
+		port, _ := parsePort(rule.Port)
+		proto, _ := parseProto(rule.Proto)
+		if rule.any() && port.isAny() {
+			if l.direction == DirectionInbound {
+				l.report(LintWarning, LintOverlyBroad, i, -1, "allows %s traffic on every port from every point", proto)
+			}
+
+			if proto == ProtoAny {
+				l.report(LintWarning, LintActionConflict, -1, i, "%s %s never applies, the rule allows all %s traffic", actionKey, action, l.direction)
+			}
+		}
+
+		if len(l.idents) > 0 {
+			l.lintIdentities(i, rule)
+		}
+
+		for j, other := range rules {
+			if j == i || !valid[j] || !ruleCovers(other, rule, l.idents) {
+				continue
+			}
+
+			// Of two equal rules the later one is reported
+			if ruleCovers(rule, other, l.idents) && j > i {
+				continue
+			}
+
+			l.report(LintWarning, LintShadowed, i, j, "never decides anything, rule %d allows everything it allows", j)
+			break
+		}
+	}
+}
+
+// The `lintIdentities` method checks the groups and point of a rule against the known certs.
+func (l *firewallLinter) lintIdentities(i int, rule firewallRule) {
+	if rule.any() {
+		return
+	}
+
+	unknown := false
+	for _, g := range rule.Groups {
+		if !l.groupKnown(g) {
+			l.report(LintWarning, LintUnknownGroup, i, -1, "no known cert carries group %q", g)
+			unknown = true
+		}
+	}
+
+	if rule.Point != "" && !l.pointKnown(rule.Point) {
+		l.report(LintWarning, LintUnknownPoint, i, -1, "no known cert is named %q", rule.Point)
+		unknown = true
+	}
+
+	if unknown {
+		return
+	}
+
+	for _, id := range l.idents {
+		if ruleMatchesIdentity(rule, id) {
+			return
+		}
+	}
+
+	l.report(LintWarning, LintUnreachable, i, -1, "no known cert carries all of the groups %s", strings.Join(rule.Groups, ", "))
+}
+
+// The `groupKnown` method reports whether a known cert carries the group.
+func (l *firewallLinter) groupKnown(group string) bool {
+	for _, id := range l.idents {
+		if containsString(id.groups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The `pointKnown` method reports whether a known cert has the name.
+func (l *firewallLinter) pointKnown(name string) bool {
+	for _, id := range l.idents {
+		if id.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The function `ruleMatchesIdentity` reports whether a rule matches a peer cert, ignoring ports and
+// protocols.
+func ruleMatchesIdentity(r firewallRule, id certIdentity) bool {
+	if r.any() || (r.Point != "" && r.Point == id.name) {
+		return true
+	}
+
+	if len(r.Groups) == 0 {
+		return false
+	}
+
+	for _, g := range r.Groups {
+		if !containsString(id.groups, g) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The function `ruleCovers` reports whether rule `a` allows all traffic rule `b` allows. A point is
+// covered by groups only if the known cert with that name carries them.
+func ruleCovers(a, b firewallRule, idents []certIdentity) bool {
+	aProto, _ := parseProto(a.Proto)
+	bProto, _ := parseProto(b.Proto)
+	if aProto != ProtoAny && aProto != bProto {
+		return false
+	}
+
+	aPort, _ := parsePort(a.Port)
+	bPort, _ := parsePort(b.Port)
+	if !aPort.covers(bPort) {
+		return false
+	}
+
+	if a.any() {
+		return true
+	}
+
+	if b.any() {
+		return false
+	}
+
+	if len(b.Groups) > 0 && (len(a.Groups) == 0 || !ruleMatchesIdentity(firewallRule{Groups: a.Groups}, certIdentity{groups: b.Groups})) {
+		return false
+	}
+
+	if b.Point == "" || a.Point == b.Point {
+		return true
+	}
+
+	if len(a.Groups) == 0 {
+		return false
+	}
+
+	for _, id := range idents {
+		if id.name == b.Point {
+			return ruleMatchesIdentity(firewallRule{Groups: a.Groups}, id)
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,65 @@
+package mobile
+
+import "testing"
+
+// The function `TestLintFirewall` tests the findings for a firewall with an any/any rule, an invalid
+// port range, groups no known cert carries and an outbound rule matching groups.
+func TestLintFirewall(t *testing.T) {
+	settings, err := loadSettings(`firewall:
+  inbound_action: drop
+  inbound:
+    - port: any
+      proto: any
+      point: any
+    - port: 22
+      proto: tcp
+      groups: [admin]
+    - port: 900-200
+      proto: tcp
+      groups: [admin]
+    - port: 443
+      proto: tcp
+      groups: [admin, ops]
+    - port: 80
+      proto: tcp
+      groups: [dev]
+  outbound:
+    - port: 53
+      proto: udp
+      groups: [admin]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := lintFirewall(settings, []certIdentity{{name: "phone", groups: []string{"admin"}}, {name: "ci", groups: []string{"ops"}}})
+
+	in, out := DirectionInbound, DirectionOutbound
+	want := map[LintFinding]bool{
+		{Severity: LintWarning, Kind: LintOverlyBroad, Direction: in, Rule: 0, Related: -1}:    true,
+		{Severity: LintWarning, Kind: LintActionConflict, Direction: in, Rule: -1, Related: 0}: true,
+		{Severity: LintWarning, Kind: LintShadowed, Direction: in, Rule: 1, Related: 0}:        true,
+		{Severity: LintWarning, Kind: LintShadowed, Direction: in, Rule: 3, Related: 0}:        true,
+		{Severity: LintWarning, Kind: LintShadowed, Direction: in, Rule: 4, Related: 0}:        true,
+		{Severity: LintError, Kind: LintInvalidPort, Direction: in, Rule: 2, Related: -1}:      true,
+		{Severity: LintWarning, Kind: LintUnreachable, Direction: in, Rule: 3, Related: -1}:    true,
+		{Severity: LintWarning, Kind: LintUnknownGroup, Direction: in, Rule: 4, Related: -1}:   true,
+		{Severity: LintError, Kind: LintInvalidRule, Direction: out, Rule: 0, Related: -1}:     true,
+	}
+
+	for _, f := range r.Findings {
+		key := LintFinding{Severity: f.Severity, Kind: f.Kind, Direction: f.Direction, Rule: f.Rule, Related: f.Related}
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected finding: %+v", f)
+		}
+		delete(want, key)
+	}
+
+	for f := range want {
+		t.Errorf("missing finding: %+v", f)
+	}
+
+	if r.Errors != 2 {
+		t.Errorf("expected 2 errors, got %d", r.Errors)
+	}
+}
@@ -0,0 +1,291 @@
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The ways an overlay can merge a list into the base config.
+const (
+	ListReplace = "replace"
+	ListAppend  = "append"
+)
+
+// The sources an overlay can come from. Managed overlays are pushed by the enterprise and bypass the
+// policy, user overlays are subject to it.
+const (
+	OverlayManaged = "managed"
+	OverlayUser    = "user"
+)
+
+// The ConfigOverlay type is a partial config layered on top of a base config by `MergeConfigs`.
+// @property {string} Name - Identifies the overlay in the merge report.
+// @property {string} Source - Either `OverlayManaged` or `OverlayUser`, defaults to `OverlayUser`.
+// @property Config - The partial config, either as an object or as YAML or JSON configuration data.
+// @property Lists - Maps the dotted path of a list to `ListReplace` or `ListAppend`. Lists that are
+// not mentioned are replaced.
+type ConfigOverlay struct {
+	Name   string            `json:"name"`
+	Source string            `json:"source"`
+	Config any               `json:"config"`
+	Lists  map[string]string `json:"lists"`
+}
+
+// The MergePolicy type restricts what user overlays may change.
+// @property {[]string} Locked - Paths user overlays may not change, including everything below them.
+// @property {[]string} Allowed - If set, the only paths user overlays may change.
+// @property {bool} Strict - Whether any rejected override fails the whole merge instead of being
+// skipped.
+type MergePolicy struct {
+	Locked  []string `json:"locked"`
+	Allowed []string `json:"allowed"`
+	Strict  bool     `json:"strict"`
+}
+
+// The MergedPath type records a path an overlay changed.
+// @property {string} Path - The dotted path that was changed.
+// @property {string} Overlay - The name of the overlay that changed it.
+// @property {string} Reason - Why the change was rejected, empty for applied changes.
+type MergedPath struct {
+	Path    string
+	Overlay string
+	Reason  string
+}
+
+// The MergeResult type is the result of `MergeConfigs`.
+// @property {string} Config - The merged configuration data as JSON, ready for `NewBulk` or `Reload`.
+// @property {[]MergedPath} Applied - The overrides that were applied, in overlay order.
+// @property {[]MergedPath} Rejected - The overrides the policy rejected, in overlay order.
+type MergeResult struct {
+	Config   string
+	Applied  []MergedPath
+	Rejected []MergedPath
+}
+
+// The function `MergeConfigs` layers the JSON encoded list of `ConfigOverlay` values on top of the base
+// configuration data, in order, and returns a JSON encoded `MergeResult`. Maps are merged deeply and
+// lists are replaced or appended as each overlay declares. Overrides of user overlays that the JSON
+// encoded `MergePolicy` forbids are skipped and reported, or fail the merge when the policy is strict.
+func MergeConfigs(baseConfig string, overlaysJSON string, policyJSON string) (string, error) {
+	base, err := loadSettings(baseConfig)
+	if err != nil {
+		return "", err
+	}
+
+	var overlays []ConfigOverlay
+	if strings.TrimSpace(overlaysJSON) != "" {
+		if err := json.Unmarshal([]byte(overlaysJSON), &overlays); err != nil {
+			return "", fmt.Errorf("invalid overlays: %s", err)
+		}
+	}
+
+	var policy MergePolicy
+	if strings.TrimSpace(policyJSON) != "" {
+		if err := json.Unmarshal([]byte(policyJSON), &policy); err != nil {
+			return "", fmt.Errorf("invalid policy: %s", err)
+		}
+	}
+
+	res := &MergeResult{Applied: []MergedPath{}, Rejected: []MergedPath{}}
+	merged := any(base)
+	for i, o := range overlays {
+		if o.Name == "" {
+			o.Name = fmt.Sprintf("overlay %d", i)
+		}
+
+		settings, err := overlaySettings(o.Config)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", o.Name, err)
+		}
+
+		m := &overlayMerger{overlay: o, result: res}
+		if o.Source != OverlayManaged {
+			m.policy = &policy
+		}
+		merged = m.merge(merged, settings, nil)
+	}
+
+	if policy.Strict && len(res.Rejected) > 0 {
+		r := res.Rejected[0]
+		return "", fmt.Errorf("%s may not change %s: %s", r.Overlay, r.Path, r.Reason)
+	}
+
+	res.Config, err = marshalJSON(merged)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(res)
+}
+
+// The function `overlaySettings` turns the config of an overlay into a settings tree.
+func overlaySettings(config any) (map[string]any, error) {
+	switch t := config.(type) {
+	case nil:
+		return map[string]any{}, nil
+	case string:
+		return loadSettings(t)
+	case map[string]any:
+		return normalizeValue(t).(map[string]any), nil
+	default:
+		return nil, errors.New("config must be an object or configuration data")
+	}
+}
+
+// The overlayMerger type merges a single overlay into a settings tree.
+// @property overlay - The overlay being merged.
+// @property policy - The policy the overlay is subject to, nil for managed overlays.
+// @property result - Collects the applied and rejected overrides, nil when nobody is interested.
+type overlayMerger struct {
+	overlay ConfigOverlay
+	policy  *MergePolicy
+	result  *MergeResult
+}
+
+// The `merge` method merges `overlay` into `base` at `path` and returns the result. Maps are merged key
+// by key and every other value replaces the one in `base`, unless it is a list the overlay appends to.
+// The policy is checked before a map is descended into, so a map can neither reach below a locked
+// path nor replace a value that is not a map.
+func (m *overlayMerger) merge(base any, overlay any, path []string) any {
+	p := strings.Join(path, ".")
+	if reflect.DeepEqual(base, overlay) {
+		return base
+	}
+
+	if overlayMap, ok := overlay.(map[string]any); ok {
+		baseMap, baseIsMap := base.(map[string]any)
+		reason := ""
+		switch {
+		case len(path) == 0:
+		case !baseIsMap && base != nil:
+			reason = m.denied(p)
+		default:
+			reason = m.deniedBelow(p)
+		}
+		if reason != "" {
+			m.reject(p, reason)
+			return base
+		}
+
+		out := make(map[string]any, len(baseMap)+len(overlayMap))
+		for k, v := range baseMap {
+			out[k] = v
+		}
+
+		keys := make([]string, 0, len(overlayMap))
+		for k := range overlayMap {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v := m.merge(out[k], overlayMap[k], append(path[:len(path):len(path)], k))
+			if _, exists := out[k]; exists || v != nil {
+				out[k] = v
+			}
+		}
+		return out
+	}
+
+	if reason := m.denied(p); reason != "" {
+		m.reject(p, reason)
+		return base
+	}
+
+	if m.result != nil {
+		m.result.Applied = append(m.result.Applied, MergedPath{Path: p, Overlay: m.overlay.Name})
+	}
+
+	baseList, baseIsList := base.([]any)
+	overlayList, overlayIsList := overlay.([]any)
+	if baseIsList && overlayIsList && m.overlay.Lists[p] == ListAppend {
+		out := append([]any{}, baseList...)
+		for _, v := range overlayList {
+			if !containsValue(out, v) {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+
+	return overlay
+}
+
+// The `reject` method records an override the policy rejected.
+func (m *overlayMerger) reject(path string, reason string) {
+	if m.result != nil {
+		m.result.Rejected = append(m.result.Rejected, MergedPath{Path: path, Overlay: m.overlay.Name, Reason: reason})
+	}
+}
+
+// The `deniedBelow` method returns why the policy forbids changing anything at or below the path, or
+// an empty string when some path below it may still be changed.
+func (m *overlayMerger) deniedBelow(path string) string {
+	if m.policy == nil {
+		return ""
+	}
+
+	for _, locked := range m.policy.Locked {
+		if pathWithin(path, locked) {
+			return fmt.Sprintf("%s is locked by policy", locked)
+		}
+	}
+
+	if len(m.policy.Allowed) == 0 {
+		return ""
+	}
+
+	for _, allowed := range m.policy.Allowed {
+		if pathWithin(path, allowed) || pathWithin(allowed, path) {
+			return ""
+		}
+	}
+
+	return "path is not in the policy allow list"
+}
+
+// The `denied` method returns why the policy forbids changing the path, or an empty string when it is
+// allowed.
+func (m *overlayMerger) denied(path string) string {
+	if m.policy == nil {
+		return ""
+	}
+
+	for _, locked := range m.policy.Locked {
+		if pathWithin(path, locked) || pathWithin(locked, path) {
+			return fmt.Sprintf("%s is locked by policy", locked)
+		}
+	}
+
+	if len(m.policy.Allowed) == 0 {
+		return ""
+	}
+
+	for _, allowed := range m.policy.Allowed {
+		if pathWithin(path, allowed) {
+			return ""
+		}
+	}
+
+	return "path is not in the policy allow list"
+}
+
+// The function `pathWithin` reports whether a dotted path is equal to or below another.
+func pathWithin(path string, parent string) bool {
+	return parent == "" || path == parent || strings.HasPrefix(path, parent+".")
+}
+
+// The function `containsValue` reports whether a list contains a value.
+func containsValue(list []any, v any) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,138 @@
+package mobile
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// The function `TestMergeConfigs` tests list append and replace, locked and allowed paths, managed
+// overlays and that a map can not replace a locked value.
+func TestMergeConfigs(t *testing.T) {
+	base := "pki:\n  ca: trusted-ca\n  cert: cert\ntun:\n  routes:\n    - route: 10.1.0.0/16\n  unsafe_routes: [a]\nlogging:\n  level: info\n"
+
+	tests := []struct {
+		name      string
+		overlays  string
+		policy    string
+		want      map[string]any
+		applied   []string
+		rejected  []string
+		wantError bool
+	}{
+		{
+			name:     "list replace",
+			overlays: `[{"config": {"tun": {"routes": [{"route": "10.2.0.0/16"}]}}}]`,
+			want:     map[string]any{"tun.routes": []any{map[string]any{"route": "10.2.0.0/16"}}},
+			applied:  []string{"tun.routes"},
+		},
+		{
+			name:     "list append",
+			overlays: `[{"config": {"tun": {"routes": [{"route": "10.1.0.0/16"}, {"route": "10.2.0.0/16"}]}}, "lists": {"tun.routes": "append"}}]`,
+			want:     map[string]any{"tun.routes": []any{map[string]any{"route": "10.1.0.0/16"}, map[string]any{"route": "10.2.0.0/16"}}},
+			applied:  []string{"tun.routes"},
+		},
+		{
+			name:     "locked leaf",
+			overlays: `[{"name": "user", "config": {"pki": {"ca": "evil-ca", "cert": "new-cert"}}}]`,
+			policy:   `{"locked": ["pki.ca"]}`,
+			want:     map[string]any{"pki.ca": "trusted-ca", "pki.cert": "new-cert"},
+			applied:  []string{"pki.cert"},
+			rejected: []string{"pki.ca"},
+		},
+		{
+			name:     "map replacing a locked value",
+			overlays: `[{"config": {"pki": {"ca": {}}}}]`,
+			policy:   `{"locked": ["pki.ca"]}`,
+			want:     map[string]any{"pki.ca": "trusted-ca"},
+			rejected: []string{"pki.ca"},
+		},
+		{
+			name:     "map below a locked value",
+			overlays: `[{"config": {"pki": {"ca": {"nested": "x"}}}}]`,
+			policy:   `{"locked": ["pki.ca"]}`,
+			want:     map[string]any{"pki.ca": "trusted-ca"},
+			rejected: []string{"pki.ca"},
+		},
+		{
+			name:     "locked section",
+			overlays: `[{"config": {"pki": {"extra": {"a": 1}}}}]`,
+			policy:   `{"locked": ["pki"]}`,
+			want:     map[string]any{"pki.extra": nil},
+			rejected: []string{"pki"},
+		},
+		{
+			name:     "map outside the allow list",
+			overlays: `[{"config": {"logging": {"level": {"x": 1}}}}]`,
+			policy:   `{"allowed": ["tun"]}`,
+			want:     map[string]any{"logging.level": "info"},
+			rejected: []string{"logging"},
+		},
+		{
+			name:     "allow list",
+			overlays: `[{"config": {"tun": {"unsafe_routes": ["b"]}, "logging": {"level": "debug"}}}]`,
+			policy:   `{"allowed": ["tun.unsafe_routes"]}`,
+			want:     map[string]any{"tun.unsafe_routes": []any{"b"}, "logging.level": "info"},
+			applied:  []string{"tun.unsafe_routes"},
+			rejected: []string{"logging"},
+		},
+		{
+			name:     "managed overlay",
+			overlays: `[{"source": "managed", "config": {"pki": {"ca": "rotated-ca"}}}]`,
+			policy:   `{"locked": ["pki.ca"]}`,
+			want:     map[string]any{"pki.ca": "rotated-ca"},
+			applied:  []string{"pki.ca"},
+		},
+		{
+			name:      "strict",
+			overlays:  `[{"config": {"pki": {"ca": {}}}}]`,
+			policy:    `{"locked": ["pki.ca"], "strict": true}`,
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := MergeConfigs(base, tt.overlays, tt.policy)
+			if tt.wantError {
+				if err == nil {
+					t.Error("expected the merge to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var res MergeResult
+			if err := json.Unmarshal([]byte(out), &res); err != nil {
+				t.Fatal(err)
+			}
+
+			settings, err := loadSettings(res.Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for path, want := range tt.want {
+				got, _ := lookupPath(settings, path)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("expected %s = %v, got %v", path, want, got)
+				}
+			}
+
+			paths := func(l []MergedPath) []string {
+				var out []string
+				for _, p := range l {
+					out = append(out, p.Path)
+				}
+				return out
+			}
+			if got := paths(res.Applied); !reflect.DeepEqual(got, tt.applied) {
+				t.Errorf("expected applied %v, got %v", tt.applied, got)
+			}
+			if got := paths(res.Rejected); !reflect.DeepEqual(got, tt.rejected) {
+				t.Errorf("expected rejected %v, got %v", tt.rejected, got)
+			}
+		})
+	}
+}
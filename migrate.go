@@ -0,0 +1,173 @@
+package mobile
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The config version this package writes. Configs without `config_version` are version 0.
+const currentConfigVersion = 2
+
+// The configMigration type upgrades a config from `version - 1` to `version`.
+// @property version - The config version the migration produces.
+// @property description - A short human readable summary of the migration.
+// @property migrate - Rewrites the settings in place and returns the paths it changed.
+type configMigration struct {
+	version     int
+	description string
+	migrate     func(settings map[string]any) []string
+}
+
+// configMigrations is the migration registry, ordered by version. Every step must be idempotent so a
+// config that was partially edited by hand still migrates cleanly.
+var configMigrations = []configMigration{
+	{
+		version:     1,
+		description: "rename stats.extention to stats.extension",
+		migrate:     migrateStatsExtension,
+	},
+	{
+		version:     2,
+		description: "turn tower.detection_point entries into lists",
+		migrate:     migrateDetectionPoints,
+	},
+}
+
+// The MigrationStep type records a single migration applied to a config.
+// @property {int} Version - The config version the step produced.
+// @property {string} Description - What the step does.
+// @property {[]string} Paths - The paths the step changed.
+type MigrationStep struct {
+	Version     int
+	Description string
+	Paths       []string
+}
+
+// The MigrationResult type is the result of `MigrateConfig`.
+// @property {string} Config - The migrated configuration data. It is the input unchanged when no
+// migration changed anything, and JSON otherwise.
+// @property {int} FromVersion - The config version of the input.
+// @property {int} ToVersion - The config version the output is valid for, always the current one.
+// @property {[]MigrationStep} Steps - The migrations that changed something, in order.
+// @property {bool} Reformatted - Whether `Config` was written anew as JSON, which drops the comments,
+// key order and formatting of the input.
+type MigrationResult struct {
+	Config      string
+	FromVersion int
+	ToVersion   int
+	Steps       []MigrationStep
+	Reformatted bool
+}
+
+// The function `MigrateConfig` upgrades configuration data written for an older config version to the
+// current one, step by step, and returns a JSON encoded `MigrationResult` describing what changed. A
+// config that any step changes is returned as JSON, so comments in YAML input are lost; the result
+// reports this as `Reformatted`.
+func MigrateConfig(configData string) (string, error) {
+	r, err := migrateConfig(configData)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(r)
+}
+
+// The function `migrateConfig` is the implementation behind `MigrateConfig`.
+func migrateConfig(configData string) (*MigrationResult, error) {
+	settings, err := loadSettings(configData)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := configVersion(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if from > currentConfigVersion {
+		return nil, fmt.Errorf("config version %d is newer than the supported version %d", from, currentConfigVersion)
+	}
+
+	r := &MigrationResult{Config: configData, FromVersion: from, ToVersion: currentConfigVersion, Steps: []MigrationStep{}}
+	for _, m := range configMigrations {
+		if m.version <= from {
+			continue
+		}
+
+		if paths := m.migrate(settings); len(paths) > 0 {
+			sort.Strings(paths)
+			r.Steps = append(r.Steps, MigrationStep{Version: m.version, Description: m.description, Paths: paths})
+		}
+	}
+
+	if len(r.Steps) == 0 {
+		return r, nil
+	}
+
+	settings["config_version"] = currentConfigVersion
+	r.Reformatted = true
+	r.Config, err = marshalJSON(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// The function `configVersion` returns the `config_version` of a settings tree.
+func configVersion(settings map[string]any) (int, error) {
+	switch v := settings["config_version"].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return v, nil
+	case float64:
+		return int(v), nil
+	default:
+		return 0, fmt.Errorf("invalid config_version: %v", v)
+	}
+}
+
+// The function `migrateStatsExtension` renames the misspelled `stats.extention` setting.
+func migrateStatsExtension(settings map[string]any) []string {
+	stats, ok := settings["stats"].(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	v, ok := stats["extention"]
+	if !ok {
+		return nil
+	}
+
+	delete(stats, "extention")
+	if _, exists := stats["extension"]; !exists {
+		stats["extension"] = v
+	}
+
+	return []string{"stats.extention", "stats.extension"}
+}
+
+// The function `migrateDetectionPoints` wraps detection points that were written as a single object,
+// `{mask, port}`, in a list.
+func migrateDetectionPoints(settings map[string]any) []string {
+	tower, ok := settings["tower"].(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	points, ok := tower["detection_point"].(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	var paths []string
+	for network, v := range points {
+		if entry, ok := v.(map[string]any); ok {
+			points[network] = []any{entry}
+			paths = append(paths, "tower.detection_point."+network)
+		}
+	}
+
+	return paths
+}
@@ -0,0 +1,62 @@
+package mobile
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The function `TestMigrateConfig` tests that old configs are migrated step by step, that configs
+// without anything to migrate are returned unchanged and that newer configs are rejected.
+func TestMigrateConfig(t *testing.T) {
+	old := "# old config\nstats:\n  extention: true\ntower:\n  detection_point:\n    10.0.0.0/8:\n      mask: 10.0.0.1/32\n      port: 80\n"
+	r, err := migrateConfig(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.FromVersion != 0 || r.ToVersion != currentConfigVersion || !r.Reformatted || len(r.Steps) != 2 {
+		t.Fatalf("unexpected migration: %+v", r)
+	}
+	if !reflect.DeepEqual(r.Steps[0].Paths, []string{"stats.extension", "stats.extention"}) || !reflect.DeepEqual(r.Steps[1].Paths, []string{"tower.detection_point.10.0.0.0/8"}) {
+		t.Errorf("unexpected steps: %+v", r.Steps)
+	}
+
+	settings, err := loadSettings(r.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := lookupPath(settings, "config_version"); v != currentConfigVersion {
+		t.Errorf("expected config_version %d, got %v", currentConfigVersion, v)
+	}
+	if v, ok := lookupPath(settings, "stats.extension"); !ok || v != true {
+		t.Errorf("expected stats.extension to be set, got %v", v)
+	}
+	if v, _ := lookupPath(settings, "tower.detection_point"); !reflect.DeepEqual(v, map[string]any{"10.0.0.0/8": []any{map[string]any{"mask": "10.0.0.1/32", "port": 80}}}) {
+		t.Errorf("unexpected detection points: %v", v)
+	}
+
+	// Migrating again changes nothing
+	again, err := migrateConfig(r.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Steps) != 0 || again.Reformatted || again.Config != r.Config {
+		t.Errorf("expected the migration to be idempotent, got %+v", again)
+	}
+
+	plain := "# nothing to migrate\npunchy:\n  enable: true\n"
+	r, err = migrateConfig(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Config != plain || r.Reformatted || r.FromVersion != 0 || r.ToVersion != currentConfigVersion {
+		t.Errorf("expected the config to be kept as is, got %+v", r)
+	}
+
+	if _, err := migrateConfig("config_version: 99\n"); err == nil {
+		t.Error("expected a newer config version to be rejected")
+	}
+	if _, err := migrateConfig("config_version: two\n"); err == nil {
+		t.Error("expected an invalid config version to be rejected")
+	}
+}
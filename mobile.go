@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -18,21 +19,25 @@ import (
 )
 
 // The CIDR type represents an IP address with its corresponding subnet mask.
+// @property {string} Family - Either "ipv4" or "ipv6".
 // @property {string} Ip - The "Ip" property represents the IP address in the CIDR notation. It
 // specifies the network address and the number of significant bits in the subnet mask.
-// @property {string} MaskCIDR - The MaskCIDR property represents the subnet mask in CIDR notation.
-// CIDR stands for Classless Inter-Domain Routing and is a method used to allocate IP addresses and
-// define network boundaries. The MaskCIDR property specifies the number of bits in the subnet mask.
-// For example, a MaskCIDR
+// @property {string} MaskCIDR - The MaskCIDR property represents the subnet mask in address notation,
+// such as "255.255.255.0" for IPv4 or "ffff:ffff:ffff:ffff::" for IPv6.
 // @property {int} MaskSize - The MaskSize property represents the size of the network mask in bits. It
 // indicates the number of bits in the network portion of the IP address.
 // @property {string} Network - The "Network" property represents the network address of the CIDR
 // (Classless Inter-Domain Routing) block.
+// @property {string} First - The first address of the block, which is the network address.
+// @property {string} Last - The last address of the block, the broadcast address for IPv4.
 type CIDR struct {
+	Family   string
 	Ip       string
 	MaskCIDR string
 	MaskSize int
 	Network  string
+	First    string
+	Last     string
 }
 
 // The above code defines two types, Validity and RawCert, which are used to represent the validity and
@@ -72,30 +77,60 @@ type KeyPair struct {
 }
 
 // The function `GetConfigSetting` retrieves a specific setting from a given configuration data string.
+// References in the configuration data are resolved first, if that fails an empty string is returned.
 func GetConfigSetting(configData string, setting string) string {
+	configData, err := resolveConfig(configData)
+	if err != nil {
+		return ""
+	}
+
+	c, _ := loadQuietConfig(configData)
+	return c.GetString(setting, "")
+}
+
+// The function `loadQuietConfig` loads the configuration data into a `cfg.C` whose logger discards
+// all output. Every read-only helper in this package goes through here.
+func loadQuietConfig(configData string) (*cfg.C, error) {
 	// We don't want to leak the config into the system logs
 	l := logger.New(1000)
 	l.SetOutput(io.Discard)
 
 	c := cfg.NewC(l)
-	c.LoadString(configData)
-	return c.GetString(setting, "")
+	err := c.LoadString(configData)
+	return c, err
 }
 
 // The function `ParseCIDR` takes a CIDR string, parses it, and returns the IP address, mask CIDR, mask
-// size, and network address.
+// size, network address and address range. Both IPv4 and IPv6 are supported.
 func ParseCIDR(cidr string) (*CIDR, error) {
-	ip, ipNet, err := net.ParseCIDR(cidr)
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid CIDR address: %s", cidr)
+	}
+
+	family := FamilyIPv4
+	if prefix.Addr().Is6() {
+		family = FamilyIPv6
+	}
+
+	network := prefix.Masked().Addr()
+	mask := net.CIDRMask(prefix.Bits(), network.BitLen())
+
+	// The last address has every host bit set
+	last := network.AsSlice()
+	for i := range last {
+		last[i] |= ^mask[i]
 	}
-	size, _ := ipNet.Mask.Size()
+	lastAddr, _ := netip.AddrFromSlice(last)
 
 	return &CIDR{
-		Ip:       ip.String(),
-		MaskCIDR: fmt.Sprintf("%d.%d.%d.%d", ipNet.Mask[0], ipNet.Mask[1], ipNet.Mask[2], ipNet.Mask[3]),
-		MaskSize: size,
-		Network:  ipNet.IP.String(),
+		Family:   family,
+		Ip:       prefix.Addr().String(),
+		MaskCIDR: net.IP(mask).String(),
+		MaskSize: prefix.Bits(),
+		Network:  network.String(),
+		First:    network.String(),
+		Last:     lastAddr.String(),
 	}, nil
 }
 
@@ -166,9 +201,13 @@ func GenerateKeyPair(curve string) (result string, err error) {
 		return
 	}
 
+	// P256 and SM2 keys carry the ECDH banner `VerifyCertAndKey` expects for those curves
 	kp := KeyPair{}
-	kp.PublicKey = string(cert.MarshalX25519PublicKey(pub))
-	kp.PrivateKey = string(cert.MarshalX25519PrivateKey(priv))
+	if pub, priv, err = keyPairPEM(curve, pub, priv); err != nil {
+		return "", err
+	}
+	kp.PublicKey = string(pub)
+	kp.PrivateKey = string(priv)
 
 	rawJson, err := json.Marshal(kp)
 	if err != nil {
@@ -178,6 +217,18 @@ func GenerateKeyPair(curve string) (result string, err error) {
 	return string(rawJson), nil
 }
 
+// The function `keyPairPEM` encodes a raw key pair with the PEM banners of its curve.
+func keyPairPEM(curve string, pub []byte, priv []byte) ([]byte, []byte, error) {
+	switch curve {
+	case "25519", "X25519":
+		return cert.MarshalX25519PublicKey(pub), cert.MarshalX25519PrivateKey(priv), nil
+	case "P256", "SM2", "GM":
+		return cert.MarshalEDCHPublicKey(pub), cert.MarshalEDCHPrivateKey(priv), nil
+	default:
+		return nil, nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+}
+
 // The function generates a key pair for the X25519 elliptic curve Diffie-Hellman algorithm.
 func x25519Keypair() ([]byte, []byte) {
 	privkey := make([]byte, 32)
@@ -425,3 +425,29 @@ firewall:
 
 	t.Log(err)
 }
+
+// The function `TestParseCIDR` tests parsing IPv4 and IPv6 CIDRs.
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want CIDR
+	}{
+		{"10.1.2.3/20", CIDR{Family: "ipv4", Ip: "10.1.2.3", MaskCIDR: "255.255.240.0", MaskSize: 20, Network: "10.1.0.0", First: "10.1.0.0", Last: "10.1.15.255"}},
+		{"2001:db8::1/48", CIDR{Family: "ipv6", Ip: "2001:db8::1", MaskCIDR: "ffff:ffff:ffff::", MaskSize: 48, Network: "2001:db8::", First: "2001:db8::", Last: "2001:db8:0:ffff:ffff:ffff:ffff:ffff"}},
+		{"fd00::7/128", CIDR{Family: "ipv6", Ip: "fd00::7", MaskCIDR: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", MaskSize: 128, Network: "fd00::7", First: "fd00::7", Last: "fd00::7"}},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.cidr, err)
+		}
+		if *c != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.cidr, tt.want, *c)
+		}
+	}
+
+	if _, err := ParseCIDR("10.1.2.3"); err == nil {
+		t.Error("expected an address without prefix length to be rejected")
+	}
+}
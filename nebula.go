@@ -0,0 +1,505 @@
+package mobile
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+// The PEM banner prefixes of Nebula and VLAN. Both share the same certificate and key encodings, only
+// the banners differ.
+const (
+	nebulaPEMPrefix = "NEBULA "
+	vlanPEMPrefix   = "VLAN "
+)
+
+// incompatiblePEMTypes lists Nebula PEM types VLAN cannot read.
+var incompatiblePEMTypes = map[string]string{
+	"NEBULA CERTIFICATE V2": "v2 certificates are not supported",
+}
+
+// The nebulaRename type moves a Nebula setting to its VLAN path.
+// @property from - The Nebula setting.
+// @property to - The VLAN setting.
+// @property list - Whether a single value is wrapped in a list on the way.
+type nebulaRename struct {
+	from string
+	to   string
+	list bool
+}
+
+// nebulaRenames lists Nebula settings that only moved, in the order they are applied. When several
+// settings move to the same VLAN path the first one that is set wins and the later ones are reported
+// as dropped, so deprecated spellings come after the settings that replaced them.
+var nebulaRenames = []nebulaRename{
+	{from: "pki.blocklist", to: "pki.blocklist"},
+	{from: "pki.disconnect_invalid", to: "pki.disconnect_invalid"},
+	{from: "lighthouse.am_lighthouse", to: "tower.service"},
+	{from: "lighthouse.hosts", to: "tower.hosts"},
+	{from: "lighthouse.interval", to: "tower.interval"},
+	{from: "lighthouse.serve_dns", to: "tower.dns.enable"},
+	{from: "lighthouse.dns.host", to: "tower.dns.addr"},
+	{from: "lighthouse.dns.port", to: "tower.dns.port"},
+	{from: "lighthouse.remote_allow_list", to: "tower.remote_allow_list"},
+	{from: "lighthouse.remote_allow_ranges", to: "tower.remote_allow_ranges"},
+	{from: "lighthouse.local_allow_list", to: "tower.local_allow_list"},
+	{from: "lighthouse.advertise_addrs", to: "tower.advertise_addrs"},
+	{from: "listen.host", to: "listen.addr"},
+	{from: "listen.port", to: "listen.port"},
+	{from: "listen.batch", to: "listen.batch"},
+	{from: "listen.read_buffer", to: "listen.read_buffer"},
+	{from: "listen.write_buffer", to: "listen.write_buffer"},
+	{from: "listen.send_recv_error", to: "listen.send_recv_error"},
+	{from: "routines", to: "listen.routines"},
+	{from: "punchy.punch", to: "punchy.enable"},
+	{from: "punchy.respond", to: "punchy.respond"},
+	{from: "punchy.delay", to: "punchy.delay"},
+	{from: "punchy.respond_delay", to: "punchy.respond_delay"},
+	{from: "preferred_ranges", to: "punchy.preferred_ranges"},
+	{from: "local_range", to: "punchy.preferred_ranges", list: true},
+	{from: "punch_back", to: "punchy.respond"},
+	{from: "cipher", to: "cipher"},
+	{from: "sshd.enabled", to: "ssh.enabled"},
+	{from: "sshd.host_key", to: "ssh.point_key"},
+	{from: "tun.dev", to: "tun.dev"},
+	{from: "tun.drop_local_broadcast", to: "tun.drop_local_broadcast"},
+	{from: "tun.drop_multicast", to: "tun.drop_multicast"},
+	{from: "tun.tx_queue", to: "tun.tx_queue"},
+	{from: "tun.mtu", to: "tun.mtu"},
+	{from: "tun.routes", to: "tun.routes"},
+	{from: "logging.level", to: "logging.level"},
+	{from: "logging.format", to: "logging.format"},
+	{from: "stats.type", to: "stats.type"},
+	{from: "stats.listen", to: "stats.listen"},
+	{from: "stats.path", to: "stats.path"},
+	{from: "stats.namespace", to: "stats.name_space"},
+	{from: "stats.prefix", to: "stats.prefix"},
+	{from: "stats.protocol", to: "stats.protocol"},
+	{from: "stats.host", to: "stats.server"},
+	{from: "stats.message_metrics", to: "stats.message_metrics"},
+	{from: "stats.lighthouse_metrics", to: "stats.tower_metrics"},
+	{from: "handshakes.try_interval", to: "handshakes.try_interval"},
+	{from: "handshakes.retries", to: "handshakes.retries"},
+	{from: "handshakes.trigger_buffer", to: "handshakes.trigger_buffer"},
+	{from: "timers.connection_alive_interval", to: "timers.connection_alive_interval"},
+	{from: "timers.pending_deletion_interval", to: "timers.pending_deletion_interval"},
+	{from: "firewall.outbound_action", to: "firewall.outbound_action"},
+	{from: "firewall.inbound_action", to: "firewall.inbound_action"},
+	{from: "firewall.conntrack.tcp_timeout", to: "firewall.conntrack.tcp_timeout"},
+	{from: "firewall.conntrack.udp_timeout", to: "firewall.conntrack.udp_timeout"},
+	{from: "firewall.conntrack.default_timeout", to: "firewall.conntrack.default_timeout"},
+}
+
+// nebulaDropped lists Nebula settings that have no effect in VLAN and can be left out safely.
+var nebulaDropped = map[string]string{
+	"handshakes.query_buffer":            "VLAN sizes the query buffer itself",
+	"logging.disable_timestamp":          "VLAN logging always writes timestamps",
+	"logging.timestamp_format":           "VLAN logging uses a fixed timestamp format",
+	"stats.interval":                     "VLAN reports stats at a fixed interval",
+	"firewall.conntrack.max_connections": "VLAN does not cap the conntrack table",
+}
+
+// The ImportedKey type is an entry of an `ImportResult` report.
+// @property {string} Key - The Nebula setting.
+// @property {string} Target - The VLAN setting it was mapped to, empty if it was not mapped.
+// @property {string} Reason - Why the setting was changed on the way, dropped or is unsupported.
+type ImportedKey struct {
+	Key    string
+	Target string
+	Reason string
+}
+
+// The ImportResult type is the result of `ImportNebulaConfig`.
+// @property {string} Config - The VLAN configuration data as JSON.
+// @property {[]ImportedKey} Mapped - The settings carried over to the VLAN config.
+// @property {[]ImportedKey} Dropped - The settings left out because they have no effect in VLAN, or
+// because another setting moved to the same VLAN path took precedence.
+// @property {[]ImportedKey} Unsupported - The settings left out because VLAN lacks the feature. The
+// imported config may behave differently where these were relied on.
+type ImportResult struct {
+	Config      string
+	Mapped      []ImportedKey
+	Dropped     []ImportedKey
+	Unsupported []ImportedKey
+}
+
+// The function `ImportNebulaConfig` converts a Nebula config into a VLAN config and returns a JSON
+// encoded `ImportResult`. Renamed sections are moved, such as `lighthouse` to `tower` and
+// `static_host_map` to `points`, and Nebula certificate PEMs are translated where the formats are
+// compatible. Firewall rules using Nebula matchers VLAN lacks are left out as a whole rather than
+// widened.
+func ImportNebulaConfig(yamlData string) (string, error) {
+	r, err := importNebulaConfig(yamlData)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(r)
+}
+
+// The function `importNebulaConfig` is the implementation behind `ImportNebulaConfig`.
+func importNebulaConfig(yamlData string) (*ImportResult, error) {
+	src, err := loadSettings(yamlData)
+	if err != nil {
+		return nil, err
+	}
+
+	im := &nebulaImporter{
+		src:      src,
+		out:      map[string]any{"config_version": currentConfigVersion},
+		consumed: map[string]bool{},
+		result:   &ImportResult{Mapped: []ImportedKey{}, Dropped: []ImportedKey{}, Unsupported: []ImportedKey{}},
+	}
+	im.run()
+
+	configData, err := marshalJSON(im.out)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := loadSettings(configData); err != nil {
+		return nil, fmt.Errorf("imported config does not load: %s", err)
+	}
+
+	im.result.Config = configData
+	return im.result, nil
+}
+
+// The nebulaImporter type holds the state of a single import.
+// @property src - The Nebula settings.
+// @property out - The VLAN settings being built.
+// @property consumed - The Nebula paths that were handled, including everything below them.
+// @property result - The report being built.
+type nebulaImporter struct {
+	src      map[string]any
+	out      map[string]any
+	consumed map[string]bool
+	result   *ImportResult
+}
+
+// The `run` method handles the settings that need more than a rename, then the renames, then reports
+// whatever is left as unsupported.
+func (im *nebulaImporter) run() {
+	for _, path := range []string{"pki.ca", "pki.cert", "pki.key"} {
+		im.importPEM(path)
+	}
+
+	im.importPoints()
+	im.importPunchy()
+	im.importSSH()
+	im.importTun()
+	im.importFirewall("firewall.inbound", true)
+	im.importFirewall("firewall.outbound", false)
+
+	targets := map[string]string{}
+	for _, r := range nebulaRenames {
+		v, ok := im.lookup(r.from)
+		if !ok {
+			continue
+		}
+
+		if prev, ok := targets[r.to]; ok {
+			im.dropped(r.from, fmt.Sprintf("conflicts with %s, which takes precedence for %s", prev, r.to))
+			continue
+		}
+		targets[r.to] = r.from
+
+		if _, ok := v.([]any); r.list && !ok {
+			im.mapped(r.from, r.to, []any{v}, "wrapped in a list")
+			continue
+		}
+		im.mapped(r.from, r.to, v, "")
+	}
+
+	for key, reason := range nebulaDropped {
+		if _, ok := im.lookup(key); ok {
+			im.dropped(key, reason)
+		}
+	}
+
+	im.reportLeftovers(im.src, "")
+
+	for _, list := range [][]ImportedKey{im.result.Mapped, im.result.Dropped, im.result.Unsupported} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	}
+}
+
+// The `lookup` method returns a Nebula setting that was not handled yet.
+func (im *nebulaImporter) lookup(path string) (any, bool) {
+	if im.consumed[path] {
+		return nil, false
+	}
+
+	return lookupPath(im.src, path)
+}
+
+// The `mapped` method sets a VLAN setting from a Nebula one and records it.
+func (im *nebulaImporter) mapped(from, to string, v any, reason string) {
+	im.consumed[from] = true
+	setPath(im.out, to, v)
+	im.result.Mapped = append(im.result.Mapped, ImportedKey{Key: from, Target: to, Reason: reason})
+}
+
+// The `dropped` method records a Nebula setting that has no effect in VLAN.
+func (im *nebulaImporter) dropped(key, reason string) {
+	im.consumed[key] = true
+	im.result.Dropped = append(im.result.Dropped, ImportedKey{Key: key, Reason: reason})
+}
+
+// The `unsupported` method records a Nebula setting that VLAN lacks the feature for.
+func (im *nebulaImporter) unsupported(key, reason string) {
+	im.consumed[key] = true
+	im.result.Unsupported = append(im.result.Unsupported, ImportedKey{Key: key, Reason: reason})
+}
+
+// The `reportLeftovers` method reports every setting below `v` that was not handled as unsupported.
+func (im *nebulaImporter) reportLeftovers(v any, path string) {
+	if path != "" && im.consumed[path] {
+		return
+	}
+
+	m, ok := v.(map[string]any)
+	if !ok || (len(m) == 0 && path != "") {
+		im.unsupported(path, "no VLAN equivalent")
+		return
+	}
+
+	for k, child := range m {
+		im.reportLeftovers(child, joinPath(path, k))
+	}
+}
+
+// The `importPEM` method translates the certificate or key PEM at `path`.
+func (im *nebulaImporter) importPEM(path string) {
+	v, ok := im.lookup(path)
+	if !ok {
+		return
+	}
+
+	s, _ := v.(string)
+	if !strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN ") {
+		im.unsupported(path, "file paths are not supported, inline the PEM instead")
+		return
+	}
+
+	translated, changed, err := translateNebulaPEM(s)
+	if err != nil {
+		im.unsupported(path, err.Error())
+		return
+	}
+
+	reason := ""
+	if changed {
+		reason = "translated the Nebula PEM banners"
+	}
+
+	im.mapped(path, path, translated, reason)
+}
+
+// The function `translateNebulaPEM` rewrites the banners of the Nebula PEM blocks in `data` and checks
+// that the certificates among them load.
+func translateNebulaPEM(data string) (string, bool, error) {
+	var (
+		out     []byte
+		changed bool
+		rest    = []byte(data)
+	)
+
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if reason, ok := incompatiblePEMTypes[block.Type]; ok {
+			return "", false, fmt.Errorf("incompatible %s: %s", block.Type, reason)
+		}
+
+		if strings.HasPrefix(block.Type, nebulaPEMPrefix) {
+			block.Type = vlanPEMPrefix + strings.TrimPrefix(block.Type, nebulaPEMPrefix)
+			changed = true
+		}
+
+		b := pem.EncodeToMemory(block)
+		if strings.HasSuffix(block.Type, " CERTIFICATE") {
+			if _, _, err := cert.UnmarshalCertificateFromPEM(b); err != nil {
+				return "", false, fmt.Errorf("incompatible certificate: %s", err)
+			}
+		}
+
+		out = append(out, b...)
+	}
+
+	if len(out) == 0 {
+		return "", false, fmt.Errorf("no valid PEM block found")
+	}
+
+	return string(out), changed, nil
+}
+
+// The `importPoints` method moves `static_host_map` to `points` and checks that every lighthouse has
+// a static address, as VLAN finds towers through `points`.
+func (im *nebulaImporter) importPoints() {
+	hostMap, _ := im.src["static_host_map"].(map[string]any)
+	if len(hostMap) > 0 {
+		points := make(map[string]any, len(hostMap))
+		for ip, addrs := range hostMap {
+			switch t := addrs.(type) {
+			case []any:
+				points[ip] = t
+			default:
+				points[ip] = []any{t}
+			}
+		}
+		im.mapped("static_host_map", "points", points, "")
+	}
+
+	hosts, _ := lookupPath(im.src, "lighthouse.hosts")
+	list, _ := hosts.([]any)
+	for _, h := range list {
+		ip := fmt.Sprint(h)
+		if _, ok := hostMap[ip]; !ok {
+			im.unsupported("lighthouse.hosts."+ip, "towers need a static address in points")
+		}
+	}
+}
+
+// The `importPunchy` method handles `punchy` written as a bool by older Nebula versions.
+func (im *nebulaImporter) importPunchy() {
+	if v, ok := im.src["punchy"].(bool); ok {
+		im.mapped("punchy", "punchy.enable", v, "")
+	}
+}
+
+// The `importSSH` method handles the settings of the SSH daemon that changed shape.
+func (im *nebulaImporter) importSSH() {
+	if v, ok := im.lookup("sshd.listen"); ok {
+		_, port, err := net.SplitHostPort(fmt.Sprint(v))
+		n, perr := strconv.Atoi(port)
+		if err != nil || perr != nil {
+			im.unsupported("sshd.listen", "invalid listen address")
+		} else {
+			im.mapped("sshd.listen", "ssh.port", n, "only the port is kept, VLAN chooses the listen address")
+		}
+	}
+
+	v, ok := im.lookup("sshd.authorized_users")
+	if !ok {
+		return
+	}
+
+	entries, _ := v.([]any)
+	users := make([]any, 0, len(entries))
+	for _, e := range entries {
+		u, _ := e.(map[string]any)
+		users = append(users, map[string]any{"name": u["user"], "keys": u["keys"]})
+	}
+	im.mapped("sshd.authorized_users", "ssh.users", users, "renamed user to name")
+}
+
+// The `importTun` method handles `tun.disabled` and `tun.unsafe_routes`.
+func (im *nebulaImporter) importTun() {
+	if _, ok := im.src["tun"].(map[string]any); !ok {
+		return
+	}
+
+	disabled, _ := im.src["tun"].(map[string]any)["disabled"].(bool)
+	setPath(im.out, "tun.enable", !disabled)
+	if _, ok := im.lookup("tun.disabled"); ok {
+		im.mapped("tun.disabled", "tun.enable", !disabled, "inverted")
+	}
+
+	v, ok := im.lookup("tun.unsafe_routes")
+	if !ok {
+		return
+	}
+
+	entries, _ := v.([]any)
+	routes := make([]any, 0, len(entries))
+	for _, e := range entries {
+		r, _ := e.(map[string]any)
+		route := map[string]any{"route": r["route"], "via": r["via"], "enable": true}
+		for _, k := range []string{"mtu", "metric"} {
+			if v, ok := r[k]; ok {
+				route[k] = v
+			}
+		}
+		if install, ok := r["install"].(bool); ok {
+			route["enable"] = install
+		}
+		routes = append(routes, route)
+	}
+	im.mapped("tun.unsafe_routes", "tun.route_table", routes, "renamed install to enable")
+}
+
+// The `importFirewall` method converts the firewall rules at `path`. Rules using a matcher VLAN lacks
+// are left out as a whole, dropping only the matcher would make the rule allow more than it did.
+func (im *nebulaImporter) importFirewall(path string, inbound bool) {
+	v, ok := im.lookup(path)
+	if !ok {
+		return
+	}
+
+	entries, _ := v.([]any)
+	rules := make([]any, 0, len(entries))
+	for i, e := range entries {
+		rule, err := nebulaFirewallRule(e, inbound)
+		if err != nil {
+			im.unsupported(fmt.Sprintf("%s[%d]", path, i), err.Error())
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	im.consumed[path] = true
+	setPath(im.out, path, rules)
+	im.result.Mapped = append(im.result.Mapped, ImportedKey{Key: path, Target: path, Reason: "renamed host to point"})
+}
+
+// The function `nebulaFirewallRule` converts a single Nebula firewall rule.
+func nebulaFirewallRule(v any, inbound bool) (map[string]any, error) {
+	r, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid rule")
+	}
+
+	rule := map[string]any{}
+	var groups []any
+	for k, val := range r {
+		s := fmt.Sprint(val)
+		switch k {
+		case "port":
+			rule["port"] = s
+		case "proto":
+			rule["proto"] = s
+		case "host":
+			rule["point"] = s
+		case "group":
+			groups = append(groups, s)
+		case "groups":
+			list, _ := val.([]any)
+			groups = append(groups, list...)
+		case "cidr", "local_cidr", "code", "ca_name", "ca_sha":
+			if s != "" && s != "any" {
+				return nil, fmt.Errorf("%s matchers are not supported", k)
+			}
+		default:
+			return nil, fmt.Errorf("unknown matcher %s", k)
+		}
+	}
+
+	if len(groups) > 0 {
+		if !inbound {
+			return nil, fmt.Errorf("group matchers are not supported on outbound rules")
+		}
+		rule["groups"] = groups
+	}
+
+	return rule, nil
+}
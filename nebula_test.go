@@ -0,0 +1,144 @@
+package mobile
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+// The function `TestImportNebulaConfig` tests that renamed sections are moved, certificate banners are
+// translated and rules using Nebula-only matchers are reported instead of widened.
+func TestImportNebulaConfig(t *testing.T) {
+	_, caPEM, _ := newTestSigner(t, cert.Curve_X25519, "ca", nil, nil, nil)
+	nebulaCA := strings.ReplaceAll(caPEM, "VLAN CERTIFICATE", "NEBULA CERTIFICATE")
+	yamlData := "pki:\n  ca: |\n" + indent(nebulaCA, "    ") + `static_host_map:
+  "192.168.100.1": ["203.0.113.1:4242"]
+lighthouse:
+  am_lighthouse: false
+  hosts: ["192.168.100.1"]
+punchy:
+  punch: true
+routines: 2
+relay:
+  use_relays: true
+firewall:
+  inbound:
+    - port: 22
+      proto: tcp
+      group: admin
+    - port: any
+      proto: any
+      cidr: 10.0.0.0/8
+`
+
+	r, err := importNebulaConfig(yamlData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := loadSettings(r.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"punchy.enable":              "true",
+		"listen.routines":            "2",
+		"tower.service":              "false",
+		"firewall.inbound[0].port":   "22",
+		"firewall.inbound[0].groups": "[admin]",
+	} {
+		v, _ := lookupPath(settings, path)
+		if got := fmt.Sprint(v); got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+
+	points, _ := settings["points"].(map[string]any)
+	if got := fmt.Sprint(points["192.168.100.1"]); got != "[203.0.113.1:4242]" {
+		t.Errorf("expected static_host_map to move to points, got %v", settings["points"])
+	}
+
+	ca, _ := lookupPath(settings, "pki.ca")
+	if s, _ := ca.(string); !strings.Contains(s, "BEGIN VLAN CERTIFICATE") {
+		t.Errorf("expected the CA banner to be translated, got %q", s)
+	}
+
+	if rules, _ := lookupPath(settings, "firewall.inbound"); len(rules.([]any)) != 1 {
+		t.Errorf("expected the cidr rule to be left out, got %v", rules)
+	}
+
+	unsupported := map[string]bool{}
+	for _, k := range r.Unsupported {
+		unsupported[k.Key] = true
+	}
+	if !unsupported["relay.use_relays"] || !unsupported["firewall.inbound[1]"] {
+		t.Errorf("unexpected unsupported keys: %+v", r.Unsupported)
+	}
+
+	if hosts, _ := lookupPath(settings, "tower.hosts"); fmt.Sprint(hosts) != "[192.168.100.1]" {
+		t.Errorf("expected lighthouse.hosts to move to tower.hosts, got %v", hosts)
+	}
+}
+
+// The function `TestImportNebulaRenameConflicts` tests that when a setting and its deprecated spelling
+// are both set, the current one wins and the other is reported as dropped, in either key order.
+func TestImportNebulaRenameConflicts(t *testing.T) {
+	for _, yamlData := range []string{
+		"punch_back: false\nlocal_range: 10.0.0.0/8\npunchy:\n  respond: true\npreferred_ranges: [\"172.16.0.0/12\"]\n",
+		"preferred_ranges: [\"172.16.0.0/12\"]\npunchy:\n  respond: true\nlocal_range: 10.0.0.0/8\npunch_back: false\n",
+	} {
+		r, err := importNebulaConfig(yamlData)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		settings, err := loadSettings(r.Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for path, want := range map[string]string{
+			"punchy.respond":          "true",
+			"punchy.preferred_ranges": "[172.16.0.0/12]",
+		} {
+			v, _ := lookupPath(settings, path)
+			if got := fmt.Sprint(v); got != want {
+				t.Errorf("%s: expected %s, got %s", path, want, got)
+			}
+		}
+
+		dropped := map[string]string{}
+		for _, k := range r.Dropped {
+			dropped[k.Key] = k.Reason
+		}
+		if !strings.Contains(dropped["punch_back"], "punchy.respond") || !strings.Contains(dropped["local_range"], "preferred_ranges") {
+			t.Errorf("expected the deprecated settings to be reported as conflicts, got %+v", r.Dropped)
+		}
+	}
+
+	r, err := importNebulaConfig("local_range: 10.0.0.0/8\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := loadSettings(r.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := lookupPath(settings, "punchy.preferred_ranges"); fmt.Sprint(v) != "[10.0.0.0/8]" {
+		t.Errorf("expected local_range to be wrapped in a list, got %v", v)
+	}
+}
+
+// The function `indent` prefixes every line of `s` with `prefix`.
+func indent(s, prefix string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line != "" {
+			b.WriteString(prefix + line)
+		}
+	}
+	return b.String()
+}
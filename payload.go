@@ -0,0 +1,422 @@
+package mobile
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Every enrollment payload starts with this prefix so it can be recognised in a QR code or deep link.
+const enrollmentPrefix = "vlan:"
+
+// The enrollment payload format version. Version 1 uses raw deflate, argon2id with the parameters
+// from encrypt.go for passphrases and AES-256-GCM.
+const enrollmentVersion = 1
+
+// The kinds of data an enrollment payload can carry.
+const (
+	EnrollmentConfig = "config"
+	EnrollmentToken  = "token"
+)
+
+const (
+	enrollmentFlagEncrypted = 1 << iota
+	enrollmentFlagToken
+)
+
+const (
+	enrollmentChecksumSize = 8
+	enrollmentSaltSize     = 16
+	maxEnrollmentSize      = 1 << 20
+)
+
+// pemRefPrefix marks a string in the encoded settings that was replaced by references into the PEM
+// table. It starts with a NUL byte, which never occurs in a real config.
+const pemRefPrefix = "\x00pem:"
+
+// The EnrollmentOptions type holds the options of `EncodeEnrollment`.
+// @property {string} Kind - Either `EnrollmentConfig`, the default, or `EnrollmentToken` for an opaque
+// enrollment token.
+// @property {string} Passphrase - If set, the payload is encrypted with this passphrase.
+type EnrollmentOptions struct {
+	Kind       string `json:"kind"`
+	Passphrase string `json:"passphrase"`
+}
+
+// The Enrollment type is the result of decoding an enrollment payload.
+// @property {string} Kind - Either `EnrollmentConfig` or `EnrollmentToken`.
+// @property {string} Config - The configuration data as JSON, for config payloads.
+// @property {string} Token - The enrollment token, for token payloads.
+// @property {bool} Encrypted - Whether the payload was encrypted.
+type Enrollment struct {
+	Kind      string
+	Config    string
+	Token     string
+	Encrypted bool
+}
+
+// The function `EncodeEnrollment` encodes configuration data, or an enrollment token, as a compact
+// payload that fits in a QR code or deep link. PEM blocks are stored once in binary form, the rest is
+// deflated, and the payload is checksummed or, with a passphrase, encrypted. The JSON encoded
+// `EnrollmentOptions` select the kind and passphrase.
+func EncodeEnrollment(configData string, optionsJSON string) (string, error) {
+	var opts EnrollmentOptions
+	if strings.TrimSpace(optionsJSON) != "" {
+		if err := json.Unmarshal([]byte(optionsJSON), &opts); err != nil {
+			return "", fmt.Errorf("invalid options: %s", err)
+		}
+	}
+
+	var flags byte
+	var body []byte
+	switch opts.Kind {
+	case "", EnrollmentConfig:
+		settings, err := loadSettings(configData)
+		if err != nil {
+			return "", err
+		}
+
+		body, err = packSettings(settings)
+		if err != nil {
+			return "", err
+		}
+	case EnrollmentToken:
+		flags |= enrollmentFlagToken
+		body = []byte(configData)
+	default:
+		return "", fmt.Errorf("invalid enrollment kind: %q", opts.Kind)
+	}
+
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(body)
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	header := []byte{enrollmentVersion, flags}
+	var out []byte
+	if opts.Passphrase != "" {
+		header[1] |= enrollmentFlagEncrypted
+
+		salt := make([]byte, enrollmentSaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return "", err
+		}
+
+		aead, err := newConfigAEAD(enrollmentKey(opts.Passphrase, salt))
+		if err != nil {
+			return "", err
+		}
+
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+
+		out = append(append(append(header, salt...), nonce...), aead.Seal(nil, nonce, compressed.Bytes(), header)...)
+	} else {
+		out = append(header, compressed.Bytes()...)
+		sum := sha256.Sum256(out)
+		out = append(out, sum[:enrollmentChecksumSize]...)
+	}
+
+	return enrollmentPrefix + base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// The function `DecodeEnrollment` decodes a payload produced by `EncodeEnrollment` and returns a JSON
+// encoded `Enrollment`. The payload may also be given as a deep link carrying it in the `p` query
+// parameter. Encrypted payloads need `DecodeEnrollmentWithPassphrase`.
+func DecodeEnrollment(payload string) (string, error) {
+	return DecodeEnrollmentWithPassphrase(payload, "")
+}
+
+// The function `DecodeEnrollmentWithPassphrase` decodes a payload like `DecodeEnrollment`, decrypting
+// it with the passphrase if it is encrypted.
+func DecodeEnrollmentWithPassphrase(payload string, passphrase string) (string, error) {
+	e, err := decodeEnrollment(payload, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(e)
+}
+
+// The function `decodeEnrollment` is the implementation behind `DecodeEnrollmentWithPassphrase`.
+func decodeEnrollment(payload string, passphrase string) (*Enrollment, error) {
+	payload = strings.TrimSpace(payload)
+	if u, err := url.Parse(payload); err == nil && u.Query().Get("p") != "" {
+		payload = u.Query().Get("p")
+	}
+
+	raw, ok := strings.CutPrefix(payload, enrollmentPrefix)
+	if !ok {
+		return nil, errors.New("not an enrollment payload")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil || len(data) < 2 {
+		return nil, errors.New("malformed enrollment payload")
+	}
+
+	if data[0] != enrollmentVersion {
+		return nil, fmt.Errorf("unsupported enrollment payload version: %d", data[0])
+	}
+
+	header, flags := data[:2], data[1]
+	e := &Enrollment{Kind: EnrollmentConfig, Encrypted: flags&enrollmentFlagEncrypted != 0}
+	if flags&enrollmentFlagToken != 0 {
+		e.Kind = EnrollmentToken
+	}
+
+	var compressed []byte
+	if e.Encrypted {
+		if passphrase == "" {
+			return nil, errors.New("enrollment payload is encrypted, a passphrase is required")
+		}
+
+		rest := data[2:]
+		if len(rest) < enrollmentSaltSize {
+			return nil, errors.New("malformed enrollment payload")
+		}
+		salt, rest := rest[:enrollmentSaltSize], rest[enrollmentSaltSize:]
+
+		aead, err := newConfigAEAD(enrollmentKey(passphrase, salt))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rest) < aead.NonceSize() {
+			return nil, errors.New("malformed enrollment payload")
+		}
+
+		compressed, err = aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+		if err != nil {
+			return nil, errors.New("wrong passphrase or corrupted enrollment payload")
+		}
+	} else {
+		if len(data) < 2+enrollmentChecksumSize {
+			return nil, errors.New("malformed enrollment payload")
+		}
+
+		signed, checksum := data[:len(data)-enrollmentChecksumSize], data[len(data)-enrollmentChecksumSize:]
+		sum := sha256.Sum256(signed)
+		if !bytes.Equal(sum[:enrollmentChecksumSize], checksum) {
+			return nil, errors.New("enrollment payload checksum did not match")
+		}
+		compressed = signed[2:]
+	}
+
+	body, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), maxEnrollmentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("malformed enrollment payload: %s", err)
+	}
+
+	if len(body) > maxEnrollmentSize {
+		return nil, errors.New("enrollment payload is too large")
+	}
+
+	if e.Kind == EnrollmentToken {
+		e.Token = string(body)
+		return e, nil
+	}
+
+	settings, err := unpackSettings(body)
+	if err != nil {
+		return nil, err
+	}
+
+	e.Config, err = marshalJSON(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// The function `enrollmentKey` derives the payload key from a passphrase.
+func enrollmentKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, argon2Time, argon2Memory, argon2Threads, encryptionKeySize)
+}
+
+// The function `packSettings` serializes a settings tree. Every string made up of PEM blocks is moved
+// into a table of unique blocks stored in binary form and replaced by references into it. The layout
+// is the length prefixed JSON of the settings followed by the table, each block as its type and bytes.
+func packSettings(settings map[string]any) ([]byte, error) {
+	var blocks []*pem.Block
+	index := map[string]int{}
+
+	packed := replaceStrings(settings, func(s string) string {
+		parsed := parsePEMBlocks(s)
+		if parsed == nil {
+			return s
+		}
+
+		refs := make([]string, len(parsed))
+		for i, b := range parsed {
+			key := b.Type + "\x00" + string(b.Bytes)
+			n, ok := index[key]
+			if !ok {
+				n = len(blocks)
+				index[key] = n
+				blocks = append(blocks, b)
+			}
+			refs[i] = strconv.Itoa(n)
+		}
+
+		return pemRefPrefix + strings.Join(refs, ",")
+	})
+
+	j, err := json.Marshal(packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeChunk(&buf, j)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(blocks))))
+	for _, b := range blocks {
+		writeChunk(&buf, []byte(b.Type))
+		writeChunk(&buf, b.Bytes)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// The function `unpackSettings` reverses `packSettings`.
+func unpackSettings(data []byte) (map[string]any, error) {
+	r := bytes.NewReader(data)
+	j, err := readChunk(r)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(len(data)) {
+		return nil, errors.New("malformed enrollment payload")
+	}
+
+	blocks := make([][]byte, n)
+	for i := range blocks {
+		t, err := readChunk(r)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := readChunk(r)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks[i] = pem.EncodeToMemory(&pem.Block{Type: string(t), Bytes: b})
+	}
+
+	var settings map[string]any
+	if err := json.Unmarshal(j, &settings); err != nil {
+		return nil, fmt.Errorf("malformed enrollment payload: %s", err)
+	}
+
+	var refErr error
+	unpacked := replaceStrings(settings, func(s string) string {
+		refs, ok := strings.CutPrefix(s, pemRefPrefix)
+		if !ok {
+			return s
+		}
+
+		var sb strings.Builder
+		for _, ref := range strings.Split(refs, ",") {
+			i, err := strconv.Atoi(ref)
+			if err != nil || i < 0 || i >= len(blocks) {
+				refErr = errors.New("malformed enrollment payload: invalid PEM reference")
+				return ""
+			}
+			sb.Write(blocks[i])
+		}
+
+		return sb.String()
+	})
+
+	if refErr != nil {
+		return nil, refErr
+	}
+
+	return unpacked.(map[string]any), nil
+}
+
+// The function `parsePEMBlocks` returns the PEM blocks a string consists of, or nil if it is anything
+// other than one or more PEM blocks without headers.
+func parsePEMBlocks(s string) []*pem.Block {
+	if !strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN ") {
+		return nil
+	}
+
+	var blocks []*pem.Block
+	rest := []byte(s)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var b *pem.Block
+		b, rest = pem.Decode(rest)
+		if b == nil || len(b.Headers) > 0 {
+			return nil
+		}
+		blocks = append(blocks, b)
+	}
+
+	return blocks
+}
+
+// The function `replaceStrings` returns a copy of a settings tree with every string value passed
+// through `f`.
+func replaceStrings(v any, f func(string) string) any {
+	switch t := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(t))
+		for k, val := range t {
+			m[k] = replaceStrings(val, f)
+		}
+		return m
+	case []any:
+		l := make([]any, len(t))
+		for i, val := range t {
+			l[i] = replaceStrings(val, f)
+		}
+		return l
+	case string:
+		return f(t)
+	default:
+		return v
+	}
+}
+
+// The function `writeChunk` writes a length prefixed byte slice.
+func writeChunk(buf *bytes.Buffer, b []byte) {
+	buf.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	buf.Write(b)
+}
+
+// The function `readChunk` reads a byte slice written by `writeChunk`.
+func readChunk(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errors.New("malformed enrollment payload")
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.New("malformed enrollment payload")
+	}
+
+	return b, nil
+}
@@ -0,0 +1,102 @@
+package mobile
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The function `TestEnrollmentPayload` tests encoding and decoding plain, encrypted and token payloads,
+// the deduplication of PEM blocks and that corrupted payloads are rejected.
+func TestEnrollmentPayload(t *testing.T) {
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "VLAN CERTIFICATE", Bytes: []byte(strings.Repeat("ca", 64))}))
+	crt := string(pem.EncodeToMemory(&pem.Block{Type: "VLAN CERTIFICATE", Bytes: []byte(strings.Repeat("cert", 32))}))
+	settings := map[string]any{
+		"pki":    map[string]any{"ca": ca + crt, "cert": crt},
+		"points": map[string]any{"10.1.0.1": []any{"203.0.113.1:4242"}},
+	}
+	configData, err := marshalJSON(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both certs are stored once although `crt` appears twice
+	packed, err := packSettings(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, w := binary.Uvarint(packed)
+	if blocks, _ := binary.Uvarint(packed[w+int(n):]); blocks != 2 {
+		t.Errorf("expected 2 PEM blocks in the table, got %d", blocks)
+	}
+
+	decode := func(payload string, passphrase string) *Enrollment {
+		t.Helper()
+		e, err := decodeEnrollment(payload, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	plain, err := EncodeEnrollment(configData, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plain, enrollmentPrefix) || len(plain) >= len(configData) {
+		t.Errorf("expected a compact payload, got %d bytes for %d", len(plain), len(configData))
+	}
+
+	for _, payload := range []string{plain, "vlan-app://enroll?p=" + plain} {
+		e := decode(payload, "")
+		got, err := loadSettings(e.Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Kind != EnrollmentConfig || e.Encrypted || !reflect.DeepEqual(got, normalizeValue(settings)) {
+			t.Errorf("unexpected enrollment: %+v", e)
+		}
+	}
+
+	encrypted, err := EncodeEnrollment(configData, `{"passphrase": "open sesame"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := decode(encrypted, "open sesame"); !e.Encrypted || !strings.Contains(e.Config, "203.0.113.1:4242") {
+		t.Errorf("unexpected enrollment: %+v", e)
+	}
+	if _, err := decodeEnrollment(encrypted, ""); err == nil {
+		t.Error("expected an encrypted payload to need a passphrase")
+	}
+	if _, err := decodeEnrollment(encrypted, "wrong"); err == nil {
+		t.Error("expected a wrong passphrase to be rejected")
+	}
+
+	token, err := EncodeEnrollment("one-time-token", `{"kind": "token"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := decode(token, ""); e.Kind != EnrollmentToken || e.Token != "one-time-token" {
+		t.Errorf("unexpected enrollment: %+v", e)
+	}
+
+	data, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(plain, enrollmentPrefix))
+	data[3] ^= 1
+	corrupted := enrollmentPrefix + base64.RawURLEncoding.EncodeToString(data)
+	if _, err := decodeEnrollment(corrupted, ""); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected the checksum to fail, got %v", err)
+	}
+
+	data[3] ^= 1
+	data[0] = enrollmentVersion + 1
+	if _, err := decodeEnrollment(enrollmentPrefix+base64.RawURLEncoding.EncodeToString(data), ""); err == nil {
+		t.Error("expected an unknown version to be rejected")
+	}
+
+	if _, err := decodeEnrollment("https://example.com/", ""); err == nil {
+		t.Error("expected a payload without the prefix to be rejected")
+	}
+}
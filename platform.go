@@ -0,0 +1,304 @@
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+// The address families of platform routes.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// The PlatformRoute type is an address or route in the shape the VPN APIs of iOS and Android take it.
+// @property {string} Family - Either "ipv4" or "ipv6".
+// @property {string} CIDR - The address or network in CIDR notation.
+// @property {string} Address - The address, or the network address of a route.
+// @property {int} PrefixLength - The length of the network prefix.
+// @property {string} Mask - The network mask, such as "255.255.255.0" or "ffff:ffff::".
+type PlatformRoute struct {
+	Family       string
+	CIDR         string
+	Address      string
+	PrefixLength int
+	Mask         string
+}
+
+// The PlatformSettings type is the result of `PlatformNetworkSettings`. It is the same for iOS, where
+// it maps to `NEPacketTunnelNetworkSettings`, and Android, where it maps to `VpnService.Builder` calls.
+// @property {[]PlatformRoute} Addresses - The interface addresses, taken from the IPs of the cert.
+// @property {int} MTU - The MTU of the interface.
+// @property {[]PlatformRoute} IncludedRoutes - The networks to route into the interface: the VPN
+// networks, `tun.routes` and the enabled entries of `tun.route_table`.
+// @property {[]PlatformRoute} ExcludedRoutes - The networks to keep out of the interface: the
+// underlay addresses of points in `points` that an included route covers.
+// @property {[]string} DNSServers - The DNS servers to use while the VPN is up: the split DNS resolver
+// when `Bulk.PlatformNetworkSettings` finds it running, else the tower DNS service if it is enabled.
+// @property {[]string} SearchDomains - The DNS search domains: the zone of `tower.dns.zone`.
+// @property {[]string} MatchDomains - The domains whose queries go to `DNSServers`: the zone and the
+// domains of `tower.dns.upstreams`. Empty sends every query to `DNSServers`.
+// @property {string} SplitDNS - The IP:port the split DNS resolver listens on, empty unless it runs.
+// The platform only queries port 53, so a resolver on another port is left out of `DNSServers` and
+// the app has to forward queries to it itself.
+// @property {[]string} Warnings - Settings that could not be carried over to the platform.
+type PlatformSettings struct {
+	Addresses      []PlatformRoute
+	MTU            int
+	IncludedRoutes []PlatformRoute
+	ExcludedRoutes []PlatformRoute
+	DNSServers     []string
+	SearchDomains  []string
+	MatchDomains   []string
+	SplitDNS       string
+	Warnings       []string
+}
+
+// The function `PlatformNetworkSettings` returns the JSON encoded `PlatformSettings` the app hands to
+// the VPN API of its platform for the configuration data. Its DNS servers are those of the tower DNS
+// service; while a `Bulk` runs the split DNS resolver, use `Bulk.PlatformNetworkSettings` instead.
+func PlatformNetworkSettings(configData string) (string, error) {
+	configData, err := resolveConfig(configData)
+	if err != nil {
+		return "", err
+	}
+
+	settings, err := loadSettings(configData)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := platformNetworkSettings(settings, netip.AddrPort{})
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(p)
+}
+
+// The `PlatformNetworkSettings` method returns the JSON encoded `PlatformSettings` of the running
+// configuration, including the unsafe routes changed at runtime. While the split DNS resolver runs,
+// its address is returned in `SplitDNS` and, if it listens on port 53, it replaces the tower DNS
+// service in `DNSServers`. Start it on the interface address, such as "10.1.0.7:53", for the platform
+// to reach it.
+func (x *Bulk) PlatformNetworkSettings() (string, error) {
+	x.mu.Lock()
+	settings := x.appliedSettings()
+	x.mu.Unlock()
+
+	p, err := platformNetworkSettings(settings, x.resolver.listenAddr())
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(p)
+}
+
+// The function `platformNetworkSettings` reads the interface addresses from the cert of `settings` and
+// returns its platform settings. `splitDNS` is the address of the split DNS resolver, if it runs.
+func platformNetworkSettings(settings map[string]any, splitDNS netip.AddrPort) (*PlatformSettings, error) {
+	rawCert, _ := lookupPath(settings, "pki.cert")
+	s, _ := rawCert.(string)
+	if s == "" {
+		return nil, errors.New("config has no pki.cert")
+	}
+
+	c, _, err := cert.UnmarshalCertificateFromPEM([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshaling cert: %s", err)
+	}
+
+	var addrs []netip.Prefix
+	for _, ipNet := range c.Details.Ips {
+		ones, _ := ipNet.Mask.Size()
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if ok {
+			addrs = append(addrs, netip.PrefixFrom(ip.Unmap(), ones))
+		}
+	}
+
+	return platformSettings(settings, addrs, splitDNS)
+}
+
+// The function `platformSettings` is the implementation behind `PlatformNetworkSettings`, for the
+// interface addresses `addrs` and the split DNS resolver on `splitDNS`.
+func platformSettings(settings map[string]any, addrs []netip.Prefix, splitDNS netip.AddrPort) (*PlatformSettings, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("cert carries no IP")
+	}
+
+	p := &PlatformSettings{
+		Addresses:      []PlatformRoute{},
+		MTU:            newConfig().Tun.Mtu,
+		IncludedRoutes: []PlatformRoute{},
+		ExcludedRoutes: []PlatformRoute{},
+		DNSServers:     []string{},
+		SearchDomains:  []string{},
+		MatchDomains:   []string{},
+		Warnings:       []string{},
+	}
+
+	if mtu, ok := lookupPath(settings, "tun.mtu"); ok {
+		if n, ok := mtu.(int); ok && n > 0 {
+			p.MTU = n
+		}
+	}
+
+	included := map[netip.Prefix]bool{}
+	for _, a := range addrs {
+		c, err := ParseCIDR(a.String())
+		if err != nil {
+			return nil, err
+		}
+
+		addr := newPlatformRoute(a)
+		addr.Address, addr.Mask, addr.PrefixLength = c.Ip, c.MaskCIDR, c.MaskSize
+		p.Addresses = append(p.Addresses, addr)
+		included[a.Masked()] = true
+	}
+
+	for _, cidr := range platformRoutes(settings) {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			included[prefix] = true
+		}
+	}
+
+	for _, prefix := range sortedPrefixes(included) {
+		p.IncludedRoutes = append(p.IncludedRoutes, newPlatformRoute(prefix))
+	}
+
+	// Traffic to the underlay addresses of points must keep flowing outside the tunnel, or routing it
+	// into the tunnel loops
+	excluded := map[netip.Prefix]bool{}
+	points, _ := settings["points"].(map[string]any)
+	vpnIPs := make([]string, 0, len(points))
+	for vpnIP := range points {
+		vpnIPs = append(vpnIPs, vpnIP)
+	}
+	sort.Strings(vpnIPs)
+
+	for _, vpnIP := range vpnIPs {
+		list, _ := points[vpnIP].([]any)
+		for _, e := range list {
+			ip, ok := underlayIP(fmt.Sprint(e))
+			if !ok {
+				p.Warnings = append(p.Warnings, fmt.Sprintf("underlay address %v of point %s is not an IP and can not be excluded from the routes", e, vpnIP))
+				continue
+			}
+
+			for prefix := range included {
+				if prefix.Contains(ip) {
+					excluded[netip.PrefixFrom(ip, ip.BitLen())] = true
+					break
+				}
+			}
+		}
+	}
+
+	for _, prefix := range sortedPrefixes(excluded) {
+		p.ExcludedRoutes = append(p.ExcludedRoutes, newPlatformRoute(prefix))
+	}
+
+	p.platformDNS(settings, addrs[0].Addr(), splitDNS)
+	return p, nil
+}
+
+// The `platformDNS` method fills in the DNS servers. The split DNS resolver on `splitDNS` answers if it
+// runs, else the tower DNS service if it is enabled, on its address or on the interface address if it
+// listens on every address.
+func (p *PlatformSettings) platformDNS(settings map[string]any, local netip.Addr, splitDNS netip.AddrPort) {
+	var ip netip.Addr
+	if splitDNS.IsValid() {
+		p.SplitDNS = splitDNS.String()
+		if splitDNS.Port() != 53 {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("split DNS listens on %s, which the platform can not use as it queries port 53", splitDNS))
+			return
+		}
+		ip = splitDNS.Addr()
+	} else {
+		enable, _ := lookupPath(settings, "tower.dns.enable")
+		if on, _ := enable.(bool); !on {
+			return
+		}
+
+		if port, ok := lookupPath(settings, "tower.dns.port"); ok {
+			if n, _ := port.(int); n != 0 && n != 53 {
+				p.Warnings = append(p.Warnings, fmt.Sprintf("tower.dns.port %d can not be used by the platform, which queries port 53", n))
+				return
+			}
+		}
+
+		addr, _ := lookupPath(settings, "tower.dns.addr")
+		ip, _ = netip.ParseAddr(fmt.Sprint(addr))
+	}
+
+	if !ip.IsValid() || ip.IsUnspecified() {
+		ip = local
+	}
+
+	p.DNSServers = append(p.DNSServers, ip.Unmap().String())
+
+	// Only the split domains go into the tunnel, the system resolver keeps everything else
+	p.MatchDomains = append(p.MatchDomains, splitDNSDomains(settings)...)
+
+	if zone, _ := lookupPath(settings, "tower.dns.zone"); zone != nil {
+		if z, err := dnsName(fmt.Sprint(zone)); err == nil {
+			p.SearchDomains = append(p.SearchDomains, z)
+		}
+	}
+}
+
+// The function `newPlatformRoute` creates the platform entry of an address or network.
+func newPlatformRoute(prefix netip.Prefix) PlatformRoute {
+	family := FamilyIPv4
+	if prefix.Addr().Is6() {
+		family = FamilyIPv6
+	}
+
+	mask := net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())
+	return PlatformRoute{
+		Family:       family,
+		CIDR:         prefix.String(),
+		Address:      prefix.Addr().String(),
+		PrefixLength: prefix.Bits(),
+		Mask:         net.IP(mask).String(),
+	}
+}
+
+// The function `underlayIP` returns the IP of an underlay address such as "203.0.113.1:4242", false
+// for host names.
+func underlayIP(addr string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+
+	ip, err := netip.ParseAddr(strings.Trim(addr, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return ip.Unmap(), true
+}
+
+// The function `sortedPrefixes` returns the prefixes of a set, IPv4 first.
+func sortedPrefixes(set map[netip.Prefix]bool) []netip.Prefix {
+	list := make([]netip.Prefix, 0, len(set))
+	for prefix := range set {
+		list = append(list, prefix)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if c := list[i].Addr().Compare(list[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return list[i].Bits() < list[j].Bits()
+	})
+
+	return list
+}
@@ -0,0 +1,109 @@
+package mobile
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The function `TestPlatformSettings` tests the platform settings of a config routing everything into
+// the tunnel through a gateway point.
+func TestPlatformSettings(t *testing.T) {
+	settings, err := loadSettings(`points:
+  "10.1.0.1": ["203.0.113.1:4242", "tower.example.com:4242"]
+tower:
+  dns:
+    enable: true
+    addr: 0.0.0.0
+    zone: vlan
+    upstreams:
+      - domains: [corp.example]
+        servers: [tower]
+tun:
+  mtu: 1280
+  routes:
+    - route: 10.9.0.0/16
+  route_table:
+    - route: 0.0.0.0/0
+      via: 10.1.0.1
+      enable: true
+    - route: 172.16.0.0/12
+      via: 10.1.0.1
+    - route: 192.168.0.0/16
+      via: 10.1.0.1
+      enable: false
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := platformSettings(settings, []netip.Prefix{netip.MustParsePrefix("10.1.0.7/24")}, netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.MTU != 1280 || len(p.Addresses) != 1 || p.Addresses[0].Address != "10.1.0.7" || p.Addresses[0].Mask != "255.255.255.0" {
+		t.Errorf("unexpected interface settings: %+v", p)
+	}
+
+	var included []string
+	for _, r := range p.IncludedRoutes {
+		included = append(included, r.CIDR)
+	}
+	if want := []string{"0.0.0.0/0", "10.1.0.0/24", "10.9.0.0/16", "172.16.0.0/12"}; !reflect.DeepEqual(included, want) {
+		t.Errorf("expected included routes %v, got %v", want, included)
+	}
+
+	if len(p.ExcludedRoutes) != 1 || p.ExcludedRoutes[0].CIDR != "203.0.113.1/32" {
+		t.Errorf("expected the tower underlay address to be excluded, got %+v", p.ExcludedRoutes)
+	}
+
+	if len(p.Warnings) != 1 || !strings.Contains(p.Warnings[0], "tower.example.com:4242") {
+		t.Errorf("expected a warning for the host name, got %v", p.Warnings)
+	}
+
+	if !reflect.DeepEqual(p.DNSServers, []string{"10.1.0.7"}) {
+		t.Errorf("expected the DNS server on the interface address, got %v", p.DNSServers)
+	}
+
+	if !reflect.DeepEqual(p.MatchDomains, []string{"corp.example", "vlan"}) || !reflect.DeepEqual(p.SearchDomains, []string{"vlan"}) {
+		t.Errorf("unexpected DNS domains: match %v, search %v", p.MatchDomains, p.SearchDomains)
+	}
+}
+
+// The function `TestPlatformSplitDNS` tests that a running split DNS resolver replaces the tower DNS
+// service, and is only returned in `SplitDNS` when it listens on a port the platform can not query.
+func TestPlatformSplitDNS(t *testing.T) {
+	settings, err := loadSettings(`tower:
+  dns:
+    port: 5353
+    zone: vlan
+    upstreams:
+      - domains: [corp.example]
+        servers: [1.1.1.1]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []netip.Prefix{netip.MustParsePrefix("10.1.0.7/24")}
+
+	p, err := platformSettings(settings, addrs, netip.MustParseAddrPort("0.0.0.0:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.SplitDNS != "0.0.0.0:53" || !reflect.DeepEqual(p.DNSServers, []string{"10.1.0.7"}) || len(p.Warnings) != 0 {
+		t.Errorf("expected the split DNS resolver on the interface address, got %+v", p)
+	}
+	if !reflect.DeepEqual(p.MatchDomains, []string{"corp.example", "vlan"}) || !reflect.DeepEqual(p.SearchDomains, []string{"vlan"}) {
+		t.Errorf("unexpected DNS domains: match %v, search %v", p.MatchDomains, p.SearchDomains)
+	}
+
+	p, err = platformSettings(settings, addrs, netip.MustParseAddrPort("127.0.0.1:5300"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.SplitDNS != "127.0.0.1:5300" || len(p.DNSServers) != 0 || len(p.Warnings) != 1 {
+		t.Errorf("expected the split DNS address and a warning only, got %+v", p)
+	}
+}
@@ -0,0 +1,177 @@
+package mobile
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretPaths lists the settings that carry secrets. A `*` segment matches any list index. Every
+// scalar at or below one of these paths is redacted.
+var secretPaths = [][]string{
+	{"pki", "key"},
+	{"proxy", "socks5", "*", "password"},
+	{"psk", "keys"},
+	{"ssh", "users", "*", "keys"},
+}
+
+// redactKey keys the placeholders. It is a fixed domain separation constant, so the same secret gets
+// the same placeholder in every process and on every device, while a placeholder can not be looked
+// up in a table of plain hashes.
+var redactKey = []byte("mobileVLAN config redaction v1")
+
+// additionPath is the setting that carries a nested config overlay, which is redacted recursively.
+var additionPath = []string{"sync", "addition"}
+
+// The function `RedactConfig` replaces every secret in the configuration data with a placeholder
+// containing a keyed hash of the secret. The key is fixed, so configs redacted anywhere can still be
+// compared for changed secrets. YAML input is returned as YAML with
+// its ordering and comments intact, JSON input is returned as JSON.
+func RedactConfig(configData string) (string, error) {
+	if isJSONConfig(configData) {
+		var v any
+		if err := json.Unmarshal([]byte(configData), &v); err != nil {
+			return "", fmt.Errorf("failed to parse config: %s", err)
+		}
+
+		b, err := json.MarshalIndent(redactSettings(v, nil), "", "    ")
+		if err != nil {
+			return "", err
+		}
+
+		return string(b), nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(configData), &doc); err != nil {
+		return "", fmt.Errorf("failed to parse config: %s", err)
+	}
+
+	redactNode(&doc, nil)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// The function `redactedPlaceholder` returns the placeholder a secret is replaced with.
+func redactedPlaceholder(secret string) string {
+	mac := hmac.New(sha256.New, redactKey)
+	mac.Write([]byte(secret))
+	return "REDACTED:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// The function `redactSettings` returns a copy of a settings tree with every secret replaced by its
+// placeholder. `path` is the location of `v` in the tree.
+func redactSettings(v any, path []string) any {
+	if pathIs(path, additionPath) {
+		if s, ok := v.(string); ok {
+			if r, err := RedactConfig(s); err == nil {
+				return r
+			}
+			return redactedPlaceholder(s)
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(t))
+		for k, val := range t {
+			m[k] = redactSettings(val, append(path[:len(path):len(path)], k))
+		}
+		return m
+	case []any:
+		l := make([]any, len(t))
+		for i, val := range t {
+			l[i] = redactSettings(val, append(path[:len(path):len(path)], fmt.Sprint(i)))
+		}
+		return l
+	case nil:
+		return nil
+	default:
+		if isSecretPath(path) {
+			return redactedPlaceholder(fmt.Sprint(t))
+		}
+		return v
+	}
+}
+
+// The function `redactNode` replaces every secret scalar below a YAML node with its placeholder.
+func redactNode(n *yaml.Node, path []string) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			redactNode(c, path)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			redactNode(n.Content[i+1], append(path[:len(path):len(path)], n.Content[i].Value))
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			redactNode(c, append(path[:len(path):len(path)], fmt.Sprint(i)))
+		}
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return
+		}
+
+		switch {
+		case pathIs(path, additionPath):
+			r, err := RedactConfig(n.Value)
+			if err != nil {
+				r = redactedPlaceholder(n.Value)
+			}
+			n.SetString(r)
+		case isSecretPath(path):
+			n.Style = 0
+			n.SetString(redactedPlaceholder(n.Value))
+		}
+	}
+}
+
+// The function `isSecretPath` reports whether a path is at or below one of the `secretPaths`.
+func isSecretPath(path []string) bool {
+	for _, secret := range secretPaths {
+		if len(path) >= len(secret) && pathIs(path[:len(secret)], secret) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The function `pathIs` reports whether a path matches a pattern, where `*` in the pattern matches any
+// single segment.
+func pathIs(path []string, pattern []string) bool {
+	if len(path) != len(pattern) {
+		return false
+	}
+
+	for i, p := range pattern {
+		if p != "*" && p != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The function `isJSONConfig` reports whether the configuration data is JSON rather than YAML.
+func isJSONConfig(configData string) bool {
+	return strings.HasPrefix(strings.TrimSpace(configData), "{")
+}
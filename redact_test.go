@@ -0,0 +1,95 @@
+package mobile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The function `TestRedactConfig` tests that every secret path is redacted in YAML and JSON input,
+// that the structure and comments are kept and that placeholders are keyed.
+func TestRedactConfig(t *testing.T) {
+	secrets := []string{"pki-key", "socks-pw", "psk-key", "ssh-key", "addition-key"}
+	yamlConfig := strings.Join([]string{
+		"# support ticket",
+		"pki:",
+		"  ca: ca-cert",
+		"  key: pki-key",
+		"proxy:",
+		"  socks5:",
+		"    - addr: 127.0.0.1:1080",
+		"      password: socks-pw",
+		"psk:",
+		"  mode: enforced",
+		"  keys: [psk-key]",
+		"ssh:",
+		"  users:",
+		"    - user: admin",
+		"      keys: [ssh-key]",
+		"sync:",
+		"  addition: 'pki: {key: addition-key}'",
+		"",
+	}, "\n")
+	jsonConfig := `{"pki": {"ca": "ca-cert", "key": "pki-key"}, "proxy": {"socks5": [{"addr": "127.0.0.1:1080", "password": "socks-pw"}]}, "psk": {"mode": "enforced", "keys": ["psk-key"]}, "ssh": {"users": [{"user": "admin", "keys": ["ssh-key"]}]}, "sync": {"addition": "pki: {key: addition-key}"}}`
+
+	for name, configData := range map[string]string{"yaml": yamlConfig, "json": jsonConfig} {
+		t.Run(name, func(t *testing.T) {
+			r, err := RedactConfig(configData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range secrets {
+				if strings.Contains(r, s) {
+					t.Errorf("secret %q was not redacted:\n%s", s, r)
+				}
+
+				// An unkeyed hash of the secret could be brute-forced
+				sum := sha256.Sum256([]byte(s))
+				if strings.Contains(r, hex.EncodeToString(sum[:16])) {
+					t.Errorf("placeholder of %q is an unkeyed hash", s)
+				}
+			}
+
+			for _, s := range []string{"ca-cert", "127.0.0.1:1080", "enforced", "admin", redactedPlaceholder("pki-key")} {
+				if !strings.Contains(r, s) {
+					t.Errorf("expected %q to be kept:\n%s", s, r)
+				}
+			}
+
+			if name == "yaml" && !strings.HasPrefix(r, "# support ticket\n") {
+				t.Errorf("expected comments to be kept:\n%s", r)
+			}
+			if name == "json" && !isJSONConfig(r) {
+				t.Errorf("expected JSON output:\n%s", r)
+			}
+		})
+	}
+
+	if redactedPlaceholder("a") != redactedPlaceholder("a") || redactedPlaceholder("a") == redactedPlaceholder("b") {
+		t.Error("expected placeholders to be stable and to tell secrets apart")
+	}
+
+	if _, err := RedactConfig("pki: [\n"); err == nil {
+		t.Error("expected an invalid config to be rejected")
+	}
+}
+
+// The function `TestRedactedPlaceholderStable` tests that a placeholder does not depend on the process
+// that redacted it, by recomputing it from the fixed key alone.
+func TestRedactedPlaceholderStable(t *testing.T) {
+	r, err := RedactConfig("pki:\n  key: pki-key\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, []byte("mobileVLAN config redaction v1"))
+	mac.Write([]byte("pki-key"))
+	want := "REDACTED:" + hex.EncodeToString(mac.Sum(nil)[:16])
+
+	if !strings.Contains(r, want) {
+		t.Errorf("expected the placeholder %s:\n%s", want, r)
+	}
+}
@@ -0,0 +1,273 @@
+package mobile
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The states a reload transaction can end up in.
+const (
+	// ReloadCommitted means the new configuration is in use and is now the last-known-good config.
+	ReloadCommitted = "committed"
+	// ReloadVerifying means the new configuration is in use, but is rolled back unless a tower becomes
+	// reachable within the grace period.
+	ReloadVerifying = "verifying"
+	// ReloadRolledBack means the new configuration was rejected and the last-known-good config is in
+	// use again.
+	ReloadRolledBack = "rolled_back"
+	// ReloadRejected means the new configuration was never applied, for example because its config
+	// bundle signature did not verify.
+	ReloadRejected = "rejected"
+	// ReloadFailed means the new configuration was rejected and restoring the last-known-good config
+	// failed as well.
+	ReloadFailed = "failed"
+)
+
+// The default time a reloaded configuration gets to reach a tower before it is rolled back.
+const defaultReloadGracePeriod = 30 * time.Second
+
+// The ReloadResult type reports the outcome of a reload transaction.
+// @property {int64} ID - Identifies the transaction, increases with every reload.
+// @property {string} State - One of `ReloadCommitted`, `ReloadVerifying`, `ReloadRejected`,
+// `ReloadRolledBack` or `ReloadFailed`.
+// @property {string} Reason - Why the transaction was rolled back or failed.
+// @property {[]string} Towers - The tower endpoints that were checked for reachability.
+// @property Time - The time the transaction reached its current state.
+type ReloadResult struct {
+	ID     int64
+	State  string
+	Reason string
+	Towers []string
+	Time   time.Time
+}
+
+// The `rejected` method reports whether the transaction ended without the new configuration in use.
+func (r *ReloadResult) rejected() bool {
+	return r.State == ReloadRejected || r.State == ReloadRolledBack || r.State == ReloadFailed
+}
+
+// The `SetReloadGracePeriod` method sets how long, in seconds, a reloaded configuration gets to reach
+// at least one tower before it is rolled back. A value of 0 disables the reachability check.
+func (x *Bulk) SetReloadGracePeriod(seconds int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.reloadGrace = time.Duration(seconds) * time.Second
+}
+
+// The `ReloadWithResult` method reloads the configuration like `Reload`, but returns the JSON encoded
+// `ReloadResult` of the transaction instead of an error.
+func (x *Bulk) ReloadWithResult(configData string) (string, error) {
+	return marshalJSON(x.reload(configData))
+}
+
+// The `LastReloadResult` method returns the JSON encoded `ReloadResult` of the most recent reload, or
+// `null` when the configuration was never reloaded.
+func (x *Bulk) LastReloadResult() (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return marshalJSON(x.lastReload)
+}
+
+// The `reload` method applies a new configuration as a transaction. Signed config bundles are verified
+// against the CA of the active configuration and references are resolved first. If the core rejects
+// the configuration, or if towers were reachable before and none is reachable again within the grace
+// period, the last-known-good configuration is restored.
+//
+// Transactions are serialized by `x.reloadMu`. `x.mu` is only held to swap state, never while the
+// app's resolver, the core or its reload callbacks run, and the "reload" event is delivered once the
+// transaction is finished.
+func (x *Bulk) reload(configData string) *ReloadResult {
+	return x.reloaded(x.applyReload(configData))
+}
+
+// The `reloaded` method delivers the "reload" event of a transaction and verifies the configuration for
+// the grace period it still has. The caller must not hold `x.reloadMu`.
+func (x *Bulk) reloaded(r *ReloadResult, verify time.Duration) *ReloadResult {
+	x.emit("reload", r)
+
+	if verify > 0 {
+		go x.verifyReload(*r, verify)
+	}
+	return r
+}
+
+// The `applyReload` method is the transaction behind `reload`. It returns the grace period the
+// configuration still has to be verified within, or 0 when the transaction is finished.
+func (x *Bulk) applyReload(configData string) (*ReloadResult, time.Duration) {
+	x.reloadMu.Lock()
+	defer x.reloadMu.Unlock()
+	return x.transact(configData)
+}
+
+// The `transact` method runs a reload transaction. The caller must hold `x.reloadMu`.
+func (x *Bulk) transact(configData string) (*ReloadResult, time.Duration) {
+	x.mu.Lock()
+	x.reloadID++
+	r := &ReloadResult{ID: x.reloadID}
+	grace := x.reloadGrace
+	x.mu.Unlock()
+
+	wasReachable := x.towerReachable(x.towers())
+	configData, err := prepareConfig(configData, x.config.GetString("pki.ca", ""))
+	var (
+		resolved string
+		state    runtimeState
+	)
+	if err == nil {
+		resolved, state, err = x.activeConfig(configData)
+	}
+	if err != nil {
+		r.State = ReloadRejected
+		r.Reason = err.Error()
+		r.Time = time.Now()
+		x.setLastReload(r)
+		return r, 0
+	}
+
+	if err := x.applyConfig(resolved); err != nil {
+		x.rollback(r, fmt.Sprintf("failed to apply config: %s", err))
+		return r, 0
+	}
+
+	x.setActive(configData, resolved, state)
+
+	r.Towers = x.towers()
+	if grace <= 0 || !wasReachable || len(r.Towers) == 0 {
+		x.commit(r)
+		return r, 0
+	}
+
+	r.State = ReloadVerifying
+	r.Time = time.Now()
+	x.setLastReload(r)
+	return r, grace
+}
+
+// The `verifyReload` method waits for a tower to become reachable after a reload and either commits
+// the configuration or rolls it back once the grace period expires. A newer reload supersedes it.
+func (x *Bulk) verifyReload(r ReloadResult, grace time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if !x.checkReload(&r, grace, now) {
+			continue
+		}
+
+		if r.State != ReloadVerifying {
+			x.emit("reload", r)
+		}
+		return
+	}
+}
+
+// The `checkReload` method runs one reachability check of a reload being verified. It commits the
+// configuration once a tower is reachable and rolls it back once the grace period that started when
+// the reload was applied is over at `now`. It reports whether verification is finished, which includes
+// the reload having been superseded.
+func (x *Bulk) checkReload(r *ReloadResult, grace time.Duration, now time.Time) bool {
+	x.reloadMu.Lock()
+	defer x.reloadMu.Unlock()
+
+	x.mu.Lock()
+	current := x.reloadID == r.ID
+	x.mu.Unlock()
+	if !current {
+		return true
+	}
+
+	switch {
+	case x.towerReachable(r.Towers):
+		x.commit(r)
+	case now.After(r.Time.Add(grace)):
+		x.rollback(r, fmt.Sprintf("no tower reachable within %s", grace))
+	default:
+		return false
+	}
+
+	return true
+}
+
+// The `commit` method makes the active configuration the last-known-good config. The caller must hold
+// `x.reloadMu`.
+func (x *Bulk) commit(r *ReloadResult) {
+	r.State = ReloadCommitted
+	r.Time = time.Now()
+
+	x.mu.Lock()
+	x.lastGood = x.active
+	x.lastGoodRuntime = x.activeRuntime
+	x.lastReload = r
+	x.mu.Unlock()
+	x.l.Info("Reload %d committed", r.ID)
+}
+
+// The `rollback` method restores the last-known-good config and the runtime state that was layered
+// over it. The caller must hold `x.reloadMu`.
+func (x *Bulk) rollback(r *ReloadResult, reason string) {
+	x.mu.Lock()
+	lastGood := x.lastGood
+	x.restoreRuntime(x.lastGoodRuntime)
+	x.mu.Unlock()
+
+	r.Reason = reason
+	r.State = ReloadRolledBack
+	resolved, state, err := x.activeConfig(lastGood)
+	if err == nil {
+		err = x.applyConfig(resolved)
+	}
+	if err == nil {
+		x.setActive(lastGood, resolved, state)
+	} else {
+		r.State = ReloadFailed
+		r.Reason = fmt.Sprintf("%s; restoring last-known-good config failed: %s", reason, err)
+	}
+
+	r.Time = time.Now()
+	x.setLastReload(r)
+	x.l.Warn("Reload %d %s: %s", r.ID, r.State, r.Reason)
+}
+
+// The `setLastReload` method records the result of the most recent reload.
+func (x *Bulk) setLastReload(r *ReloadResult) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.lastReload = r
+}
+
+// The `towers` method returns the tower endpoints of the applied configuration, taken from
+// `tower.hosts`.
+func (x *Bulk) towers() []string {
+	hosts, _ := normalizeValue(x.config.Get("tower.hosts")).([]any)
+	towers := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		endpoint := fmt.Sprint(h)
+		if _, err := parseEndpoint(endpoint); err == nil && !containsString(towers, endpoint) {
+			towers = append(towers, endpoint)
+		}
+	}
+
+	sort.Strings(towers)
+	return towers
+}
+
+// The `towerReachable` method reports whether a tunnel to at least one of the towers is established.
+func (x *Bulk) towerReachable(towers []string) bool {
+	for _, endpoint := range towers {
+		ep, err := parseEndpoint(endpoint)
+		if err != nil {
+			continue
+		}
+
+		if x.reachable != nil {
+			if x.reachable(ep) {
+				return true
+			}
+		} else if x.c.GetpointByEndpoint(ep, false) != nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,140 @@
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfg "git.weixin.qq.com/__/vlan/lib/config"
+	"git.weixin.qq.com/__/vlan/lib/network/iputil"
+	"git.weixin.qq.com/__/vlan/lib/utils/logs/logger"
+)
+
+// The type `reentrantListener` reads the last reload result from inside the event callback, which
+// deadlocks if events are delivered while the `Bulk` is locked.
+type reentrantListener struct {
+	x      *Bulk
+	states []string
+}
+
+func (l *reentrantListener) OnEvent(eventJSON string) {
+	var e struct{ Data ReloadResult }
+	_ = json.Unmarshal([]byte(eventJSON), &e)
+	if _, err := l.x.LastReloadResult(); err == nil {
+		l.states = append(l.states, e.Data.State)
+	}
+}
+
+// The function `newReloadBulk` returns a `Bulk` running `configData` whose core rejects configs that
+// mention "rejected_by_core" and whose towers are reachable while `up` is set.
+func newReloadBulk(t *testing.T, configData string, up *atomic.Bool) *Bulk {
+	t.Helper()
+
+	l := logger.New(1000)
+	l.SetOutput(io.Discard)
+	c := cfg.NewC(l)
+	if err := c.LoadString(configData); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Bulk{
+		l:      l,
+		config: c,
+		apply: func(resolved string) error {
+			if strings.Contains(resolved, "rejected_by_core") {
+				return errors.New("invalid config")
+			}
+			return c.ReloadConfigString(resolved)
+		},
+		reachable:   func(ep iputil.Endpoint) bool { return up.Load() },
+		lastGood:    configData,
+		active:      configData,
+		reloadGrace: time.Minute,
+	}
+}
+
+// The function `TestReloadRollback` tests that a config the core rejects is rolled back to the
+// last-known-good config and that events are delivered without holding the `Bulk` locked.
+func TestReloadRollback(t *testing.T) {
+	configData := "logging:\n  level: info\n"
+	var up atomic.Bool
+	x := newReloadBulk(t, configData, &up)
+	listener := &reentrantListener{x: x}
+	x.SetEventListener(listener)
+
+	if err := x.Reload("logging:\n  level: debug\n"); err != nil {
+		t.Fatal(err)
+	}
+	if x.config.GetString("logging.level", "") != "debug" || x.lastGood != "logging:\n  level: debug\n" {
+		t.Errorf("expected the reload to be committed, got level %s", x.config.GetString("logging.level", ""))
+	}
+
+	if err := x.Reload("logging:\n  level: rejected_by_core\n"); err == nil {
+		t.Error("expected the rejected config to return an error")
+	}
+	if x.lastReload.State != ReloadRolledBack || !strings.Contains(x.lastReload.Reason, "invalid config") {
+		t.Errorf("expected the reload to be rolled back, got %+v", x.lastReload)
+	}
+	if x.config.GetString("logging.level", "") != "debug" || x.active != x.lastGood {
+		t.Errorf("expected the last-known-good config to be restored, got level %s", x.config.GetString("logging.level", ""))
+	}
+
+	if err := x.Reload("logging: [\n"); err == nil || x.lastReload.State != ReloadRejected {
+		t.Errorf("expected an invalid config to be rejected, got %+v", x.lastReload)
+	}
+
+	want := []string{ReloadCommitted, ReloadRolledBack, ReloadRejected}
+	if strings.Join(listener.states, ",") != strings.Join(want, ",") {
+		t.Errorf("expected events %v, got %v", want, listener.states)
+	}
+}
+
+// The function `TestReloadGracePeriod` tests that a reload that loses every tower is rolled back once
+// the grace period expires, and committed if a tower comes back in time.
+func TestReloadGracePeriod(t *testing.T) {
+	configData := "tower:\n  hosts: [\"10.1.0.1\"]\npoints:\n  \"10.1.0.1\": [\"203.0.113.1:4242\"]\n  \"10.1.0.9\": [\"203.0.113.9:4242\"]\n"
+	var up atomic.Bool
+	up.Store(true)
+	x := newReloadBulk(t, configData, &up)
+
+	if towers := x.towers(); len(towers) != 1 || towers[0] != "10.1.0.1" {
+		t.Fatalf("expected only tower.hosts to count as towers, got %v", towers)
+	}
+
+	broken := configData + "points_broken: true\n"
+	r, grace := x.applyReload(broken)
+	if r.State != ReloadVerifying || grace != time.Minute {
+		t.Fatalf("expected the reload to be verified, got %+v", r)
+	}
+
+	up.Store(false)
+	v := *r
+	if x.checkReload(&v, grace, v.Time.Add(30*time.Second)) {
+		t.Error("expected verification to continue within the grace period")
+	}
+	if !x.checkReload(&v, grace, v.Time.Add(grace+time.Second)) {
+		t.Fatal("expected verification to end after the grace period")
+	}
+	if v.State != ReloadRolledBack || x.active != configData || x.config.IsSet("points_broken") {
+		t.Errorf("expected the reload to be rolled back, got %+v", v)
+	}
+
+	up.Store(true)
+	r, grace = x.applyReload(broken)
+	v = *r
+	if !x.checkReload(&v, grace, v.Time.Add(time.Second)) || v.State != ReloadCommitted || x.lastGood != broken {
+		t.Errorf("expected the reload to be committed once a tower is reachable, got %+v", v)
+	}
+
+	// A superseded reload is not verified any further
+	r, grace = x.applyReload(configData)
+	v = *r
+	x.applyReload(configData + "logging:\n  level: debug\n")
+	if !x.checkReload(&v, grace, v.Time.Add(grace+time.Second)) || v.State != ReloadVerifying {
+		t.Errorf("expected the superseded reload to be left alone, got %+v", v)
+	}
+}
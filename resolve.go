@@ -0,0 +1,181 @@
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The reference kinds understood in configuration data. `${secret:name}` is resolved by the registered
+// `ConfigResolver` only, `${env:NAME}` falls back to the process environment when none is registered.
+// `$${` writes a literal `${`.
+const (
+	RefSecret = "secret"
+	RefEnv    = "env"
+)
+
+// The ConfigResolver interface is implemented by the app to resolve `${secret:name}` and `${env:NAME}`
+// references in configuration data, for example from the platform keystore.
+type ConfigResolver interface {
+	Resolve(kind string, name string) (string, error)
+}
+
+var (
+	resolverMu sync.RWMutex
+	resolver   ConfigResolver
+)
+
+// The function `SetConfigResolver` registers the resolver used for references in configuration data
+// handed to `NewBulk`, `Reload`, `ValidateConfig` and `GetConfigSetting`. Passing nil unregisters it.
+func SetConfigResolver(r ConfigResolver) {
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolver = r
+}
+
+// The function `ValidateConfig` checks that configuration data can be loaded: config versions
+// migrate, every reference resolves and the result parses. Signed config bundles need a trusted CA
+// and are rejected, verify them with `VerifyConfigBundle`.
+func ValidateConfig(configData string) error {
+	configData, err := prepareConfig(configData, "")
+	if err != nil {
+		return err
+	}
+
+	configData, err = resolveConfig(configData)
+	if err != nil {
+		return err
+	}
+
+	if _, err := loadQuietConfig(configData); err != nil {
+		return fmt.Errorf("failed to load config: %s", err)
+	}
+
+	return nil
+}
+
+// The function `resolveConfig` replaces the references in the string values of the configuration
+// data. Configuration data without references is returned unchanged, otherwise the result is JSON.
+// The result holds resolved secrets and must never be logged or stored, keep the input for that.
+func resolveConfig(configData string) (string, error) {
+	if !strings.Contains(configData, "${") {
+		return configData, nil
+	}
+
+	settings, err := loadSettings(configData)
+	if err != nil {
+		return "", err
+	}
+
+	resolverMu.RLock()
+	r := resolver
+	resolverMu.RUnlock()
+
+	var unresolved []string
+	resolved := resolveValue(settings, "", r, &unresolved)
+	if len(unresolved) > 0 {
+		sort.Strings(unresolved)
+		return "", fmt.Errorf("unresolved config references: %s", strings.Join(unresolved, "; "))
+	}
+
+	return marshalJSON(resolved)
+}
+
+// The function `resolveValue` resolves the references below `v` and records the ones that failed in
+// `unresolved`, by path.
+func resolveValue(v any, path string, r ConfigResolver, unresolved *[]string) any {
+	switch t := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(t))
+		for k, val := range t {
+			m[k] = resolveValue(val, joinPath(path, k), r, unresolved)
+		}
+		return m
+	case []any:
+		l := make([]any, len(t))
+		for i, val := range t {
+			l[i] = resolveValue(val, fmt.Sprintf("%s[%d]", path, i), r, unresolved)
+		}
+		return l
+	case string:
+		s, err := interpolate(t, r)
+		if err != nil {
+			*unresolved = append(*unresolved, fmt.Sprintf("%s: %s", path, err))
+			return t
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// The function `interpolate` replaces the references in `s`. Errors name the reference but never a
+// resolved value.
+func interpolate(s string, r ConfigResolver) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "$")
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+
+		b.WriteString(s[:i])
+		s = s[i:]
+		switch {
+		case strings.HasPrefix(s, "$${"):
+			b.WriteString("${")
+			s = s[3:]
+		case strings.HasPrefix(s, "${"):
+			end := strings.Index(s, "}")
+			if end < 0 {
+				return "", errors.New("unterminated reference")
+			}
+
+			v, err := resolveRef(s[2:end], r)
+			if err != nil {
+				return "", err
+			}
+
+			b.WriteString(v)
+			s = s[end+1:]
+		default:
+			b.WriteByte('$')
+			s = s[1:]
+		}
+	}
+}
+
+// The function `resolveRef` resolves a single reference written as `kind:name`.
+func resolveRef(ref string, r ConfigResolver) (string, error) {
+	kind, name, ok := strings.Cut(ref, ":")
+	if !ok || name == "" {
+		return "", fmt.Errorf("invalid reference ${%s}, expected ${secret:name} or ${env:NAME}", ref)
+	}
+
+	switch kind {
+	case RefSecret, RefEnv:
+	default:
+		return "", fmt.Errorf("unknown reference kind %q in ${%s}", kind, ref)
+	}
+
+	if r == nil {
+		if kind == RefEnv {
+			if v, ok := os.LookupEnv(name); ok {
+				return v, nil
+			}
+			return "", fmt.Errorf("${%s} is not set", ref)
+		}
+		return "", fmt.Errorf("${%s} can not be resolved, no config resolver is registered", ref)
+	}
+
+	v, err := r.Resolve(kind, name)
+	if err != nil {
+		return "", fmt.Errorf("${%s} can not be resolved: %s", ref, err)
+	}
+
+	return v, nil
+}
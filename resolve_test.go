@@ -0,0 +1,61 @@
+package mobile
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The type `mapResolver` is a `ConfigResolver` backed by a map keyed by `kind:name`.
+type mapResolver map[string]string
+
+func (m mapResolver) Resolve(kind string, name string) (string, error) {
+	v, ok := m[kind+":"+name]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return v, nil
+}
+
+// The function `TestResolveConfig` tests that references resolve through the registered resolver and
+// that unresolved references are reported by path without leaking resolved values.
+func TestResolveConfig(t *testing.T) {
+	SetConfigResolver(mapResolver{"secret:pki_key": "s3cr3t", "env:TOWER_ADDR": "203.0.113.1"})
+	defer SetConfigResolver(nil)
+
+	configData := "pki:\n  key: ${secret:pki_key}\npoints:\n  \"6.6.6.6\": [\"${env:TOWER_ADDR}:4242\"]\nlogging:\n  format: $${literal}\n"
+	if err := ValidateConfig(configData); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := GetConfigSetting(configData, "pki.key"); got != "s3cr3t" {
+		t.Errorf("expected the secret to resolve, got %q", got)
+	}
+
+	if got := GetConfigSetting(configData, "logging.format"); got != "${literal}" {
+		t.Errorf("expected the escaped reference to be kept literally, got %q", got)
+	}
+
+	resolved, err := resolveConfig(configData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resolved, "203.0.113.1:4242") {
+		t.Errorf("expected the env reference to resolve inside the string, got %s", resolved)
+	}
+
+	err = ValidateConfig("pki:\n  key: ${secret:missing}\n  cert: ${vault:x}\n  ca: ${secret:pki_key\n")
+	if err == nil {
+		t.Fatal("expected unresolved references to be reported")
+	}
+
+	for _, want := range []string{"pki.key: ${secret:missing}", "pki.cert: unknown reference kind", "pki.ca: unterminated"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Error("resolved secret leaked into the error")
+	}
+}
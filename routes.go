@@ -0,0 +1,406 @@
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+)
+
+// The RouteEntry type is an unsafe route as listed by `ListRoutes`.
+// @property {string} Route - The network in CIDR notation.
+// @property {string} Via - The VPN IP of the point that routes the network.
+// @property {int} Mtu - The MTU of the route, 0 for the tun MTU.
+// @property {int} Metric - The metric of the route.
+// @property {bool} Enable - Whether the route is installed.
+// @property {string} Source - Either "config" or "runtime".
+type RouteEntry struct {
+	Route  string
+	Via    string
+	Mtu    int
+	Metric int
+	Enable bool
+	Source string
+}
+
+// The RouteChange type is the result of a runtime route change.
+// @property {[]RouteEntry} Routes - The effective unsafe routes after the change.
+// @property {[]string} Add - The CIDRs the platform must now add to its VPN interface settings.
+// @property {[]string} Remove - The CIDRs the platform must now remove from its VPN interface settings.
+type RouteChange struct {
+	Routes []RouteEntry
+	Add    []string
+	Remove []string
+}
+
+// The routeState type holds the unsafe route changes made at runtime, keyed by canonical CIDR. Like
+// runtime firewall rules they are layered over `tun.route_table` on every reload.
+// @property added - The routes added at runtime, in the shape of the config.
+// @property order - The CIDRs of `added`, in the order they were added.
+// @property removed - The routes of the config removed at runtime.
+// @property enabled - The routes enabled or disabled at runtime.
+type routeState struct {
+	added   map[string]map[string]any
+	order   []string
+	removed map[string]bool
+	enabled map[string]bool
+}
+
+// The `empty` method reports whether no route was changed at runtime.
+func (s *routeState) empty() bool {
+	return len(s.order) == 0 && len(s.removed) == 0 && len(s.enabled) == 0
+}
+
+// The `clone` method returns a copy of the state to roll back to.
+func (s *routeState) clone() routeState {
+	c := routeState{
+		added:   make(map[string]map[string]any, len(s.added)),
+		order:   append([]string{}, s.order...),
+		removed: make(map[string]bool, len(s.removed)),
+		enabled: make(map[string]bool, len(s.enabled)),
+	}
+	for k, v := range s.added {
+		route := make(map[string]any, len(v))
+		for rk, rv := range v {
+			route[rk] = rv
+		}
+		c.added[k] = route
+	}
+	for k, v := range s.removed {
+		c.removed[k] = v
+	}
+	for k, v := range s.enabled {
+		c.enabled[k] = v
+	}
+
+	return c
+}
+
+// The `AddRoute` method adds an unsafe route to the running config and returns the JSON encoded
+// `RouteChange`. `routeJSON` holds the route in the shape of `tun.route_table` entries; `enable`
+// defaults to true, and `via` must be the VPN IP of a point inside the VPN network of this point's
+// cert. Routes are updated by a reload transaction, without dropping tunnels.
+func (x *Bulk) AddRoute(routeJSON string) (string, error) {
+	var rt RouteTable
+	rt.Enable = true
+	if err := json.Unmarshal([]byte(routeJSON), &rt); err != nil {
+		return "", fmt.Errorf("invalid route: %s", err)
+	}
+
+	cidr, err := canonicalCIDR(rt.Route)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := parseEndpoint(rt.Via); err != nil {
+		return "", fmt.Errorf("invalid via: %s", err)
+	}
+
+	via := netip.MustParseAddr(strings.TrimSpace(rt.Via)).Unmap()
+	if err := x.checkVia(via); err != nil {
+		return "", err
+	}
+
+	if rt.Mtu < 0 || rt.Metric < 0 {
+		return "", errors.New("invalid route: mtu and metric must not be negative")
+	}
+
+	route := map[string]any{"route": cidr, "via": via.String(), "enable": rt.Enable}
+	if rt.Mtu > 0 {
+		route["mtu"] = rt.Mtu
+	}
+	if rt.Metric > 0 {
+		route["metric"] = rt.Metric
+	}
+
+	return x.changeRoutes(func(s *routeState, effective map[string]RouteEntry) error {
+		if _, ok := effective[cidr]; ok {
+			return fmt.Errorf("route %s already exists", cidr)
+		}
+
+		if s.added == nil {
+			s.added = map[string]map[string]any{}
+		}
+		s.added[cidr] = route
+		s.order = append(s.order, cidr)
+		delete(s.removed, cidr)
+		delete(s.enabled, cidr)
+		return nil
+	})
+}
+
+// The `RemoveRoute` method removes an unsafe route, added at runtime or taken from the config, and
+// returns the JSON encoded `RouteChange`. A route of the config stays removed across reloads.
+func (x *Bulk) RemoveRoute(cidr string) (string, error) {
+	cidr, err := canonicalCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	return x.changeRoutes(func(s *routeState, effective map[string]RouteEntry) error {
+		e, ok := effective[cidr]
+		if !ok {
+			return fmt.Errorf("unknown route %s", cidr)
+		}
+
+		if e.Source == RuleSourceRuntime {
+			delete(s.added, cidr)
+			for i, c := range s.order {
+				if c == cidr {
+					s.order = append(s.order[:i:i], s.order[i+1:]...)
+					break
+				}
+			}
+		} else {
+			if s.removed == nil {
+				s.removed = map[string]bool{}
+			}
+			s.removed[cidr] = true
+		}
+
+		delete(s.enabled, cidr)
+		return nil
+	})
+}
+
+// The `SetRouteEnabled` method enables or disables an unsafe route and returns the JSON encoded
+// `RouteChange`.
+func (x *Bulk) SetRouteEnabled(cidr string, enable bool) (string, error) {
+	cidr, err := canonicalCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	return x.changeRoutes(func(s *routeState, effective map[string]RouteEntry) error {
+		e, ok := effective[cidr]
+		if !ok {
+			return fmt.Errorf("unknown route %s", cidr)
+		}
+
+		if e.Source == RuleSourceRuntime {
+			s.added[cidr]["enable"] = enable
+			return nil
+		}
+
+		if s.enabled == nil {
+			s.enabled = map[string]bool{}
+		}
+		s.enabled[cidr] = enable
+		return nil
+	})
+}
+
+// The `ListRoutes` method returns the JSON encoded `RouteEntry` list of the effective unsafe routes.
+func (x *Bulk) ListRoutes() (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return marshalJSON(x.routeEntries(x.activeSettings()))
+}
+
+// The `changeRoutes` method applies a change to the runtime routes as a reload transaction and
+// reports the CIDRs the platform must add and remove.
+func (x *Bulk) changeRoutes(change func(s *routeState, effective map[string]RouteEntry) error) (string, error) {
+	var (
+		before  []string
+		changed bool
+	)
+	err := x.changeRuntime(func() error {
+		before = platformRoutes(x.appliedSettings())
+
+		effective := map[string]RouteEntry{}
+		for _, e := range x.routeEntries(x.activeSettings()) {
+			effective[e.Route] = e
+		}
+
+		if err := change(&x.routes, effective); err != nil {
+			return err
+		}
+		changed = true
+		return nil
+	})
+	if err != nil && changed {
+		return "", fmt.Errorf("failed to apply routes: %s", err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	after := platformRoutes(x.appliedSettings())
+	r := &RouteChange{
+		Routes: x.routeEntries(x.activeSettings()),
+		Add:    subtractStrings(after, before),
+		Remove: subtractStrings(before, after),
+	}
+
+	x.l.Info("Updated unsafe routes, adding %v and removing %v", r.Add, r.Remove)
+	return marshalJSON(r)
+}
+
+// The `checkVia` method checks that the gateway of a route lies inside one of the VPN networks of the
+// cert of this point, as only points of the network can route traffic.
+func (x *Bulk) checkVia(via netip.Addr) error {
+	x.mu.Lock()
+	rawCert, _ := lookupPath(x.appliedSettings(), "pki.cert")
+	x.mu.Unlock()
+
+	s, _ := rawCert.(string)
+	c, _, err := cert.UnmarshalCertificateFromPEM([]byte(s))
+	if err != nil {
+		return fmt.Errorf("error while unmarshaling cert: %s", err)
+	}
+
+	var networks []string
+	for _, ipNet := range c.Details.Ips {
+		ones, _ := ipNet.Mask.Size()
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+
+		network := netip.PrefixFrom(ip.Unmap(), ones).Masked()
+		if network.Contains(via) {
+			return nil
+		}
+		networks = append(networks, network.String())
+	}
+
+	if len(networks) == 0 {
+		return errors.New("cert carries no IP")
+	}
+
+	return fmt.Errorf("invalid via %s: not inside the VPN network %s", via, strings.Join(networks, ", "))
+}
+
+// The `routeEntries` method layers the runtime route changes over `tun.route_table` of `settings` and
+// returns the effective routes. The caller must hold `x.mu`.
+func (x *Bulk) routeEntries(settings map[string]any) []RouteEntry {
+	raw, _ := lookupPath(settings, "tun.route_table")
+	list, _ := raw.([]any)
+
+	entries := []RouteEntry{}
+	effective := make([]any, 0, len(list)+len(x.routes.order))
+	for _, v := range list {
+		m, _ := v.(map[string]any)
+		cidr, err := canonicalCIDR(fmt.Sprint(m["route"]))
+		if err != nil || x.routes.removed[cidr] || x.routes.added[cidr] != nil {
+			if err != nil {
+				effective = append(effective, v)
+			}
+			continue
+		}
+
+		if enable, ok := x.routes.enabled[cidr]; ok {
+			copied := make(map[string]any, len(m))
+			for k, val := range m {
+				copied[k] = val
+			}
+			copied["enable"] = enable
+			m = copied
+		}
+
+		effective = append(effective, m)
+		entries = append(entries, newRouteEntry(m, cidr, RuleSourceConfig))
+	}
+
+	for _, cidr := range x.routes.order {
+		m := x.routes.added[cidr]
+		effective = append(effective, m)
+		entries = append(entries, newRouteEntry(m, cidr, RuleSourceRuntime))
+	}
+
+	if !x.routes.empty() {
+		setPath(settings, "tun.route_table", effective)
+	}
+
+	return entries
+}
+
+// The function `newRouteEntry` creates the listing entry of a route.
+func newRouteEntry(m map[string]any, cidr string, source string) RouteEntry {
+	rt := RouteTable{Enable: routeEnabled(m)}
+	if b, err := json.Marshal(m); err == nil {
+		_ = json.Unmarshal(b, &rt)
+	}
+
+	return RouteEntry{
+		Route:  cidr,
+		Via:    rt.Via,
+		Mtu:    rt.Mtu,
+		Metric: rt.Metric,
+		Enable: rt.Enable,
+		Source: source,
+	}
+}
+
+// The function `routeEnabled` reports whether a `tun.route_table` entry is enabled. Like `AddRoute`,
+// the core takes an entry without `enable` as enabled.
+func routeEnabled(m map[string]any) bool {
+	v, ok := m["enable"]
+	if !ok {
+		return true
+	}
+
+	enable, _ := v.(bool)
+	return enable
+}
+
+// The function `platformRoutes` returns the CIDRs the platform routes into the VPN interface for the
+// settings: `tun.routes` and the enabled entries of `tun.route_table`.
+func platformRoutes(v any) []string {
+	settings, _ := v.(map[string]any)
+
+	seen := map[string]bool{}
+	for _, path := range []string{"tun.routes", "tun.route_table"} {
+		raw, _ := lookupPath(settings, path)
+		list, _ := raw.([]any)
+		for _, e := range list {
+			m, _ := e.(map[string]any)
+			if path == "tun.route_table" && !routeEnabled(m) {
+				continue
+			}
+
+			if cidr, err := canonicalCIDR(fmt.Sprint(m["route"])); err == nil {
+				seen[cidr] = true
+			}
+		}
+	}
+
+	cidrs := make([]string, 0, len(seen))
+	for cidr := range seen {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	return cidrs
+}
+
+// The function `canonicalCIDR` returns a network in canonical CIDR notation, with the host bits
+// cleared.
+func canonicalCIDR(s string) (string, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(s))
+	if err != nil {
+		return "", fmt.Errorf("invalid route %q: %s", s, err)
+	}
+
+	return p.Masked().String(), nil
+}
+
+// The function `subtractStrings` returns the sorted elements of `a` that are not in `b`.
+func subtractStrings(a, b []string) []string {
+	out := []string{}
+	for _, s := range a {
+		if !containsString(b, s) {
+			out = append(out, s)
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,131 @@
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cfg "git.weixin.qq.com/__/vlan/lib/config"
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+	"git.weixin.qq.com/__/vlan/lib/utils/logs/logger"
+)
+
+// The type `fakeTunnelCore` is a core that keeps its tunnels across reloads that only change hot
+// reloadable settings and drops them on any other change, and that rejects routes via 10.1.0.66.
+type fakeTunnelCore struct {
+	c       *cfg.C
+	running string
+	tunnels int
+}
+
+func (f *fakeTunnelCore) apply(resolved string) error {
+	if strings.Contains(resolved, "10.1.0.66") {
+		return errors.New("gateway unreachable")
+	}
+
+	d, err := diffConfigs(f.running, resolved)
+	if err != nil {
+		return err
+	}
+	if d.RequiresRestart || d.RequiresRehandshake {
+		f.tunnels = 0
+	}
+
+	f.running = resolved
+	return f.c.ReloadConfigString(resolved)
+}
+
+// The function `TestRoutes` tests runtime route changes, the CIDRs reported to the platform, and that
+// the core applies them without dropping tunnels.
+func TestRoutes(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.1.0.0/16")
+	ipNet.IP = net.ParseIP("10.1.0.2").To4()
+	ca, _, caKey := newTestSigner(t, cert.Curve_X25519, "ca", nil, nil, nil)
+	now := time.Now()
+	pointCert := signTestCert(t, &cert.Certificate{Details: cert.CertificateDetails{
+		Name:      "phone",
+		Ips:       []*net.IPNet{ipNet},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(time.Hour),
+		PublicKey: make([]byte, 32),
+		Curve:     cert.Curve_X25519,
+	}}, ca, caKey)
+
+	configData, err := marshalJSON(map[string]any{
+		"pki": map[string]any{"cert": pointCert},
+		"tun": map[string]any{
+			"routes":      []any{map[string]any{"route": "10.9.0.0/16"}},
+			"route_table": []any{map[string]any{"route": "192.168.10.0/24", "via": "10.1.0.1"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := logger.New(1000)
+	l.SetOutput(io.Discard)
+	c := cfg.NewC(l)
+	if err := c.LoadString(configData); err != nil {
+		t.Fatal(err)
+	}
+	core := &fakeTunnelCore{c: c, running: configData, tunnels: 3}
+	x := &Bulk{l: l, config: c, apply: core.apply, lastGood: configData, active: configData}
+
+	change := func(out string, err error) RouteChange {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var r RouteChange
+		if err := json.Unmarshal([]byte(out), &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := change(x.AddRoute(`{"route": "172.16.5.1/24", "via": "10.1.0.7", "metric": 10}`))
+	if !reflect.DeepEqual(r.Add, []string{"172.16.5.0/24"}) || len(r.Remove) != 0 || len(r.Routes) != 2 || !r.Routes[0].Enable {
+		t.Errorf("unexpected change: %+v", r)
+	}
+	if !strings.Contains(core.running, "172.16.5.0/24") {
+		t.Error("expected the route to be handed to the core")
+	}
+
+	for route, want := range map[string]string{
+		`{"route": "192.168.10.0/24", "via": "10.1.0.2"}`: "already exists",
+		`{"route": "172.16.6.0/24", "via": "10.2.0.7"}`:   "not inside the VPN network 10.1.0.0/16",
+		`{"route": "172.16.6.0/24", "via": "fd00::7"}`:    "IPv4 VPN IP",
+		`{"route": "172.16.6.0/24", "via": "10.1.0.66"}`:  "gateway unreachable",
+	} {
+		if _, err := x.AddRoute(route); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", route, want, err)
+		}
+	}
+	if strings.Contains(core.running, "172.16.6.0/24") || len(x.routes.order) != 1 {
+		t.Error("expected the rejected route to be rolled back")
+	}
+
+	r = change(x.SetRouteEnabled("192.168.10.0/24", false))
+	if !reflect.DeepEqual(r.Remove, []string{"192.168.10.0/24"}) || len(r.Add) != 0 {
+		t.Errorf("unexpected change: %+v", r)
+	}
+
+	r = change(x.RemoveRoute("172.16.5.0/24"))
+	if !reflect.DeepEqual(r.Remove, []string{"172.16.5.0/24"}) || len(r.Routes) != 1 || r.Routes[0].Enable {
+		t.Errorf("unexpected change: %+v", r)
+	}
+
+	if _, err := x.RemoveRoute("10.9.0.0/16"); err == nil {
+		t.Error("expected tun.routes to be left to the config")
+	}
+
+	if core.tunnels != 3 {
+		t.Errorf("expected route changes to keep the tunnels, %d of 3 left", core.tunnels)
+	}
+}
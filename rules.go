@@ -0,0 +1,365 @@
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The sources of firewall rules.
+const (
+	RuleSourceConfig  = "config"
+	RuleSourceRuntime = "runtime"
+)
+
+// The FirewallRuleEntry type is a firewall rule as listed by `ListFirewallRules`.
+// @property {string} ID - The ID of the rule. Rules from the config are named after their position.
+// @property {string} Direction - Either "inbound" or "outbound".
+// @property {string} Source - Either "config" or "runtime".
+// @property {int} Position - The index of the rule among the effective rules of its direction.
+// @property {string} Port - The port or port range the rule allows.
+// @property {string} Proto - The protocol the rule allows.
+// @property {string} Point - The cert name the rule allows, if any.
+// @property {[]string} Groups - The groups a peer must all carry, if any.
+// @property Expires - When a runtime rule with a TTL expires, null otherwise.
+type FirewallRuleEntry struct {
+	ID        string
+	Direction string
+	Source    string
+	Position  int
+	Port      string
+	Proto     string
+	Point     string
+	Groups    []string
+	Expires   *time.Time
+}
+
+// The firewallState type holds the firewall rules added at runtime. They are layered over the rules of
+// the config on every reload, so they survive reloads but are never written into the config.
+// @property nextID - The number of the next runtime rule.
+// @property entries - The runtime rules, in the order they were added.
+type firewallState struct {
+	nextID  int64
+	entries []*runtimeRule
+}
+
+// The runtimeRule type is a firewall rule added at runtime.
+type runtimeRule struct {
+	id        string
+	direction string
+	position  int
+	rule      firewallRule
+	expires   time.Time
+	timer     *time.Timer
+}
+
+// The `AddFirewallRule` method adds a firewall rule to the running firewall and returns its JSON encoded
+// `FirewallRuleEntry`. `ruleJSON` holds the rule in the shape of the config, with an optional `ttl` in
+// seconds after which the rule is removed again. `position` is the index among the rules of the
+// direction to insert at, negative to append. The change is applied as a reload transaction and rolled
+// back with it.
+func (x *Bulk) AddFirewallRule(direction string, ruleJSON string, position int) (string, error) {
+	direction = strings.ToLower(direction)
+	if direction != DirectionInbound && direction != DirectionOutbound {
+		return "", fmt.Errorf("invalid direction %q, expected inbound or outbound", direction)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(ruleJSON), &raw); err != nil {
+		return "", fmt.Errorf("invalid rule: %s", err)
+	}
+
+	rule, ttl, err := runtimeRuleFrom(direction, raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid rule: %s", err)
+	}
+
+	var r *runtimeRule
+	err = x.changeRuntime(func() error {
+		x.firewall.nextID++
+		r = &runtimeRule{
+			id:        fmt.Sprintf("runtime:%d", x.firewall.nextID),
+			direction: direction,
+			position:  position,
+			rule:      rule,
+		}
+		if ttl > 0 {
+			r.expires = time.Now().Add(ttl)
+		}
+
+		x.firewall.entries = append(x.firewall.entries, r)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to apply firewall rule: %s", err)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.l.Info("Added %s firewall rule %s: %s", direction, r.id, describeRule(rule))
+	for _, e := range x.firewallEntries(x.activeSettings()) {
+		if e.ID == r.id {
+			if containsRule(x.firewall.entries, r) {
+				x.scheduleExpiry(r)
+			}
+			return marshalJSON(e)
+		}
+	}
+
+	return "", errors.New("added firewall rule is not effective")
+}
+
+// The `RemoveFirewallRule` method removes a firewall rule that was added at runtime. Rules from the
+// config can only be changed through the config.
+func (x *Bulk) RemoveFirewallRule(id string) error {
+	var removed *runtimeRule
+	err := x.changeRuntime(func() error {
+		for i, r := range x.firewall.entries {
+			if r.id == id {
+				removed = r
+				x.firewall.entries = append(append([]*runtimeRule{}, x.firewall.entries[:i]...), x.firewall.entries[i+1:]...)
+				return nil
+			}
+		}
+
+		if strings.HasPrefix(id, RuleSourceConfig+":") {
+			return fmt.Errorf("firewall rule %s comes from the config, change the config instead", id)
+		}
+
+		return fmt.Errorf("unknown firewall rule %s", id)
+	})
+	if removed == nil {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove firewall rule: %s", err)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if removed.timer != nil && !containsRule(x.firewall.entries, removed) {
+		removed.timer.Stop()
+	}
+
+	x.l.Info("Removed %s firewall rule %s", removed.direction, id)
+	return nil
+}
+
+// The `expireFirewallRule` method removes a runtime rule whose TTL is over.
+func (x *Bulk) expireFirewallRule(id string) {
+	if err := x.RemoveFirewallRule(id); err != nil {
+		x.l.Warn("Failed to expire firewall rule %s: %s", id, err)
+	}
+}
+
+// The `scheduleExpiry` method removes a runtime rule with a TTL once it expires. The caller must hold
+// `x.mu`.
+func (x *Bulk) scheduleExpiry(r *runtimeRule) {
+	if r.expires.IsZero() {
+		return
+	}
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	id := r.id
+	r.timer = time.AfterFunc(time.Until(r.expires), func() { x.expireFirewallRule(id) })
+}
+
+// The function `runtimeRuleFrom` reads a rule of `direction` added at runtime and its TTL. Unlike rules
+// of the config, which the core validates on load, unknown keys and values of the wrong type are
+// rejected.
+func runtimeRuleFrom(direction string, raw map[string]any) (firewallRule, time.Duration, error) {
+	for k, v := range raw {
+		switch k {
+		case "port":
+			switch v.(type) {
+			case string, float64:
+			default:
+				return firewallRule{}, 0, errors.New("port must be a number or a string")
+			}
+		case "proto", "point":
+			if _, ok := v.(string); !ok {
+				return firewallRule{}, 0, fmt.Errorf("%s must be a string", k)
+			}
+		case "groups":
+			switch g := v.(type) {
+			case string:
+			case []any:
+				for _, e := range g {
+					if _, ok := e.(string); !ok {
+						return firewallRule{}, 0, errors.New("groups must be strings")
+					}
+				}
+			default:
+				return firewallRule{}, 0, errors.New("groups must be a string or a list of strings")
+			}
+		case "ttl":
+		default:
+			return firewallRule{}, 0, fmt.Errorf("unknown key %q", k)
+		}
+	}
+
+	rule := firewallRuleFrom(raw)
+	if err := checkFirewallRule(direction, rule); err != nil {
+		return firewallRule{}, 0, err
+	}
+
+	var ttl time.Duration
+	if v, ok := raw["ttl"]; ok {
+		seconds, ok := v.(float64)
+		if !ok {
+			return firewallRule{}, 0, errors.New("ttl must be a number of seconds")
+		}
+		if seconds <= 0 {
+			return firewallRule{}, 0, errors.New("ttl must be positive")
+		}
+		ttl = time.Duration(seconds * float64(time.Second))
+	}
+
+	return rule, ttl, nil
+}
+
+// The function `containsRule` reports whether `list` contains the runtime rule `r`.
+func containsRule(list []*runtimeRule, r *runtimeRule) bool {
+	for _, e := range list {
+		if e == r {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The `ListFirewallRules` method returns the JSON encoded `FirewallRuleEntry` list of the effective
+// firewall rules, inbound first.
+func (x *Bulk) ListFirewallRules() (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return marshalJSON(x.firewallEntries(x.activeSettings()))
+}
+
+// The `ExportFirewall` method returns the effective firewall, including runtime rules, as JSON in the
+// shape of the `Firewall` config type.
+func (x *Bulk) ExportFirewall() (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	fw, _ := lookupPath(x.appliedSettings(), "firewall")
+	m, _ := fw.(map[string]any)
+	if m == nil {
+		m = map[string]any{}
+	}
+
+	for _, direction := range []string{DirectionInbound, DirectionOutbound} {
+		list, _ := m[direction].([]any)
+		for i, v := range list {
+			list[i] = firewallRuleSettings(newFirewallRuleEntry("", direction, "", firewallRuleFrom(v), nil))
+		}
+	}
+
+	return marshalJSON(m)
+}
+
+// The `firewallEntries` method layers the runtime rules over the firewall rules of `settings` and
+// returns the effective rules. Expired rules are skipped. The caller must hold `x.mu`.
+func (x *Bulk) firewallEntries(settings map[string]any) []FirewallRuleEntry {
+	now := time.Now()
+	entries := []FirewallRuleEntry{}
+	for _, direction := range []string{DirectionInbound, DirectionOutbound} {
+		// Rules from the config are kept as written, runtime rules are inserted between them
+		raw, _ := lookupPath(settings, "firewall."+direction)
+		effective, _ := raw.([]any)
+		effective = append([]any{}, effective...)
+
+		list := make([]FirewallRuleEntry, 0, len(effective))
+		for i, v := range effective {
+			list = append(list, newFirewallRuleEntry(fmt.Sprintf("%s:%s:%d", RuleSourceConfig, direction, i), direction, RuleSourceConfig, firewallRuleFrom(v), nil))
+		}
+
+		for _, r := range x.firewall.entries {
+			if r.direction != direction || (!r.expires.IsZero() && !now.Before(r.expires)) {
+				continue
+			}
+
+			var expires *time.Time
+			if !r.expires.IsZero() {
+				t := r.expires
+				expires = &t
+			}
+
+			e := newFirewallRuleEntry(r.id, direction, RuleSourceRuntime, r.rule, expires)
+			pos := r.position
+			if pos < 0 || pos > len(list) {
+				pos = len(list)
+			}
+			list = append(list[:pos], append([]FirewallRuleEntry{e}, list[pos:]...)...)
+			effective = append(effective[:pos], append([]any{firewallRuleSettings(e)}, effective[pos:]...)...)
+		}
+
+		for i := range list {
+			list[i].Position = i
+		}
+
+		if len(effective) > 0 {
+			setPath(settings, "firewall."+direction, effective)
+		}
+		entries = append(entries, list...)
+	}
+
+	return entries
+}
+
+// The function `newFirewallRuleEntry` creates the listing entry of a rule.
+func newFirewallRuleEntry(id, direction, source string, r firewallRule, expires *time.Time) FirewallRuleEntry {
+	return FirewallRuleEntry{
+		ID:        id,
+		Direction: direction,
+		Source:    source,
+		Port:      r.Port,
+		Proto:     r.Proto,
+		Point:     r.Point,
+		Groups:    r.Groups,
+		Expires:   expires,
+	}
+}
+
+// The function `firewallRuleSettings` returns a rule in the shape of the config.
+func firewallRuleSettings(e FirewallRuleEntry) map[string]any {
+	m := map[string]any{}
+	if e.Port != "" {
+		m["port"] = e.Port
+	}
+	if e.Proto != "" {
+		m["proto"] = e.Proto
+	}
+	if e.Point != "" {
+		m["point"] = e.Point
+	}
+	if len(e.Groups) > 0 {
+		groups := make([]any, len(e.Groups))
+		for i, g := range e.Groups {
+			groups[i] = g
+		}
+		m["groups"] = groups
+	}
+
+	return m
+}
+
+// The `stopRuntimeTimers` method stops the timers expiring runtime rules.
+func (x *Bulk) stopRuntimeTimers() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, r := range x.firewall.entries {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+	}
+}
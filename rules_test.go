@@ -0,0 +1,168 @@
+package mobile
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The function `TestFirewallRules` tests adding, listing, expiring and removing runtime firewall rules.
+func TestFirewallRules(t *testing.T) {
+	configData := "firewall:\n  inbound:\n    - port: 22\n      proto: tcp\n      groups: [admin]\n"
+	var up atomic.Bool
+	x := newReloadBulk(t, configData, &up)
+
+	for rule, want := range map[string]string{
+		`{"port": "70000", "proto": "tcp", "point": "any"}`:           "out of bounds",
+		`{"port": 80, "proto": "tcp", "piont": "any"}`:                "unknown key",
+		`{"port": 80, "proto": "tcp", "point": "any", "ttl": "1h"}`:   "ttl must be a number",
+		`{"port": 80, "proto": "tcp", "point": "any", "ttl": -1}`:     "ttl must be positive",
+		`{"port": 80, "proto": "tcp", "groups": [1], "point": "any"}`: "groups must be strings",
+	} {
+		if _, err := x.AddFirewallRule("inbound", rule, -1); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", rule, want, err)
+		}
+	}
+
+	if _, err := x.AddFirewallRule("outbound", `{"port": 53, "proto": "udp", "groups": ["admin"]}`, -1); err == nil || !strings.Contains(err.Error(), "not supported on outbound") {
+		t.Errorf("expected groups on an outbound rule to be rejected, got %v", err)
+	}
+
+	out, err := x.AddFirewallRule("inbound", `{"port": 8080, "proto": "tcp", "point": "laptop"}`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var added FirewallRuleEntry
+	if err := json.Unmarshal([]byte(out), &added); err != nil {
+		t.Fatal(err)
+	}
+
+	if added.Position != 0 || added.Source != RuleSourceRuntime || added.Port != "8080" {
+		t.Errorf("unexpected rule: %+v", added)
+	}
+
+	out, err = x.AddFirewallRule("inbound", `{"port": 9000, "proto": "udp", "point": "any", "ttl": 3600}`, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expiring FirewallRuleEntry
+	if err := json.Unmarshal([]byte(out), &expiring); err != nil {
+		t.Fatal(err)
+	}
+
+	if expiring.Expires == nil || expiring.Expires.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("expected the rule to expire in an hour, got %v", expiring.Expires)
+	}
+
+	exported, err := x.ExportFirewall()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fw struct{ Inbound []Inbound }
+	if err := json.Unmarshal([]byte(exported), &fw); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fw.Inbound) != 3 || fw.Inbound[0].Point != "laptop" || fw.Inbound[1].Port != "22" {
+		t.Errorf("unexpected effective rules: %+v", fw.Inbound)
+	}
+
+	if err := x.RemoveFirewallRule("config:inbound:0"); err == nil {
+		t.Error("expected removing a rule of the config to fail")
+	}
+
+	if err := x.RemoveFirewallRule(added.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	x.expireFirewallRule(expiring.ID)
+
+	list, err := x.ListFirewallRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []FirewallRuleEntry
+	if err := json.Unmarshal([]byte(list), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Source != RuleSourceConfig {
+		t.Errorf("expected only the rule of the config to be left, got %+v", entries)
+	}
+
+	if len(x.config.Get("firewall.inbound").([]any)) != 1 {
+		t.Errorf("expected the core to run only the rule of the config, got %v", x.config.Get("firewall.inbound"))
+	}
+}
+
+// The function `TestFirewallRulesRollback` tests that runtime rules go through the reload transaction:
+// a rule the core rejects is not kept, and a rule that loses every tower is rolled back with the
+// config once the grace period expires.
+func TestFirewallRulesRollback(t *testing.T) {
+	configData := "tower:\n  hosts: [\"10.1.0.1\"]\nfirewall:\n  inbound:\n    - port: 22\n      proto: tcp\n      groups: [admin]\n"
+	var up atomic.Bool
+	x := newReloadBulk(t, configData, &up)
+
+	if _, err := x.AddFirewallRule("inbound", `{"port": 80, "proto": "tcp", "point": "rejected_by_core"}`, -1); err == nil {
+		t.Error("expected the rule the core rejects to fail")
+	}
+	if len(x.firewall.entries) != 0 || x.lastReload.State != ReloadRolledBack {
+		t.Errorf("expected the rejected rule to be rolled back, got %d rules and %+v", len(x.firewall.entries), x.lastReload)
+	}
+
+	up.Store(true)
+	if _, err := x.AddFirewallRule("inbound", `{"port": 80, "proto": "tcp", "point": "any"}`, -1); err != nil {
+		t.Fatal(err)
+	}
+	up.Store(false)
+
+	x.mu.Lock()
+	r := *x.lastReload
+	x.mu.Unlock()
+	if r.State != ReloadVerifying {
+		t.Fatalf("expected the rule to be verified, got %+v", r)
+	}
+
+	if !x.checkReload(&r, time.Minute, r.Time.Add(2*time.Minute)) || r.State != ReloadRolledBack {
+		t.Fatalf("expected the rule to be rolled back, got %+v", r)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.firewall.entries) != 0 || len(x.config.Get("firewall.inbound").([]any)) != 1 {
+		t.Errorf("expected the runtime rule to be removed with the rollback, got %v", x.config.Get("firewall.inbound"))
+	}
+}
+
+// The function `TestExportFirewallDuringReload` tests that the firewall can be exported while the core
+// applies a reload, which the race detector checks.
+func TestExportFirewallDuringReload(t *testing.T) {
+	configData := "firewall:\n  inbound:\n    - port: 22\n      proto: tcp\n      groups: [admin]\n"
+	var up atomic.Bool
+	x := newReloadBulk(t, configData, &up)
+
+	apply := x.apply
+	x.apply = func(resolved string) error {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, err := x.ExportFirewall(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		err := apply(resolved)
+		<-done
+		return err
+	}
+
+	if r := x.reload(configData); r.State != ReloadCommitted {
+		t.Errorf("expected the reload to be committed, got %+v", r)
+	}
+}
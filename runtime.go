@@ -0,0 +1,160 @@
+package mobile
+
+import "errors"
+
+// The runtime state of a `Bulk`, such as firewall rules, unsafe routes and DNS records changed through
+// its methods, is layered over the applied config whenever it is handed to the core, so it survives
+// reloads without ever being written into the config.
+
+// The runtimeState type is a snapshot of the runtime state, taken when it is layered over a config so
+// that a rollback restores the runtime state of the last-known-good config along with it.
+type runtimeState struct {
+	firewall []*runtimeRule
+	routes   routeState
+	dns      dnsState
+}
+
+// The `changeRuntime` method applies a change to the runtime state as a reload transaction of the
+// applied config, so it is verified and rolled back like any reload. `change` runs with `x.mu` held and
+// is undone when it fails or the transaction is rejected; a rollback restores the runtime state of the
+// last-known-good config.
+func (x *Bulk) changeRuntime(change func() error) error {
+	x.reloadMu.Lock()
+
+	x.mu.Lock()
+	prev := x.runtimeSnapshot()
+	err := change()
+	if err != nil {
+		x.restoreRuntime(prev)
+	}
+	active := x.active
+	x.mu.Unlock()
+
+	if err != nil {
+		x.reloadMu.Unlock()
+		return err
+	}
+
+	r, verify := x.transact(active)
+	if r.State == ReloadRejected {
+		x.mu.Lock()
+		x.restoreRuntime(prev)
+		x.mu.Unlock()
+	}
+	x.reloadMu.Unlock()
+
+	x.reloaded(r, verify)
+	if r.rejected() {
+		return errors.New(r.Reason)
+	}
+
+	return nil
+}
+
+// The `activeConfig` method turns a config as written into the config handed to the core: references
+// are resolved and the runtime state is layered over it. It returns the runtime state it layered.
+// References are resolved through the app's resolver without holding `x.mu`, so the caller must not
+// hold it.
+func (x *Bulk) activeConfig(configData string) (string, runtimeState, error) {
+	resolved, err := resolveConfig(configData)
+	if err != nil {
+		return "", runtimeState{}, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	layered, err := x.layerRuntime(resolved)
+	return layered, x.runtimeSnapshot(), err
+}
+
+// The `runtimeSnapshot` method returns a copy of the runtime state. The caller must hold `x.mu`.
+func (x *Bulk) runtimeSnapshot() runtimeState {
+	return runtimeState{
+		firewall: append([]*runtimeRule(nil), x.firewall.entries...),
+		routes:   x.routes.clone(),
+		dns:      x.dns.clone(),
+	}
+}
+
+// The `restoreRuntime` method replaces the runtime state with a snapshot. Runtime rules that come back
+// have their expiry scheduled again and those that go away have it cancelled. The caller must hold
+// `x.mu`.
+func (x *Bulk) restoreRuntime(s runtimeState) {
+	for _, r := range x.firewall.entries {
+		if !containsRule(s.firewall, r) && r.timer != nil {
+			r.timer.Stop()
+		}
+	}
+
+	for _, r := range s.firewall {
+		if !containsRule(x.firewall.entries, r) {
+			x.scheduleExpiry(r)
+		}
+	}
+
+	x.firewall.entries = append([]*runtimeRule(nil), s.firewall...)
+	x.routes = s.routes.clone()
+	x.dns = s.dns.clone()
+}
+
+// The `layerRuntime` method layers the runtime state over a resolved config. The caller must hold
+// `x.mu`.
+func (x *Bulk) layerRuntime(resolved string) (string, error) {
+	if len(x.firewall.entries) == 0 && x.routes.empty() && x.dns.empty() {
+		return resolved, nil
+	}
+
+	settings, err := loadSettings(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	x.firewallEntries(settings)
+	x.routeEntries(settings)
+	x.dnsRecords(settings)
+	return marshalJSON(settings)
+}
+
+// The `applyConfig` method hands a resolved config to the core, which runs its reload callbacks.
+func (x *Bulk) applyConfig(resolved string) error {
+	if x.apply != nil {
+		return x.apply(resolved)
+	}
+
+	return x.config.ReloadConfigString(resolved)
+}
+
+// The `setActive` method records the config handed to the core, the runtime state layered over it and
+// the resolved config it turned into. The caller must hold `x.reloadMu`.
+func (x *Bulk) setActive(configData string, resolved string, state runtimeState) {
+	applied, _ := loadSettings(resolved)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.active = configData
+	x.activeRuntime = state
+	x.applied = applied
+}
+
+// The `appliedSettings` method returns a copy of the settings handed to the core, resolved and with
+// the runtime state layered, or those of the active config before the first transaction. The caller
+// must hold `x.mu`.
+func (x *Bulk) appliedSettings() map[string]any {
+	if x.applied == nil {
+		return x.activeSettings()
+	}
+
+	settings, _ := normalizeValue(x.applied).(map[string]any)
+	return settings
+}
+
+// The `activeSettings` method returns the settings of the applied config as written, without the
+// runtime state. The caller must hold `x.mu`.
+func (x *Bulk) activeSettings() map[string]any {
+	settings, err := loadSettings(x.active)
+	if err != nil {
+		return map[string]any{}
+	}
+
+	return settings
+}
@@ -0,0 +1,231 @@
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The ConfigValue type describes the result of looking up a single path in a configuration.
+// @property {string} Path - The dotted path that was looked up, for example `tun.routes` or
+// `proxy.socks5.0.password`.
+// @property {bool} Exists - Whether the path is present in the configuration data itself.
+// @property Value - The value at the path with its original type preserved. When the path is missing
+// this holds the default that applied, if any.
+// @property {bool} DefaultApplied - Whether `Value` came from a default rather than the configuration.
+// @property {string} DefaultSource - Where the applied default came from: "caller" for a default
+// supplied by the caller, "builtin" for the package defaults, or empty when no default applied.
+type ConfigValue struct {
+	Path           string
+	Exists         bool
+	Value          any
+	DefaultApplied bool
+	DefaultSource  string
+}
+
+// The function `GetConfigValue` retrieves the value at `path` from the configuration data and returns
+// it as JSON, so lists and maps such as `points` or `firewall.inbound` keep their structure. If the
+// path is not set the builtin default is returned, or `null` when there is none.
+func GetConfigValue(configData string, path string) (string, error) {
+	v, err := lookupConfigValue(configData, path, nil, false)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(v.Value)
+}
+
+// The function `LookupConfigValue` retrieves the value at `path` from the configuration data and
+// returns a JSON encoded `ConfigValue` that reports whether the key exists and whether a builtin
+// default applied.
+func LookupConfigValue(configData string, path string) (string, error) {
+	v, err := lookupConfigValue(configData, path, nil, false)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(v)
+}
+
+// The function `LookupConfigValueWithDefault` behaves like `LookupConfigValue`, but applies the JSON
+// encoded `defaultJSON` instead of the builtin default when the path is not set.
+func LookupConfigValueWithDefault(configData string, path string, defaultJSON string) (string, error) {
+	var def any
+	if err := json.Unmarshal([]byte(defaultJSON), &def); err != nil {
+		return "", fmt.Errorf("invalid default value: %s", err)
+	}
+
+	v, err := lookupConfigValue(configData, path, def, true)
+	if err != nil {
+		return "", err
+	}
+
+	return marshalJSON(v)
+}
+
+// The function `lookupConfigValue` is the shared implementation behind the `GetConfigValue` family.
+func lookupConfigValue(configData string, path string, def any, hasDef bool) (*ConfigValue, error) {
+	settings, err := loadSettings(configData)
+	if err != nil {
+		return nil, err
+	}
+
+	cv := &ConfigValue{Path: path}
+	if v, ok := lookupPath(settings, path); ok {
+		cv.Exists = true
+		cv.Value = v
+		return cv, nil
+	}
+
+	if hasDef {
+		cv.Value = def
+		cv.DefaultApplied = true
+		cv.DefaultSource = "caller"
+		return cv, nil
+	}
+
+	if v, ok := lookupPath(builtinSettings(), path); ok {
+		cv.Value = v
+		cv.DefaultApplied = true
+		cv.DefaultSource = "builtin"
+	}
+
+	return cv, nil
+}
+
+// The function `loadSettings` loads the configuration data through `loadQuietConfig` and returns its
+// settings as a tree of JSON compatible values.
+func loadSettings(configData string) (map[string]any, error) {
+	c, err := loadQuietConfig(configData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %s", err)
+	}
+
+	m, _ := normalizeValue(c.Settings).(map[string]any)
+	if m == nil {
+		m = map[string]any{}
+	}
+
+	return m, nil
+}
+
+// The function `builtinSettings` returns the package defaults from `newConfig` as a settings tree.
+func builtinSettings() map[string]any {
+	b, err := json.Marshal(newConfig())
+	if err != nil {
+		return map[string]any{}
+	}
+
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return map[string]any{}
+	}
+
+	return m
+}
+
+// The function `normalizeValue` converts the `map[interface{}]interface{}` values produced by the YAML
+// decoder into `map[string]any` so the value can be encoded as JSON.
+func normalizeValue(v any) any {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]any, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = normalizeValue(val)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(t))
+		for k, val := range t {
+			m[k] = normalizeValue(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]any, len(t))
+		for i, val := range t {
+			l[i] = normalizeValue(val)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+// The function `splitPath` splits a dotted path into its segments. List indexes may be written either
+// as `proxy.socks5.0` or `proxy.socks5[0]`.
+func splitPath(path string) []string {
+	path = strings.ReplaceAll(path, "[", ".")
+	path = strings.ReplaceAll(path, "]", "")
+
+	var parts []string
+	for _, p := range strings.Split(path, ".") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	return parts
+}
+
+// The function `lookupPath` walks a settings tree along a dotted path and returns the value found.
+func lookupPath(settings any, path string) (any, bool) {
+	v := settings
+	for _, p := range splitPath(path) {
+		switch t := v.(type) {
+		case map[string]any:
+			next, ok := t[p]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// The function `marshalJSON` encodes a value as a JSON string.
+func marshalJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// The function `mergeSettings` deep merges `overlay` into `base` and returns the result. Maps are
+// merged key by key, every other value in `overlay` replaces the one in `base`.
+func mergeSettings(base any, overlay any) any {
+	return (&overlayMerger{}).merge(base, overlay, nil)
+}
+
+// The function `setPath` sets the value at a dotted path in a settings tree, creating missing maps on
+// the way. Existing values that are not maps are replaced.
+func setPath(settings map[string]any, path string, v any) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return
+	}
+
+	m := settings
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := m[p].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			m[p] = next
+		}
+		m = next
+	}
+
+	m[parts[len(parts)-1]] = v
+}
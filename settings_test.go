@@ -0,0 +1,109 @@
+package mobile
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// The function `TestConfigValue` tests `GetConfigValue`, `LookupConfigValue` and
+// `LookupConfigValueWithDefault` for present paths, missing paths, builtin defaults and caller
+// defaults.
+func TestConfigValue(t *testing.T) {
+	configData := "tun:\n  dev: vlan0\n  routes:\n    - route: 10.2.0.0/16\n      via: 10.1.0.1\nproxy:\n  socks5:\n    - addr: 127.0.0.1:1080\n      password: pw\n"
+
+	tests := []struct {
+		name      string
+		path      string
+		defaultJS string
+		get       string
+		want      ConfigValue
+	}{
+		{
+			name: "present",
+			path: "tun.dev",
+			get:  `"vlan0"`,
+			want: ConfigValue{Path: "tun.dev", Exists: true, Value: "vlan0"},
+		},
+		{
+			name: "present list index",
+			path: "proxy.socks5[0].password",
+			get:  `"pw"`,
+			want: ConfigValue{Path: "proxy.socks5[0].password", Exists: true, Value: "pw"},
+		},
+		{
+			name: "present list",
+			path: "tun.routes",
+			get:  `[{"route":"10.2.0.0/16","via":"10.1.0.1"}]`,
+			want: ConfigValue{Path: "tun.routes", Exists: true, Value: []any{map[string]any{"route": "10.2.0.0/16", "via": "10.1.0.1"}}},
+		},
+		{
+			name: "missing",
+			path: "tun.nothing",
+			get:  `null`,
+			want: ConfigValue{Path: "tun.nothing"},
+		},
+		{
+			name: "builtin default",
+			path: "tun.mtu",
+			get:  `1300`,
+			want: ConfigValue{Path: "tun.mtu", Value: float64(1300), DefaultApplied: true, DefaultSource: "builtin"},
+		},
+		{
+			name: "no builtin config version",
+			path: "config_version",
+			get:  `null`,
+			want: ConfigValue{Path: "config_version"},
+		},
+		{
+			name:      "caller default",
+			path:      "tun.mtu",
+			defaultJS: `1400`,
+			want:      ConfigValue{Path: "tun.mtu", Value: float64(1400), DefaultApplied: true, DefaultSource: "caller"},
+		},
+		{
+			name:      "caller default ignored when present",
+			path:      "tun.dev",
+			defaultJS: `"other"`,
+			want:      ConfigValue{Path: "tun.dev", Exists: true, Value: "vlan0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var js string
+			var err error
+			if tt.defaultJS != "" {
+				js, err = LookupConfigValueWithDefault(configData, tt.path, tt.defaultJS)
+			} else {
+				js, err = LookupConfigValue(configData, tt.path)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got ConfigValue
+			if err := json.Unmarshal([]byte(js), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+
+			if tt.get == "" {
+				return
+			}
+			v, err := GetConfigValue(configData, tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tt.get {
+				t.Errorf("GetConfigValue: expected %s, got %s", tt.get, v)
+			}
+		})
+	}
+
+	if _, err := LookupConfigValueWithDefault(configData, "tun.mtu", "{"); err == nil {
+		t.Error("expected an invalid caller default to be rejected")
+	}
+}
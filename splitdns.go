@@ -0,0 +1,823 @@
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "git.weixin.qq.com/__/vlan/lib/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The keyword of `tower.dns.upstreams` servers that stands for the DNS services of the towers.
+const DNSServerTower = "tower"
+
+const (
+	defaultDNSTimeout  = 2 * time.Second
+	dnsLocalRefresh    = 5 * time.Second
+	dnsCacheSize       = 1024
+	maxDNSCacheTTL     = time.Hour
+	defaultNegativeTTL = 30 * time.Second
+	maxNegativeTTL     = 5 * time.Minute
+	maxCNAMEHops       = 8
+)
+
+// The DNSUpstreamStats type counts the queries forwarded to one DNS server.
+// @property {string} Server - The server as IP:port.
+// @property {int64} Queries - The queries forwarded to the server.
+// @property {int64} Failures - The queries the server did not answer in time.
+type DNSUpstreamStats struct {
+	Server   string
+	Queries  int64
+	Failures int64
+}
+
+// The DNSStats type is the result of `SplitDNSStats`.
+// @property {int64} Queries - Every query received.
+// @property {int64} LocalAnswers - The queries answered from the records of `ListDNSRecords`.
+// @property {int64} CacheHits - The queries answered from the cache.
+// @property {int64} CacheMisses - The queries forwarded to an upstream.
+// @property {int64} NegativeAnswers - The upstream answers that the name or type does not exist.
+// @property {int64} Refused - The queries no upstream was configured for.
+// @property {int64} Failures - The queries no upstream answered.
+// @property {int} CacheEntries - The answers held by the cache.
+// @property {[]DNSUpstreamStats} Upstreams - The counters of every upstream, sorted by server.
+type DNSStats struct {
+	Queries         int64
+	LocalAnswers    int64
+	CacheHits       int64
+	CacheMisses     int64
+	NegativeAnswers int64
+	Refused         int64
+	Failures        int64
+	CacheEntries    int
+	Upstreams       []DNSUpstreamStats
+}
+
+// The dnsRule type routes the names below `domain` to `servers`.
+type dnsRule struct {
+	domain  string
+	servers []string
+}
+
+// The dnsCacheKey type identifies a question in the cache.
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// The dnsCacheEntry type is an upstream answer held by the cache.
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// The dnsResolver type is the split DNS resolver of the app. It answers the names of `ListDNSRecords`
+// itself, forwards the names of `tower.dns.upstreams` to their servers, everything else to
+// `tower.dns.mirror`, and refuses the rest so the platform falls back to its own resolver. It has its
+// own lock as the reload callback runs while `Bulk.reloadMu` is held.
+// @property records - Returns the records to answer locally. It takes `Bulk.mu`.
+// @property local - The records last returned by `records`, refreshed every few seconds.
+// @property registered - Whether the reload callback that reconfigures the resolver is registered.
+type dnsResolver struct {
+	mu         sync.Mutex
+	records    func() []DNSRecord
+	timeout    time.Duration
+	zone       string
+	rules      []dnsRule
+	fallback   []string
+	local      []DNSRecord
+	localAt    time.Time
+	cache      map[dnsCacheKey]*dnsCacheEntry
+	stats      DNSStats
+	upstreams  map[string]*DNSUpstreamStats
+	conn       net.PacketConn
+	registered bool
+}
+
+// The `StartSplitDNS` method starts the split DNS resolver on the UDP address `listenAddr`, such as
+// "127.0.0.1:0", and returns the address it listens on. Reloads reconfigure it; upstream answers are
+// cached honouring their TTLs, answers that a name does not exist included. `PlatformNetworkSettings`
+// hands the address to the platform as its DNS server.
+func (x *Bulk) StartSplitDNS(listenAddr string) (string, error) {
+	// Holding reloadMu keeps reloads from changing the config until the callback is registered
+	x.reloadMu.Lock()
+	defer x.reloadMu.Unlock()
+
+	r := &x.resolver
+	if r.listenAddr().IsValid() {
+		return "", errors.New("split DNS is already running")
+	}
+
+	x.mu.Lock()
+	settings := x.appliedSettings()
+	x.mu.Unlock()
+
+	zone, rules, fallback, err := splitDNSSettings(settings)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to listen for DNS queries: %s", err)
+	}
+
+	r.mu.Lock()
+	r.setUpstreams(zone, rules, fallback)
+	r.conn = conn
+	r.records = x.localDNSRecords
+	register := !r.registered
+	r.registered = true
+	r.mu.Unlock()
+
+	// The callback takes r.mu, so it is registered without holding it
+	if register {
+		x.config.RegisterReloadCallback(x.reconfigureSplitDNS)
+	}
+
+	go r.serve(conn)
+	x.l.Info("Split DNS listening on %s", conn.LocalAddr())
+	return conn.LocalAddr().String(), nil
+}
+
+// The `listenAddr` method returns the address the resolver listens on, invalid unless it runs.
+func (r *dnsResolver) listenAddr() netip.AddrPort {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return netip.AddrPort{}
+	}
+
+	addr, _ := netip.ParseAddrPort(r.conn.LocalAddr().String())
+	return addr
+}
+
+// The `StopSplitDNS` method stops the split DNS resolver.
+func (x *Bulk) StopSplitDNS() {
+	r := &x.resolver
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// The `SplitDNSStats` method returns the JSON encoded `DNSStats` of the split DNS resolver.
+func (x *Bulk) SplitDNSStats() (string, error) {
+	return marshalJSON(x.resolver.snapshot())
+}
+
+// The `FlushDNSCache` method drops every answer cached by the split DNS resolver.
+func (x *Bulk) FlushDNSCache() {
+	r := &x.resolver
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = nil
+}
+
+// The `localDNSRecords` method returns the records the split DNS resolver answers itself.
+func (x *Bulk) localDNSRecords() []DNSRecord {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.allDNSRecords()
+}
+
+// The `reconfigureSplitDNS` method is the reload callback of the split DNS resolver. An invalid
+// config keeps the previous upstreams.
+func (x *Bulk) reconfigureSplitDNS(c *cfg.C) {
+	settings, _ := normalizeValue(c.Settings).(map[string]any)
+	if err := x.resolver.configure(settings); err != nil {
+		x.l.Warn("Split DNS keeps its previous upstreams: %s", err)
+	}
+}
+
+// The `configure` method takes the zone and upstreams from `settings`. The cache is flushed when the
+// upstreams change, and the local records are refreshed on the next query.
+func (r *dnsResolver) configure(settings map[string]any) error {
+	zone, rules, fallback, err := splitDNSSettings(settings)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setUpstreams(zone, rules, fallback)
+	return nil
+}
+
+// The `setUpstreams` method replaces the zone and upstreams, flushing the cache when the upstreams
+// change. The caller must hold `r.mu`.
+func (r *dnsResolver) setUpstreams(zone string, rules []dnsRule, fallback []string) {
+	if !reflect.DeepEqual(rules, r.rules) || !reflect.DeepEqual(fallback, r.fallback) {
+		r.cache = nil
+	}
+
+	r.zone, r.rules, r.fallback = zone, rules, fallback
+	r.localAt = time.Time{}
+}
+
+// The `serve` method answers the queries received on `conn` until it is closed.
+func (r *dnsResolver) serve(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if resp := r.handle(query); resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+// The `handle` method answers a packed query. It returns nil for packets that are not queries.
+func (r *dnsResolver) handle(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	r.count(func(s *DNSStats) { s.Queries++ })
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+
+	if resp, ok := r.answerLocal(h, q, name); ok {
+		r.count(func(s *DNSStats) { s.LocalAnswers++ })
+		return resp
+	}
+
+	key := dnsCacheKey{name: name, qtype: q.Type, class: q.Class}
+	if resp, ok := r.cached(key, h, q); ok {
+		r.count(func(s *DNSStats) { s.CacheHits++ })
+		return resp
+	}
+
+	servers := r.upstreamsFor(name)
+	if len(servers) == 0 {
+		r.count(func(s *DNSStats) { s.Refused++ })
+		return dnsReply(h, q, dnsmessage.RCodeRefused, false, nil)
+	}
+
+	r.count(func(s *DNSStats) { s.CacheMisses++ })
+	for _, server := range servers {
+		resp, msg, err := r.exchange(server, query, h.ID)
+		r.countUpstream(server, err != nil)
+		if err != nil {
+			continue
+		}
+
+		if r.store(key, msg) {
+			r.count(func(s *DNSStats) { s.NegativeAnswers++ })
+		}
+		return resp
+	}
+
+	r.count(func(s *DNSStats) { s.Failures++ })
+	return dnsReply(h, q, dnsmessage.RCodeServerFailure, false, nil)
+}
+
+// The `answerLocal` method answers a query from the local records. Names inside the zone without a
+// record do not exist; other names without a record are left to the upstreams.
+func (r *dnsResolver) answerLocal(h dnsmessage.Header, q dnsmessage.Question, name string) ([]byte, bool) {
+	if q.Class != dnsmessage.ClassINET {
+		return nil, false
+	}
+
+	records := r.localRecords()
+	r.mu.Lock()
+	zone := r.zone
+	r.mu.Unlock()
+
+	var answers []dnsmessage.Resource
+	found := false
+	owner, target := q.Name, name
+	for hops := 0; hops < maxCNAMEHops; hops++ {
+		var matched []DNSRecord
+		var cname *DNSRecord
+		for i, rec := range records {
+			if rec.Name != target {
+				continue
+			}
+			matched = append(matched, rec)
+			if rec.Type == DNSTypeCNAME {
+				cname = &records[i]
+			}
+		}
+
+		if len(matched) == 0 {
+			break
+		}
+		found = true
+
+		if cname != nil && q.Type != dnsmessage.TypeCNAME {
+			rr, ok := dnsResource(owner, *cname)
+			if !ok {
+				break
+			}
+			answers = append(answers, rr)
+			owner, target = rr.Body.(*dnsmessage.CNAMEResource).CNAME, cname.Value
+			continue
+		}
+
+		for _, rec := range matched {
+			if dnsRecordType(rec.Type) != q.Type {
+				continue
+			}
+			if rr, ok := dnsResource(owner, rec); ok {
+				answers = append(answers, rr)
+			}
+		}
+		break
+	}
+
+	if !found {
+		if zone == "" || (name != zone && !strings.HasSuffix(name, "."+zone)) {
+			return nil, false
+		}
+		return dnsReply(h, q, dnsmessage.RCodeNameError, true, nil), true
+	}
+
+	return dnsReply(h, q, dnsmessage.RCodeSuccess, true, answers), true
+}
+
+// The `localRecords` method returns the local records, refreshing them when they are older than a few
+// seconds. `records` is called without `r.mu`, which it must not be held for.
+func (r *dnsResolver) localRecords() []DNSRecord {
+	r.mu.Lock()
+	if r.records == nil || time.Since(r.localAt) < dnsLocalRefresh {
+		defer r.mu.Unlock()
+		return r.local
+	}
+	fetch := r.records
+	r.mu.Unlock()
+
+	records := fetch()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.local, r.localAt = records, time.Now()
+	return records
+}
+
+// The `upstreamsFor` method returns the servers for a name: those of the most specific upstream
+// domain, else the mirror.
+func (r *dnsResolver) upstreamsFor(name string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rule := range r.rules {
+		if name == rule.domain || strings.HasSuffix(name, "."+rule.domain) {
+			return rule.servers
+		}
+	}
+
+	return r.fallback
+}
+
+// The `exchange` method forwards a packed query to a server and returns its packed and parsed answer.
+func (r *dnsResolver) exchange(server string, query []byte, id uint16) ([]byte, *dnsmessage.Message, error) {
+	timeout := r.timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || msg.Header.ID != id || !msg.Header.Response {
+			continue
+		}
+
+		return buf[:n], &msg, nil
+	}
+}
+
+// The `cached` method answers a query from the cache, with the TTLs lowered by the time the answer
+// was held.
+func (r *dnsResolver) cached(key dnsCacheKey, h dnsmessage.Header, q dnsmessage.Question) ([]byte, bool) {
+	r.mu.Lock()
+	e, ok := r.cache[key]
+	now := time.Now()
+	if ok && !now.Before(e.expires) {
+		delete(r.cache, key)
+		ok = false
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	msg := e.msg
+	msg.Header.ID = h.ID
+	msg.Header.RecursionDesired = h.RecursionDesired
+	msg.Questions = []dnsmessage.Question{q}
+	msg.Answers = agedResources(msg.Answers, elapsed)
+	msg.Authorities = agedResources(msg.Authorities, elapsed)
+	msg.Additionals = agedResources(msg.Additionals, elapsed)
+
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// The `store` method caches an upstream answer for its TTL and reports whether it is negative: the
+// name or type does not exist. Negative answers are held for the SOA minimum, truncated and failed
+// answers are not cached.
+func (r *dnsResolver) store(key dnsCacheKey, msg *dnsmessage.Message) bool {
+	negative := msg.Header.RCode == dnsmessage.RCodeNameError ||
+		(msg.Header.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) == 0)
+	if msg.Header.Truncated || (msg.Header.RCode != dnsmessage.RCodeSuccess && !negative) {
+		return false
+	}
+
+	ttl := maxDNSCacheTTL
+	if negative {
+		ttl = negativeTTL(msg)
+	}
+	for _, rr := range msg.Answers {
+		if d := time.Duration(rr.Header.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+
+	if ttl <= 0 {
+		return negative
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cache == nil {
+		r.cache = map[dnsCacheKey]*dnsCacheEntry{}
+	}
+	if len(r.cache) >= dnsCacheSize {
+		r.evict(now)
+	}
+	r.cache[key] = &dnsCacheEntry{msg: *msg, stored: now, expires: now.Add(ttl)}
+
+	return negative
+}
+
+// The `evict` method makes room in the cache: expired answers go first, then the answer expiring
+// soonest. The caller must hold `r.mu`.
+func (r *dnsResolver) evict(now time.Time) {
+	var soonest *dnsCacheKey
+	for k, e := range r.cache {
+		if !now.Before(e.expires) {
+			delete(r.cache, k)
+			continue
+		}
+		if soonest == nil || e.expires.Before(r.cache[*soonest].expires) {
+			key := k
+			soonest = &key
+		}
+	}
+
+	if len(r.cache) >= dnsCacheSize && soonest != nil {
+		delete(r.cache, *soonest)
+	}
+}
+
+// The `count` method updates the counters.
+func (r *dnsResolver) count(fn func(s *DNSStats)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.stats)
+}
+
+// The `countUpstream` method counts a query forwarded to a server.
+func (r *dnsResolver) countUpstream(server string, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.upstreams == nil {
+		r.upstreams = map[string]*DNSUpstreamStats{}
+	}
+	s := r.upstreams[server]
+	if s == nil {
+		s = &DNSUpstreamStats{Server: server}
+		r.upstreams[server] = s
+	}
+
+	s.Queries++
+	if failed {
+		s.Failures++
+	}
+}
+
+// The `snapshot` method returns a copy of the counters.
+func (r *dnsResolver) snapshot() DNSStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.stats
+	s.CacheEntries = len(r.cache)
+	s.Upstreams = make([]DNSUpstreamStats, 0, len(r.upstreams))
+	for _, u := range r.upstreams {
+		s.Upstreams = append(s.Upstreams, *u)
+	}
+	sort.Slice(s.Upstreams, func(i, j int) bool { return s.Upstreams[i].Server < s.Upstreams[j].Server })
+
+	return s
+}
+
+// The function `splitDNSSettings` reads the zone, the upstream rules, sorted most specific first, and
+// the mirror from `settings`.
+func splitDNSSettings(settings map[string]any) (string, []dnsRule, []string, error) {
+	var zone string
+	if v, _ := lookupPath(settings, "tower.dns.zone"); v != nil && fmt.Sprint(v) != "" {
+		z, err := dnsName(fmt.Sprint(v))
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("invalid tower.dns.zone: %s", err)
+		}
+		zone = z
+	}
+
+	// The towers answer on the port their DNS service listens on
+	port := 53
+	if v, _ := lookupPath(settings, "tower.dns.port"); v != nil {
+		n, ok := v.(int)
+		if !ok || n <= 0 || n > 65535 {
+			return "", nil, nil, fmt.Errorf("invalid tower.dns.port %v", v)
+		}
+		port = n
+	}
+
+	var towers []string
+	seen := map[string]bool{}
+	hosts, _ := lookupPath(settings, "tower.hosts")
+	list, _ := hosts.([]any)
+	for _, h := range list {
+		ip, err := netip.ParseAddr(fmt.Sprint(h))
+		if err != nil {
+			continue
+		}
+		tower := netip.AddrPortFrom(ip.Unmap(), uint16(port)).String()
+		if !seen[tower] {
+			seen[tower] = true
+			towers = append(towers, tower)
+		}
+	}
+	sort.Strings(towers)
+
+	var rules []dnsRule
+	raw, _ := lookupPath(settings, "tower.dns.upstreams")
+	list, _ = raw.([]any)
+	for i, v := range list {
+		m, _ := v.(map[string]any)
+		domains, _ := m["domains"].([]any)
+		entries, _ := m["servers"].([]any)
+
+		var servers []string
+		for _, s := range entries {
+			expanded, err := dnsServers(fmt.Sprint(s), towers)
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("tower.dns.upstreams.%d: %s", i, err)
+			}
+			servers = append(servers, expanded...)
+		}
+		if len(servers) == 0 {
+			return "", nil, nil, fmt.Errorf("tower.dns.upstreams.%d: no servers", i)
+		}
+
+		for _, d := range domains {
+			domain, err := dnsName(fmt.Sprint(d))
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("tower.dns.upstreams.%d: %s", i, err)
+			}
+			rules = append(rules, dnsRule{domain: domain, servers: servers})
+		}
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].domain) > len(rules[j].domain) })
+
+	var fallback []string
+	if v, _ := lookupPath(settings, "tower.dns.mirror"); v != nil && fmt.Sprint(v) != "" {
+		servers, err := dnsServers(fmt.Sprint(v), towers)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("invalid tower.dns.mirror: %s", err)
+		}
+		fallback = servers
+	}
+
+	return zone, rules, fallback, nil
+}
+
+// The function `splitDNSDomains` returns the domains the split DNS resolver answers or forwards
+// itself: the zone and the domains of `tower.dns.upstreams`.
+func splitDNSDomains(settings map[string]any) []string {
+	seen := map[string]bool{}
+	if v, _ := lookupPath(settings, "tower.dns.zone"); v != nil {
+		if zone, err := dnsName(fmt.Sprint(v)); err == nil {
+			seen[zone] = true
+		}
+	}
+
+	raw, _ := lookupPath(settings, "tower.dns.upstreams")
+	list, _ := raw.([]any)
+	for _, v := range list {
+		m, _ := v.(map[string]any)
+		domains, _ := m["domains"].([]any)
+		for _, d := range domains {
+			if domain, err := dnsName(fmt.Sprint(d)); err == nil {
+				seen[domain] = true
+			}
+		}
+	}
+
+	domains := make([]string, 0, len(seen))
+	for d := range seen {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	return domains
+}
+
+// The function `dnsServers` turns a server of the config into IP:port addresses, port 53 unless one
+// is given. "tower" stands for `towers`.
+func dnsServers(server string, towers []string) ([]string, error) {
+	server = strings.TrimSpace(server)
+	if server == DNSServerTower {
+		if len(towers) == 0 {
+			return nil, errors.New("server tower used but no tower is configured in tower.hosts")
+		}
+		return towers, nil
+	}
+
+	if ap, err := netip.ParseAddrPort(server); err == nil {
+		return []string{netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String()}, nil
+	}
+
+	ip, err := netip.ParseAddr(strings.Trim(server, "[]"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server %q, expected an IP, IP:port or tower", server)
+	}
+
+	return []string{netip.AddrPortFrom(ip.Unmap(), 53).String()}, nil
+}
+
+// The function `negativeTTL` returns how long a negative answer is cached: the smaller of the TTL and
+// the minimum of its SOA record, or 30 seconds without one.
+func negativeTTL(msg *dnsmessage.Message) time.Duration {
+	for _, rr := range msg.Authorities {
+		soa, ok := rr.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+
+		ttl := rr.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		if d := time.Duration(ttl) * time.Second; d < maxNegativeTTL {
+			return d
+		}
+		return maxNegativeTTL
+	}
+
+	return defaultNegativeTTL
+}
+
+// The function `agedResources` returns a copy of `rrs` with the TTLs lowered by `elapsed` seconds. The
+// OPT pseudo record carries no TTL and is left alone.
+func agedResources(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	out := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			if rr.Header.TTL > elapsed {
+				rr.Header.TTL -= elapsed
+			} else {
+				rr.Header.TTL = 0
+			}
+		}
+		out[i] = rr
+	}
+
+	return out
+}
+
+// The function `dnsReply` packs an answer to the question `q` of a query.
+func dnsReply(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, authoritative bool, answers []dnsmessage.Resource) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			Authoritative:      authoritative,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{q},
+		Answers:   answers,
+	}
+
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// The function `dnsResource` returns a record as a resource owned by `owner`, false if its value does
+// not fit its type.
+func dnsResource(owner dnsmessage.Name, rec DNSRecord) (dnsmessage.Resource, bool) {
+	rr := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: owner, Class: dnsmessage.ClassINET, TTL: uint32(rec.TTL)},
+	}
+
+	switch rec.Type {
+	case DNSTypeA, DNSTypeAAAA:
+		ip, err := netip.ParseAddr(rec.Value)
+		if err != nil {
+			return rr, false
+		}
+		if rec.Type == DNSTypeA {
+			if !ip.Unmap().Is4() {
+				return rr, false
+			}
+			rr.Body = &dnsmessage.AResource{A: ip.Unmap().As4()}
+		} else {
+			rr.Body = &dnsmessage.AAAAResource{AAAA: ip.As16()}
+		}
+	case DNSTypeCNAME:
+		target, err := dnsmessage.NewName(rec.Value + ".")
+		if err != nil {
+			return rr, false
+		}
+		rr.Body = &dnsmessage.CNAMEResource{CNAME: target}
+	case DNSTypeTXT:
+		// A TXT string holds at most 255 bytes
+		var txt []string
+		for s := rec.Value; s != ""; {
+			n := len(s)
+			if n > 255 {
+				n = 255
+			}
+			txt, s = append(txt, s[:n]), s[n:]
+		}
+		rr.Body = &dnsmessage.TXTResource{TXT: txt}
+	default:
+		return rr, false
+	}
+
+	return rr, true
+}
+
+// The function `dnsRecordType` returns the wire type of a record type.
+func dnsRecordType(recordType string) dnsmessage.Type {
+	switch recordType {
+	case DNSTypeA:
+		return dnsmessage.TypeA
+	case DNSTypeAAAA:
+		return dnsmessage.TypeAAAA
+	case DNSTypeCNAME:
+		return dnsmessage.TypeCNAME
+	case DNSTypeTXT:
+		return dnsmessage.TypeTXT
+	default:
+		return 0
+	}
+}
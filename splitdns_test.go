@@ -0,0 +1,236 @@
+package mobile
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfg "git.weixin.qq.com/__/vlan/lib/config"
+	"git.weixin.qq.com/__/vlan/lib/utils/logs/logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The function `fakeDNSServer` starts a DNS server on a local UDP port that answers "www.corp.example"
+// with an A record and every other name with NXDOMAIN. It returns the address and the number of
+// queries it received.
+func fakeDNSServer(t *testing.T) (string, *int64) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var queries int64
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&queries, 1)
+
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+
+			q := query.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true, RecursionAvailable: true},
+				Questions: query.Questions,
+			}
+			if q.Name.String() == "www.corp.example." && q.Type == dnsmessage.TypeA {
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{10, 2, 0, 5}},
+				}}
+			} else {
+				resp.Header.RCode = dnsmessage.RCodeNameError
+				resp.Authorities = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("corp.example."), Class: dnsmessage.ClassINET, TTL: 3600},
+					Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.corp.example."), MBox: dnsmessage.MustNewName("admin.corp.example."), MinTTL: 10},
+				}}
+			}
+
+			b, _ := resp.Pack()
+			_, _ = conn.WriteTo(b, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), &queries
+}
+
+// The function `dnsQuery` packs a query for `name`.
+func dnsQuery(id uint16, name string, qtype dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	b, _ := msg.Pack()
+	return b
+}
+
+// The function `TestSplitDNS` tests local answers, per-domain forwarding, caching and stats of the split
+// DNS resolver against a fake upstream.
+func TestSplitDNS(t *testing.T) {
+	upstream, upstreamQueries := fakeDNSServer(t)
+
+	configData := "tower:\n  dns:\n    zone: vlan\n    records:\n      files.vlan: 10.1.0.20\n    upstreams:\n      - domains: [corp.example]\n        servers: [\"" + upstream + "\"]\n"
+
+	l := logger.New(1000)
+	l.SetOutput(io.Discard)
+	c := cfg.NewC(l)
+	if err := c.LoadString(configData); err != nil {
+		t.Fatal(err)
+	}
+	x := &Bulk{l: l, config: c, lastGood: configData, active: configData}
+
+	addr, err := x.StartSplitDNS("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.StopSplitDNS()
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ask := func(id uint16, name string, qtype dnsmessage.Type) dnsmessage.Message {
+		t.Helper()
+		if _, err := client.Write(dnsQuery(id, name, qtype)); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.ID != id {
+			t.Fatalf("expected answer %d, got %d", id, msg.Header.ID)
+		}
+		return msg
+	}
+
+	msg := ask(1, "Files.VLAN.", dnsmessage.TypeA)
+	if len(msg.Answers) != 1 || msg.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{10, 1, 0, 20} {
+		t.Errorf("expected the local record, got %+v", msg)
+	}
+
+	if msg := ask(2, "nobody.vlan.", dnsmessage.TypeA); msg.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("expected NXDOMAIN inside the zone, got %v", msg.Header.RCode)
+	}
+
+	for id := uint16(3); id < 5; id++ {
+		msg := ask(id, "www.corp.example.", dnsmessage.TypeA)
+		if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL > 60 {
+			t.Errorf("expected the upstream answer, got %+v", msg)
+		}
+	}
+
+	for id := uint16(5); id < 7; id++ {
+		if msg := ask(id, "gone.corp.example.", dnsmessage.TypeA); msg.Header.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("expected the upstream NXDOMAIN, got %v", msg.Header.RCode)
+		}
+	}
+
+	if n := atomic.LoadInt64(upstreamQueries); n != 2 {
+		t.Errorf("expected repeated questions to be answered from the cache, the upstream got %d queries", n)
+	}
+
+	if msg := ask(7, "example.org.", dnsmessage.TypeA); msg.Header.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("expected names outside the split domains to be refused, got %v", msg.Header.RCode)
+	}
+
+	s := x.resolver.snapshot()
+	if s.Queries != 7 || s.LocalAnswers != 2 || s.CacheHits != 2 || s.CacheMisses != 2 || s.NegativeAnswers != 1 || s.Refused != 1 || s.CacheEntries != 2 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	if len(s.Upstreams) != 1 || s.Upstreams[0].Server != upstream || s.Upstreams[0].Queries != 2 {
+		t.Errorf("unexpected upstream stats: %+v", s.Upstreams)
+	}
+
+	// A reload with other upstreams flushes the cache
+	if err := c.ReloadConfigString("tower:\n  dns:\n    mirror: " + upstream + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if s := x.resolver.snapshot(); s.CacheEntries != 0 {
+		t.Errorf("expected the cache to be flushed, it holds %d answers", s.CacheEntries)
+	}
+}
+
+// The function `TestSplitDNSSettings` tests that "tower" stands for the towers of `tower.hosts` on the
+// port of `tower.dns.port`, and that points are not taken for towers.
+func TestSplitDNSSettings(t *testing.T) {
+	settings, err := loadSettings(`points:
+  "10.1.0.9": ["203.0.113.9:4242"]
+tower:
+  hosts: ["10.1.0.2", "10.1.0.1", "10.1.0.2"]
+  dns:
+    port: 5353
+    mirror: tower
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, fallback, err := splitDNSSettings(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.1.0.1:5353", "10.1.0.2:5353"}; !reflect.DeepEqual(fallback, want) {
+		t.Errorf("expected the mirror %v, got %v", want, fallback)
+	}
+
+	settings["tower"] = map[string]any{"dns": map[string]any{"mirror": "tower"}}
+	if _, _, _, err := splitDNSSettings(settings); err == nil {
+		t.Error("expected an error without tower.hosts")
+	}
+}
+
+// The function `TestStartSplitDNSTwice` tests that starting the running resolver again fails without
+// reconfiguring it.
+func TestStartSplitDNSTwice(t *testing.T) {
+	configData := "tower:\n  dns:\n    upstreams:\n      - domains: [corp.example]\n        servers: [\"10.2.0.53\"]\n"
+
+	l := logger.New(1000)
+	l.SetOutput(io.Discard)
+	c := cfg.NewC(l)
+	if err := c.LoadString(configData); err != nil {
+		t.Fatal(err)
+	}
+	x := &Bulk{l: l, config: c, lastGood: configData, active: configData}
+
+	if _, err := x.StartSplitDNS("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.StopSplitDNS()
+
+	x.mu.Lock()
+	x.active = "tower:\n  dns:\n    mirror: 10.3.0.53\n"
+	x.mu.Unlock()
+
+	if _, err := x.StartSplitDNS("127.0.0.1:0"); err == nil {
+		t.Error("expected starting the running resolver to fail")
+	}
+
+	x.resolver.mu.Lock()
+	defer x.resolver.mu.Unlock()
+	if len(x.resolver.rules) != 1 || len(x.resolver.fallback) != 0 {
+		t.Errorf("expected the running resolver to keep its upstreams, got %v and %v", x.resolver.rules, x.resolver.fallback)
+	}
+}
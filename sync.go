@@ -0,0 +1,463 @@
+package mobile
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The outcomes of a single config sync.
+const (
+	SyncUpdated     = "updated"
+	SyncNotModified = "not_modified"
+	SyncFailed      = "failed"
+	SyncDisabled    = "disabled"
+)
+
+const (
+	defaultSyncInterval = 10 * time.Minute
+	minSyncInterval     = 10 * time.Second
+	syncRequestTimeout  = 30 * time.Second
+	maxSyncConfigSize   = 4 << 20
+)
+
+// The SyncResult type reports the outcome of a single config sync.
+// @property {string} State - One of `SyncUpdated`, `SyncNotModified`, `SyncFailed` or `SyncDisabled`.
+// @property {string} Source - The URL the config was fetched from.
+// @property {string} ETag - The entity tag the source returned, if any.
+// @property {string} Error - Why the sync failed.
+// @property {bool} Persisted - Whether the merged config was written to `sync.store`, encrypted with
+// the keystore key the `Bulk` was started with.
+// @property {ReloadResult} Reload - The result of applying the merged config, if it was applied.
+// @property Time - The time the sync finished.
+type SyncResult struct {
+	State     string
+	Source    string
+	ETag      string
+	Error     string
+	Persisted bool
+	Reload    *ReloadResult
+	Time      time.Time
+}
+
+// The syncState type holds the state of the sync subsystem of a `Bulk` instance.
+// @property mu - Serializes syncs so only one runs at a time.
+// @property etag - The entity tag of the last fetched config, sent as If-None-Match.
+// @property lastModified - The Last-Modified header of the last fetched config, sent as
+// If-Modified-Since.
+// @property stop - Closed to stop the background sync loop, nil when the loop is not running.
+// @property done - Closed once the background sync loop has returned.
+// @property last - The result of the most recent sync.
+type syncState struct {
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	stop         chan struct{}
+	done         chan struct{}
+	last         *SyncResult
+}
+
+// The syncFetch type is a config fetched from a sync source.
+type syncFetch struct {
+	body         []byte
+	etag         string
+	lastModified string
+	notModified  bool
+}
+
+// The `StartSync` method starts the background loop that periodically syncs the config from
+// `sync.source`. It does nothing if the loop is already running or `sync.enable` is not set.
+func (x *Bulk) StartSync() {
+	if !x.syncSettings().Enable {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.syncer.stop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	x.syncer.stop = stop
+	x.syncer.done = done
+	go x.runSync(stop, done)
+}
+
+// The `StopSync` method stops the background sync loop. A sync in flight is cancelled and waited for,
+// so no config is applied or persisted once it returns.
+func (x *Bulk) StopSync() {
+	x.mu.Lock()
+	stop, done := x.syncer.stop, x.syncer.done
+	x.syncer.stop = nil
+	x.syncer.done = nil
+	x.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	// Waits for a sync started by SyncNow
+	x.syncer.mu.Lock()
+	x.syncer.mu.Unlock()
+}
+
+// The `SyncNow` method syncs the config from `sync.source` immediately and returns the JSON encoded
+// `SyncResult`.
+func (x *Bulk) SyncNow() (string, error) {
+	return marshalJSON(x.syncOnce(context.Background()))
+}
+
+// The `LastSyncResult` method returns the JSON encoded `SyncResult` of the most recent sync, or `null`
+// when no sync has run yet.
+func (x *Bulk) LastSyncResult() (string, error) {
+	x.syncer.mu.Lock()
+	defer x.syncer.mu.Unlock()
+	return marshalJSON(x.syncer.last)
+}
+
+// The `runSync` method syncs once and then again every `sync.interval` until `stop` is closed, which
+// also cancels a sync in flight. The interval is read again after every sync, so a reloaded config
+// takes effect on the next round. `done` is closed once it returns.
+func (x *Bulk) runSync(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		x.syncOnce(ctx)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(syncInterval(x.syncSettings())):
+		}
+	}
+}
+
+// The `syncOnce` method fetches the config from `sync.source`, merges the `sync.addition` overlay,
+// applies the result with `Reload` and persists it to `sync.store` when `sync.persistent` is set.
+func (x *Bulk) syncOnce(ctx context.Context) *SyncResult {
+	x.syncer.mu.Lock()
+	defer x.syncer.mu.Unlock()
+
+	s := x.syncSettings()
+	r := &SyncResult{Source: s.Source}
+	defer func() {
+		r.Time = time.Now()
+		x.syncer.last = r
+		if r.State == SyncFailed {
+			x.l.Warn("Config sync from %s failed: %s", r.Source, r.Error)
+		}
+		x.emit("sync", r)
+	}()
+
+	if !s.Enable {
+		r.State = SyncDisabled
+		return r
+	}
+
+	client := &http.Client{Timeout: syncRequestTimeout}
+	f, err := fetchSyncConfig(ctx, client, s.Source, x.syncer.etag, x.syncer.lastModified)
+	if err != nil {
+		r.State = SyncFailed
+		r.Error = err.Error()
+		return r
+	}
+
+	if f.notModified {
+		r.State = SyncNotModified
+		r.ETag = x.syncer.etag
+		return r
+	}
+
+	configData, err := x.mergeSyncConfig(string(f.body), s.RequireSigned)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		r.State = SyncFailed
+		r.Error = err.Error()
+		return r
+	}
+
+	r.Reload = x.reload(configData)
+	if r.Reload.rejected() {
+		r.State = SyncFailed
+		r.Error = r.Reload.Reason
+		return r
+	}
+
+	x.syncer.etag = f.etag
+	x.syncer.lastModified = f.lastModified
+	r.ETag = f.etag
+	r.State = SyncUpdated
+
+	if s.Persistent && s.Store != "" {
+		if err := x.persistSyncConfig(s.Store, configData); err != nil {
+			r.Error = fmt.Sprintf("failed to persist config: %s", err)
+			return r
+		}
+		r.Persisted = true
+	}
+
+	return r
+}
+
+// The `persistSyncConfig` method writes a synced config to `store`. It is encrypted with the keystore
+// key the `Bulk` was started with, and a config holding secrets is never written in plaintext.
+func (x *Bulk) persistSyncConfig(store string, configData string) error {
+	if x.storeKey != nil {
+		encrypted, err := EncryptConfig(configData, rawKeyPrefix+base64.StdEncoding.EncodeToString(x.storeKey))
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(store, []byte(encrypted))
+	}
+
+	settings, err := loadSettings(configData)
+	if err != nil {
+		return err
+	}
+
+	if hasPlaintextSecrets(settings, nil) {
+		return errors.New("config holds secrets, start with NewBulkFromEncryptedConfig to store it encrypted")
+	}
+
+	return writeFileAtomic(store, []byte(configData))
+}
+
+// The `templateSettings` method returns the settings of the last-known-good config as written, with
+// references unresolved.
+func (x *Bulk) templateSettings() map[string]any {
+	x.mu.Lock()
+	configData := x.lastGood
+	x.mu.Unlock()
+
+	settings, err := loadSettings(configData)
+	if err != nil {
+		return map[string]any{}
+	}
+
+	return settings
+}
+
+// The `syncSettings` method returns the `sync` section of the active config.
+func (x *Bulk) syncSettings() Sync {
+	x.mu.Lock()
+	section, _ := lookupPath(x.appliedSettings(), "sync")
+	x.mu.Unlock()
+
+	var s Sync
+	b, err := json.Marshal(section)
+	if err == nil {
+		_ = json.Unmarshal(b, &s)
+	}
+
+	return s
+}
+
+// The `mergeSyncConfig` method verifies a fetched config bundle against the active CA and merges the
+// `sync.addition` overlay into the config. With `requireSigned` set, anything but a config bundle is
+// rejected. The `sync` section and `pki.ca` are kept from the active config unless the fetched config
+// is a bundle signed for the active CA that sets them, so a sync server can neither switch signing off
+// nor point later syncs elsewhere.
+func (x *Bulk) mergeSyncConfig(fetched string, requireSigned bool) (string, error) {
+	signed := isConfigBundle(fetched)
+	if requireSigned && !signed {
+		return "", errors.New("sync.require_signed is set and the fetched config is not a signed config bundle")
+	}
+
+	x.mu.Lock()
+	ca, _ := lookupPath(x.appliedSettings(), "pki.ca")
+	x.mu.Unlock()
+
+	caPEM, _ := ca.(string)
+	fetched, err := prepareConfig(fetched, caPEM)
+	if err != nil {
+		return "", err
+	}
+
+	settings, err := loadSettings(fetched)
+	if err != nil {
+		return "", err
+	}
+
+	if len(settings) == 0 {
+		return "", errors.New("fetched config is empty")
+	}
+
+	// The kept settings are taken from the unresolved config, so resolved secrets are never persisted
+	local := x.templateSettings()
+	for _, path := range []string{"sync", "pki.ca"} {
+		if _, ok := lookupPath(settings, path); ok && signed {
+			continue
+		}
+
+		if v, ok := lookupPath(local, path); ok {
+			setPath(settings, path, v)
+		} else if pki, _ := settings["pki"].(map[string]any); path == "pki.ca" && pki != nil {
+			delete(pki, "ca")
+		} else {
+			delete(settings, path)
+		}
+	}
+
+	merged := any(settings)
+	if s, _ := lookupPath(local, "sync.addition"); s != nil && s != "" {
+		addition, err := loadSettings(fmt.Sprint(s))
+		if err != nil {
+			return "", fmt.Errorf("invalid sync addition: %s", err)
+		}
+		merged = mergeSettings(merged, addition)
+	}
+
+	return marshalJSON(merged)
+}
+
+// The function `fetchSyncConfig` fetches a config from an HTTP(S) source. The entity tag and
+// modification time of the previous fetch are sent so an unchanged config is not downloaded again.
+func fetchSyncConfig(ctx context.Context, client *http.Client, source string, etag string, lastModified string) (*syncFetch, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sync source: %s", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported sync source scheme: %q", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return &syncFetch{notModified: true}, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status from sync source: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSyncConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxSyncConfigSize {
+		return nil, errors.New("fetched config is too large")
+	}
+
+	return &syncFetch{
+		body:         body,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// The function `syncInterval` parses `sync.interval`, falling back to the default when it is missing
+// or invalid.
+func syncInterval(s Sync) time.Duration {
+	d, err := time.ParseDuration(s.Interval)
+	if err != nil || d <= 0 {
+		return defaultSyncInterval
+	}
+
+	if d < minSyncInterval {
+		return minSyncInterval
+	}
+
+	return d
+}
+
+// The function `hasPlaintextSecrets` reports whether a settings tree holds a secret that is not a
+// `${...}` reference. `path` is the location of `v` in the tree.
+func hasPlaintextSecrets(v any, path []string) bool {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			if hasPlaintextSecrets(val, append(path[:len(path):len(path)], k)) {
+				return true
+			}
+		}
+	case []any:
+		for i, val := range t {
+			if hasPlaintextSecrets(val, append(path[:len(path):len(path)], fmt.Sprint(i))) {
+				return true
+			}
+		}
+	case nil:
+	case string:
+		if pathIs(path, additionPath) {
+			addition, err := loadSettings(t)
+			return err != nil || hasPlaintextSecrets(addition, nil)
+		}
+
+		ref := strings.HasPrefix(t, "${") && strings.Index(t, "}") == len(t)-1
+		return isSecretPath(path) && t != "" && !ref
+	default:
+		return isSecretPath(path)
+	}
+
+	return false
+}
+
+// The function `writeFileAtomic` writes data to a temporary file next to `path` and renames it into
+// place, so a crash never leaves a partially written config behind.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,202 @@
+package mobile
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cfg "git.weixin.qq.com/__/vlan/lib/config"
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+	"git.weixin.qq.com/__/vlan/lib/utils/logs/logger"
+)
+
+// The function `TestSyncNow` tests fetching a config from a local sync source, merging the addition
+// overlay, persisting it and skipping the download once the source reports it as unchanged.
+func TestSyncNow(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, "punchy:\n  enable: false\nlogging:\n  level: info\n")
+	}))
+	defer srv.Close()
+
+	store := filepath.Join(t.TempDir(), "config.json")
+	configData := strings.Join([]string{
+		"sync:",
+		"  enable: true",
+		"  persistent: true",
+		"  source: " + srv.URL,
+		"  store: " + store,
+		"  addition: 'logging: {level: debug}'",
+	}, "\n")
+
+	l := logger.New(1000)
+	l.SetOutput(io.Discard)
+	c := cfg.NewC(l)
+	if err := c.LoadString(configData); err != nil {
+		t.Fatal(err)
+	}
+	x := &Bulk{l: l, config: c, lastGood: configData, active: configData}
+
+	r := x.syncOnce(context.Background())
+	if r.State != SyncUpdated || !r.Persisted || r.ETag != `"v1"` {
+		t.Fatalf("unexpected sync result: %+v", r)
+	}
+
+	if got := x.config.GetString("logging.level", ""); got != "debug" {
+		t.Errorf("addition overlay not applied, logging.level = %q", got)
+	}
+
+	if got := x.config.GetString("sync.source", ""); got != srv.URL {
+		t.Errorf("sync section not kept, sync.source = %q", got)
+	}
+
+	stored, err := os.ReadFile(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetConfigSetting(string(stored), "punchy.enable"); got != "false" {
+		t.Errorf("stored config has punchy.enable = %q", got)
+	}
+
+	if r = x.syncOnce(context.Background()); r.State != SyncNotModified {
+		t.Fatalf("expected not modified, got %+v", r)
+	}
+
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+// The function `newSyncBulk` returns a `Bulk` running a config that syncs from `source` into `store`.
+func newSyncBulk(t *testing.T, source string, store string, extra string) *Bulk {
+	t.Helper()
+
+	configData := "sync:\n  enable: true\n  persistent: true\n  source: " + source + "\n  store: " + store + "\n" + extra
+	l := logger.New(1000)
+	l.SetOutput(io.Discard)
+	c := cfg.NewC(l)
+	if err := c.LoadString(configData); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Bulk{l: l, config: c, lastGood: configData, active: configData}
+}
+
+// The function `TestSyncSecrets` tests that a synced config holding secrets is only persisted
+// encrypted with the keystore key, and that `sync.require_signed` rejects plain configs.
+func TestSyncSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pki:\n  key: private\n")
+	}))
+	defer srv.Close()
+
+	store := filepath.Join(t.TempDir(), "config.json")
+	x := newSyncBulk(t, srv.URL, store, "")
+	if r := x.syncOnce(context.Background()); r.State != SyncUpdated || r.Persisted || !strings.Contains(r.Error, "secrets") {
+		t.Errorf("expected the plaintext config not to be persisted, got %+v", r)
+	}
+	if _, err := os.Stat(store); !os.IsNotExist(err) {
+		t.Errorf("expected no stored config, got %v", err)
+	}
+
+	key := make([]byte, 32)
+	x.storeKey = key
+	if r := x.syncOnce(context.Background()); !r.Persisted {
+		t.Fatalf("expected the config to be persisted, got %+v", r)
+	}
+
+	stored, err := os.ReadFile(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), "private") {
+		t.Error("stored config holds the plaintext key")
+	}
+	configData, err := DecryptConfig(string(stored), rawKeyPrefix+base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetConfigSetting(configData, "pki.key"); got != "private" {
+		t.Errorf("stored config has pki.key = %q", got)
+	}
+
+	x = newSyncBulk(t, srv.URL, store, "  require_signed: true\n")
+	if r := x.syncOnce(context.Background()); r.State != SyncFailed || !strings.Contains(r.Error, "require_signed") {
+		t.Errorf("expected the unsigned config to be rejected, got %+v", r)
+	}
+	if x.config.IsSet("pki.key") {
+		t.Error("expected the unsigned config not to be applied")
+	}
+}
+
+// The function `TestStopSync` tests that `StopSync` cancels a sync in flight and waits for it.
+func TestStopSync(t *testing.T) {
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	x := newSyncBulk(t, srv.URL, filepath.Join(t.TempDir(), "config.json"), "")
+	x.StartSync()
+	<-started
+	x.StopSync()
+
+	x.syncer.mu.Lock()
+	last := x.syncer.last
+	x.syncer.mu.Unlock()
+	if last == nil || last.State != SyncFailed {
+		t.Errorf("expected the sync in flight to be finished, got %+v", last)
+	}
+}
+
+// The function `TestSyncKeepsLocalSettings` tests that a synced config only replaces the sync section
+// and `pki.ca` when it is a bundle signed by the active CA.
+func TestSyncKeepsLocalSettings(t *testing.T) {
+	_, caPEM, caKey := newTestSigner(t, cert.Curve_X25519, "ca", nil, nil, nil)
+	ca := strings.ReplaceAll(caPEM, "\n", "\\n")
+	x := newSyncBulk(t, "https://sync.example.com", filepath.Join(t.TempDir(), "config.json"), "  require_signed: false\npki:\n  ca: \""+ca+"\"\n")
+
+	fetched := "sync:\n  source: https://evil.example.com\n  require_signed: false\npki:\n  ca: evil\npunchy:\n  punch: true\n"
+	merged, err := x.mergeSyncConfig(fetched, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetConfigSetting(merged, "sync.source"); got != "https://sync.example.com" {
+		t.Errorf("expected the unsigned config to keep the local sync source, got %q", got)
+	}
+	if got := GetConfigSetting(merged, "pki.ca"); got != caPEM {
+		t.Errorf("expected the unsigned config to keep the local CA, got %q", got)
+	}
+	if got := GetConfigSetting(merged, "punchy.punch"); got != "true" {
+		t.Errorf("expected the rest of the fetched config to be applied, got punchy.punch = %q", got)
+	}
+
+	bundle, err := SignConfigBundle("sync:\n  enable: true\n  source: https://next.example.com\n", caPEM, signingKeyPEM(caKey), 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err = x.mergeSyncConfig(bundle, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetConfigSetting(merged, "sync.source"); got != "https://next.example.com" {
+		t.Errorf("expected the signed config to replace the sync source, got %q", got)
+	}
+	if got := GetConfigSetting(merged, "pki.ca"); got != caPEM {
+		t.Errorf("expected the local CA to be kept when the signed config has none, got %q", got)
+	}
+}
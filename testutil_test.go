@@ -0,0 +1,88 @@
+package mobile
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"git.weixin.qq.com/__/vlan/lib/utils/cert"
+	"github.com/emmansun/gmsm/sm2"
+)
+
+// The function `newTestSigner` creates a cert for `curve` signed by `issuer`, or self-signed when
+// `issuer` is nil, and returns it with its PEM encoded cert and private key.
+func newTestSigner(t *testing.T, curve cert.Curve, name string, groups []string, issuer *cert.Certificate, issuerKey []byte) (*cert.Certificate, string, []byte) {
+	t.Helper()
+
+	var pub, priv []byte
+	switch curve {
+	case cert.Curve_X25519:
+		p, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, priv = p, k
+	case cert.Curve_P256:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, priv = elliptic.Marshal(elliptic.P256(), k.X, k.Y), k.D.FillBytes(make([]byte, 32))
+	case cert.Curve_SM2:
+		k, err := sm2.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, priv = elliptic.Marshal(sm2.P256(), k.X, k.Y), k.D.FillBytes(make([]byte, 32))
+	}
+
+	now := time.Now()
+	c := &cert.Certificate{Details: cert.CertificateDetails{
+		Name:      name,
+		Groups:    groups,
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(24 * time.Hour),
+		PublicKey: pub,
+		IsCA:      true,
+		Curve:     curve,
+	}}
+
+	if issuer == nil {
+		issuerKey = priv
+	}
+
+	return c, signTestCert(t, c, issuer, issuerKey), priv
+}
+
+// The function `signTestCert` signs a cert with the key of `issuer`, or with `issuerKey` alone when
+// the cert is self-signed, and returns it PEM encoded.
+func signTestCert(t *testing.T, c *cert.Certificate, issuer *cert.Certificate, issuerKey []byte) string {
+	t.Helper()
+
+	if issuer != nil {
+		sum, err := issuer.Sha256Sum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Details.Issuer = sum
+	}
+	if err := c.Sign(c.Details.Curve, issuerKey); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := c.MarshalToPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// The function `signingKeyPEM` encodes a raw signing key for `SignConfigBundle`.
+func signingKeyPEM(key []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "VLAN SIGNING PRIVATE KEY", Bytes: key}))
+}